@@ -16,34 +16,13 @@
 package build
 
 import (
-	"bytes"
-	"fmt"
-	"html/template"
-)
-
-const html = `
-<html>
-    <head>
-        <title>Images</title>
-    </head>
-    <body>
-        <h1>Images</h1>
-        {{range .}}<img src="/ipfs/{{.}}" style="max-width:100%; max-height:100vh; margin:auto" />
-        {{end}}
-    </body>
-</html>
-`
+	"time"
 
-func IndexHTML(hashes ...string) ([]byte, error) {
-	t, err := template.New("index.html").Parse(html)
-	if err != nil {
-		return nil, fmt.Errorf("internal error: cannot parse default index.html template: %w", err)
-	}
+	"github.com/wpengine/hackathon-catation/pup/album"
+)
 
-	var buf bytes.Buffer
-	err = t.Execute(&buf, hashes)
-	if err != nil {
-		return nil, fmt.Errorf("building index.html: %w", err)
-	}
-	return buf.Bytes(), nil
+// IndexHTML renders index.html of a new album with the name, showing the
+// images.
+func IndexHTML(name string, hashes ...string) ([]byte, error) {
+	return album.IndexHTML(name, time.Now(), hashes...)
 }
@@ -31,9 +31,13 @@ import (
 func main() {
 	internal.PrintGPLBanner("catation", "2020")
 
+	var opts ipfs.Options
+	flag.StringVar(&opts.RepoPath, "repo", "", "path of the IPFS repository (default: per-user data directory)")
+	flag.BoolVar(&opts.InMemory, "in-memory", false, "keep IPFS data in memory only")
 	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), "usage: downloader <cid> <destination>\n\n")
-		fmt.Fprintf(flag.CommandLine.Output(), "Download a CID from IPFS to a destination path.\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: downloader [flags] <cid> <destination>\n\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "Download a CID from IPFS to a destination path.\n\n")
+		flag.PrintDefaults()
 	}
 	flag.Parse()
 
@@ -42,7 +46,7 @@ func main() {
 		os.Exit(2)
 	}
 
-	node, err := ipfs.Start()
+	node, err := ipfs.Start(opts)
 	if err != nil {
 		panic(err)
 	}
@@ -67,7 +67,7 @@ func (u *UI) layout(gtx layout.Context) {
 			}
 		}
 
-		link := pinata.Upload(paths)
+		link := pinata.Upload("Images", paths)
 		_ = exec.Command("open", link).Start()
 	}
 
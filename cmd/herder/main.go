@@ -19,6 +19,8 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"image"
 	"image/jpeg"
@@ -39,20 +41,49 @@ import (
 	"github.com/wpengine/hackathon-catation/cmd/uploader/ipfs"
 	"github.com/wpengine/hackathon-catation/internal"
 	"github.com/wpengine/hackathon-catation/pup"
+	"github.com/wpengine/hackathon-catation/pup/album"
+	"github.com/wpengine/hackathon-catation/pup/car"
+	"github.com/wpengine/hackathon-catation/pup/cluster"
 	"github.com/wpengine/hackathon-catation/pup/eternum"
+	"github.com/wpengine/hackathon-catation/pup/ipfsnode"
 	"github.com/wpengine/hackathon-catation/pup/pinata"
 	"github.com/wpengine/hackathon-catation/pup/pipin"
+	"github.com/wpengine/hackathon-catation/pup/psa"
+	"github.com/wpengine/hackathon-catation/pup/s3"
+	"github.com/wpengine/hackathon-catation/pup/temporal"
 )
 
 type config struct {
-	Pinata  *pinata.API
-	Pipin   *pipin.Client
-	Eternum *eternum.Client
+	Pinata   *pinata.API
+	Pipin    *pipin.Client
+	Eternum  *eternum.Client
+	Temporal *temporal.Client
+	// Local shows the IPFS node embedded in Herder as a pinning service
+	Local bool `json:",omitempty"`
+	// Daemons are IPFS nodes controlled via their HTTP RPC API, e.g. the
+	// IPFS Desktop app
+	Daemons []*ipfsnode.Node
+	// Clusters are ipfs-clusters controlled via the REST API of one of
+	// their peers
+	Clusters []*cluster.Client
+	// S3 are buckets of S3-compatible services, where DAGs are archived as
+	// CAR files exported from the IPFS node embedded in Herder
+	S3 []*s3.Store
+	// Directories are local directories, e.g. on an external drive, where
+	// DAGs are archived like in S3
+	Directories []*car.Dir
+	// Services are any providers implementing the IPFS Pinning Service API
+	Services []*psa.Client
 }
 
 func main() {
 	internal.PrintGPLBanner("herder", "2020")
 
+	var ipfsOpts ipfs.Options
+	flag.StringVar(&ipfsOpts.RepoPath, "repo", "", "path of the IPFS repository (default: per-user data directory)")
+	flag.BoolVar(&ipfsOpts.InMemory, "in-memory", false, "keep IPFS data in memory only")
+	flag.Parse()
+
 	trigger := make(chan struct{}, 1)
 	trigger <- struct{}{}
 	TRIGGER := func() {
@@ -74,7 +105,7 @@ func main() {
 	cfg := readConfig()
 
 	// Start IPFS
-	node, err := ipfs.Start()
+	node, err := ipfs.Start(ipfsOpts)
 	if err != nil {
 		panic(err)
 	}
@@ -96,32 +127,82 @@ func main() {
 	if cfg.Eternum != nil {
 		pups = append(pups, pupColumn{len(pups), "eternum", cfg.Eternum})
 	}
+	if cfg.Temporal != nil {
+		pups = append(pups, pupColumn{len(pups), "temporal", cfg.Temporal})
+	}
+	if cfg.Local {
+		pups = append(pups, pupColumn{len(pups), "this machine", ipfsnode.New(node.API)})
+	}
+	for _, d := range cfg.Daemons {
+		name := d.Name
+		if name == "" {
+			name = d.URL
+		}
+		pups = append(pups, pupColumn{len(pups), name, d})
+	}
+	for _, c := range cfg.Clusters {
+		name := c.Name
+		if name == "" {
+			name = c.URL
+		}
+		pups = append(pups, pupColumn{len(pups), name, c})
+	}
+	for _, st := range cfg.S3 {
+		name := st.Name
+		if name == "" {
+			name = "s3://" + st.Bucket + "/" + st.Prefix
+		}
+		pups = append(pups, pupColumn{len(pups), name, car.NewArchive(node.API, st)})
+	}
+	for _, d := range cfg.Directories {
+		name := d.Name
+		if name == "" {
+			name = d.Path
+		}
+		pups = append(pups, pupColumn{len(pups), name, car.NewArchive(node.API, d)})
+	}
+	for _, s := range cfg.Services {
+		name := s.Name
+		if name == "" {
+			name = s.BaseURL
+		}
+		pups = append(pups, pupColumn{len(pups), name, s})
+	}
 
 	// In a background loop, start fetching hashes from pups, to be fed into
 	// the GUI table.
 	//
-	// rowChange is a message describing how the GUI should toggle a checkbox
-	// for a particular file's row
+	// rowChange is a message describing how the GUI should change a pup's
+	// status cell for a particular file's row
 	type rowChange struct {
-		*file        // basic data of the row (esp. in case it needs to be newly added)
-		ipup    int  // which pup's checkbox to change
-		checked bool // to what state should the pup's checkbox be changed
+		*file                // basic data of the row (esp. in case it needs to be newly added)
+		ipup   int           // which pup's cell to change
+		status pup.PinStatus // to what state should the pup's cell be changed
 	}
 	rowChanges := make(chan rowChange, 100)
 	go func() {
 		hashes := map[string]*file{}
+		disabled := map[int]bool{} // pups which rejected our credentials
 		// Infinite loop, iterating over all pups
 		for {
 			<-trigger
 			for ii := 0; ii < 2; ii++ {
 				for _, p := range pups {
+					if disabled[p.i] {
+						continue
+					}
 					ctx := context.Background()
-					ctx, release := context.WithTimeout(ctx, 10*time.Second)
+					ctx, release := context.WithTimeout(ctx, time.Minute)
 					// TODO: protect against panic
 					cids, err := p.Fetch(ctx, nil)
 					release()
+					if errors.Is(err, pup.ErrUnauthorized) {
+						log.Printf("Cannot fetch from %q, disabling it: %s", p.name, describe(err))
+						disabled[p.i] = true
+						continue
+					}
 					if err != nil {
-						log.Printf("Cannot fetch from %q: %s", p.name, err)
+						log.Printf("Cannot fetch from %q: %s", p.name, describe(err))
 						continue
 					}
 					log.Printf("Fetched %v items from %q", len(cids), p.name)
@@ -134,7 +215,7 @@ func main() {
 						// log.Printf("%q TEST %s fetched? %v", p.name, f.hash, fetched[f.hash])
 						if !fetched[f.hash] {
 							// log.Printf("FETCH UNPIN %s @ %v %q", f.hash, p.i, p.name)
-							rowChanges <- rowChange{f, p.i, false}
+							rowChanges <- rowChange{f, p.i, pup.StatusUnpinned}
 						}
 					}
 					// Add missing hashes
@@ -142,10 +223,9 @@ func main() {
 						f := &file{
 							hash:     c.Hash,
 							filename: c.Name,
-							pinned:   make([]bool, len(pups)),
 						}
 						hashes[f.hash] = f // TODO: do we need this Map? seems unused elsewhere
-						rowChanges <- rowChange{f, p.i, true}
+						rowChanges <- rowChange{f, p.i, pup.StatusPinned}
 					}
 				}
 				// time.Sleep(1 * time.Second)
@@ -165,8 +245,152 @@ func main() {
 	rowsByHash := map[string]struct {
 		y        int
 		statuses []gwu.Panel
+		labels   []gwu.Label
+		pending  []bool // is the pup still working on pinning?
 	}{}
 	t := gwu.NewTable()
+
+	// Albums are shown in a separate table, with actions working on all
+	// their hashes at once. They are discovered when fetching thumbnails.
+	type albumRow struct {
+		*album.Album
+		counts []gwu.Label // how many of album's hashes are pinned, per pup
+	}
+	albumRows := map[string]*albumRow{}     // by root hash
+	albumLabels := map[string][]gwu.Label{} // Album cells in files table, by hash
+	pinnedIn := map[string][]bool{}         // whether hash is pinned, per pup
+	albumsFound := make(chan *album.Album, 100)
+	at := gwu.NewTable()
+	win.Add(gwu.NewHTML(`<h2>Albums</h2>`))
+	win.Add(at)
+	at.SetBorder(1)
+	at.SetCellPadding(2)
+	at.EnsureSize(1, 5+len(pups))
+	at.Add(gwu.NewLabel("Title"), 0, 0)
+	at.Add(gwu.NewLabel("Created"), 0, 1)
+	at.Add(gwu.NewLabel("Hash"), 0, 2)
+	at.Add(gwu.NewLabel("Images"), 0, 3)
+	for _, p := range pups {
+		at.Add(gwu.NewLabel(p.name), 0, 4+p.i)
+	}
+	refreshAlbums := func() {
+		for _, r := range albumRows {
+			for _, p := range pups {
+				n := 0
+				for _, h := range r.Hashes() {
+					if pinnedIn[h] != nil && pinnedIn[h][p.i] {
+						n++
+					}
+				}
+				r.counts[p.i].SetText(fmt.Sprintf("%d/%d", n, len(r.Hashes())))
+			}
+		}
+	}
+	// keepOtherAlbums returns hashes of albums other than a, which must
+	// not be unpinned together with a.
+	keepOtherAlbums := func(a *album.Album) map[pup.Hash]bool {
+		keep := map[pup.Hash]bool{}
+		for _, r := range albumRows {
+			if r.Root == a.Root {
+				continue
+			}
+			for _, h := range r.Hashes() {
+				keep[h] = true
+			}
+		}
+		return keep
+	}
+	// backgroundOp runs op in background, retrying it later on temporary
+	// errors, and triggers a refresh once it succeeds.
+	backgroundOp := func(what string, p pupColumn, op func(ctx context.Context) error) {
+		go func() {
+			ctx, release := context.WithTimeout(context.Background(), 5*time.Minute)
+			defer release()
+			err := op(ctx)
+			if pup.IsRetryable(err) {
+				log.Printf("%s.%s error, will retry: %s", p.name, what, describe(err))
+				retryLater(p.name+"."+what, err, op, TRIGGER)
+				return
+			}
+			if err != nil {
+				log.Printf("%s.%s error: %s", p.name, what, describe(err))
+				return
+			}
+			log.Printf("%s.%s success", p.name, what)
+			TRIGGER()
+		}()
+	}
+	addAlbum := func(a *album.Album) {
+		if albumRows[a.Root] != nil {
+			return
+		}
+		r := &albumRow{Album: a}
+		albumRows[a.Root] = r
+		y := len(albumRows)
+		created := ""
+		if !a.Created.IsZero() {
+			created = a.Created.Local().Format("2006-01-02 15:04")
+		}
+		at.Add(gwu.NewLabel(a.Title), y, 0)
+		at.Add(gwu.NewLabel(created), y, 1)
+		at.Add(gwu.NewLabel(a.Root), y, 2)
+		at.Add(gwu.NewLabel(fmt.Sprint(len(a.Members))), y, 3)
+		for _, p := range pups {
+			p := p // capture the loop variable for use in closures
+
+			cell := gwu.NewHorizontalPanel()
+			at.Add(cell, y, 4+p.i)
+			cell.SetCellPadding(5)
+			add := gwu.NewButton("📌")
+			cell.Add(add)
+			add.AddEHandlerFunc(func(e gwu.Event) {
+				backgroundOp("PinAlbum", p, func(ctx context.Context) error {
+					return album.Pin(ctx, p.Pup, a)
+				})
+			}, gwu.ETypeClick)
+			if pup.CanUnpin(p.Pup) {
+				rm := gwu.NewButton("🗑")
+				cell.Add(rm)
+				rm.AddEHandlerFunc(func(e gwu.Event) {
+					keep := keepOtherAlbums(a)
+					backgroundOp("UnpinAlbum", p, func(ctx context.Context) error {
+						return album.Unpin(ctx, p.Pup, a, keep)
+					})
+				}, gwu.ETypeClick)
+			}
+			label := gwu.NewLabel("")
+			cell.Add(label)
+			r.counts = append(r.counts, label)
+		}
+		replicate := gwu.NewButton("📌 everywhere")
+		at.Add(replicate, y, 4+len(pups))
+		replicate.AddEHandlerFunc(func(e gwu.Event) {
+			for _, p := range pups {
+				p := p
+				backgroundOp("PinAlbum", p, func(ctx context.Context) error {
+					return album.Pin(ctx, p.Pup, a)
+				})
+			}
+		}, gwu.ETypeClick)
+
+		for _, h := range a.Hashes() {
+			for _, l := range albumLabels[h] {
+				l.SetText(a.Title)
+			}
+		}
+		refreshAlbums()
+	}
+	// albumTitle returns the title of an album containing hash, if known.
+	albumTitle := func(hash string) string {
+		for _, r := range albumRows {
+			if r.Has(hash) {
+				return r.Title
+			}
+		}
+		return ""
+	}
+
+	win.Add(gwu.NewHTML(`<h2>Files</h2>`))
 	win.Add(t)
 	t.SetBorder(1)
 	t.SetCellPadding(2)
@@ -174,8 +398,9 @@ func main() {
 	t.Add(gwu.NewLabel("Thumbnail"), 0, 0)
 	t.Add(gwu.NewLabel("Hash"), 0, 1)
 	t.Add(gwu.NewLabel("Filename"), 0, 2)
+	t.Add(gwu.NewLabel("Album"), 0, 3)
 	for _, p := range pups {
-		t.Add(gwu.NewLabel(p.name), 0, 3+p.i)
+		t.Add(gwu.NewLabel(p.name), 0, 4+p.i)
 	}
 	// Every second, if there are new rows fetched, add them to the table
 	thumbnailsByHash := sync.Map{}       // map[string][]byte
@@ -199,13 +424,19 @@ func main() {
 						t.Add(gwu.NewImage("", "/hash/"+f.hash), r.y, 0)
 						t.Add(gwu.NewLabel(f.hash), r.y, 1)
 						t.Add(gwu.NewLabel(f.filename), r.y, 2)
+						albumLabel := gwu.NewLabel(albumTitle(f.hash))
+						t.Add(albumLabel, r.y, 3)
+						albumLabels[f.hash] = append(albumLabels[f.hash], albumLabel)
 						for _, p := range pups {
 							p := p // capture the loop variable for use in closures
 
 							cell := gwu.NewHorizontalPanel()
-							t.Add(cell, r.y, 3+p.i)
+							t.Add(cell, r.y, 4+p.i)
 							cell.SetCellPadding(5)
 							r.statuses = append(r.statuses, cell)
+							label := gwu.NewLabel("")
+							r.labels = append(r.labels, label)
+							r.pending = append(r.pending, false)
 
 							// c := gwu.NewCheckBox("")
 							// cell.Add(c)
@@ -218,42 +449,103 @@ func main() {
 								defer release()
 								// TODO: make it more async & faster
 								// log.Printf("--- check %s / %q = %v ---", f.hash, p.name, v)
-								err := p.Pup.Pin(ctx, f.hash)
-								if err != nil {
-									log.Printf("%s.Pin error: %s", p.name, err)
+								err := pinNamed(ctx, p.Pup, f.hash, f.filename)
+								if pup.IsRetryable(err) {
+									log.Printf("%s.Pin error, will retry: %s", p.name, describe(err))
+									retryLater(p.name+".Pin", err, func(ctx context.Context) error {
+										return pinNamed(ctx, p.Pup, f.hash, f.filename)
+									}, TRIGGER)
 									return
 								}
-								log.Printf("%s.Pin success", p.name)
-								TRIGGER()
-							}, gwu.ETypeClick)
-
-							rm := gwu.NewButton("🗑")
-							cell.Add(rm)
-							rm.AddEHandlerFunc(func(e gwu.Event) {
-								ctx, release := context.WithTimeout(context.Background(), 2*time.Second)
-								defer release()
-								// TODO: make it more async & faster
-								// log.Printf("--- check %s / %q = %v ---", f.hash, p.name, v)
-								err := p.Pup.Unpin(ctx, f.hash)
 								if err != nil {
-									log.Printf("%s.Unpin error: %s", p.name, err)
+									log.Printf("%s.Pin error: %s", p.name, describe(err))
 									return
 								}
-								log.Printf("%s.Unpin success", p.name)
+								log.Printf("%s.Pin success", p.name)
+								if sc, ok := p.Pup.(pup.StatusChecker); ok {
+									// Don't block the event handler: the
+									// timer draining rowChanges needs the
+									// session lock we're holding.
+									go func() {
+										rowChanges <- rowChange{f.file, p.i, pup.StatusQueued}
+										waitPinned(sc, p.name, f.hash, func(status pup.PinStatus) {
+											rowChanges <- rowChange{f.file, p.i, status}
+										})
+									}()
+								}
 								TRIGGER()
 							}, gwu.ETypeClick)
+
+							if pup.CanUnpin(p.Pup) {
+								rm := gwu.NewButton("🗑")
+								cell.Add(rm)
+								rm.AddEHandlerFunc(func(e gwu.Event) {
+									ctx, release := context.WithTimeout(context.Background(), 2*time.Second)
+									defer release()
+									// TODO: make it more async & faster
+									// log.Printf("--- check %s / %q = %v ---", f.hash, p.name, v)
+									err := p.Pup.Unpin(ctx, f.hash)
+									if pup.IsRetryable(err) {
+										log.Printf("%s.Unpin error, will retry: %s", p.name, describe(err))
+										retryLater(p.name+".Unpin", err, func(ctx context.Context) error {
+											return p.Pup.Unpin(ctx, f.hash)
+										}, TRIGGER)
+										return
+									}
+									if err != nil {
+										log.Printf("%s.Unpin error: %s", p.name, describe(err))
+										return
+									}
+									log.Printf("%s.Unpin success", p.name)
+									TRIGGER()
+								}, gwu.ETypeClick)
+							}
+							if a, ok := p.Pup.(*car.Archive); ok {
+								// Import the archived DAG into our node, so
+								// that other pups can retrieve it from there
+								restore := gwu.NewButton("♻")
+								cell.Add(restore)
+								restore.AddEHandlerFunc(func(e gwu.Event) {
+									backgroundOp("Restore", p, func(ctx context.Context) error {
+										return a.Restore(ctx, f.hash)
+									})
+								}, gwu.ETypeClick)
+							}
+							cell.Add(label)
 						}
 						e.MarkDirty(t)
-						go fetchThumbnail(thumbnails, &thumbnailsByHash, node, f.hash)
+						go fetchThumbnail(thumbnails, albumsFound, &thumbnailsByHash, node, f.hash)
 					}
 
-					// Change the status of a checkbox
-					if f.checked {
+					// Change the status of a pup's cell. While the pup is
+					// still pinning, it may not list the hash yet, so
+					// ignore the fetched status until pinning completes.
+					switch {
+					case f.status.InProgress():
+						r.pending[f.ipup] = true
+						r.statuses[f.ipup].Style().SetBackground("#ffff00")
+						r.labels[f.ipup].SetText(string(f.status) + "…")
+					case f.status == pup.StatusUnpinned && r.pending[f.ipup]:
+						// still pinning
+					case f.status == pup.StatusPinned:
+						r.pending[f.ipup] = false
 						r.statuses[f.ipup].Style().SetBackground("#00ff00")
-					} else {
+						r.labels[f.ipup].SetText("")
+					case f.status == pup.StatusFailed:
+						r.pending[f.ipup] = false
+						r.statuses[f.ipup].Style().SetBackground("#ff8080")
+						r.labels[f.ipup].SetText("failed")
+					default:
+						r.pending[f.ipup] = false
 						r.statuses[f.ipup].Style().SetBackground("#ffffff")
+						r.labels[f.ipup].SetText("")
 					}
 					rowsByHash[f.hash] = r
+					if pinnedIn[f.hash] == nil {
+						pinnedIn[f.hash] = make([]bool, len(pups))
+					}
+					pinnedIn[f.hash][f.ipup] = f.status == pup.StatusPinned
+					refreshAlbums()
 					// e.MarkDirty(r.statuses[f.ipup])
 					e.MarkDirty(t)
 
@@ -278,6 +570,11 @@ func main() {
 			log.Printf("THUMB %s", h)
 			_ = h // TODO: only refresh specific thumbnail img
 			e.MarkDirty(t)
+		case a := <-albumsFound:
+			log.Printf("ALBUM %s %q", a.Root, a.Title)
+			addAlbum(a)
+			e.MarkDirty(at)
+			e.MarkDirty(t)
 		default:
 		}
 	}, gwu.ETypeStateChange)
@@ -303,15 +600,92 @@ func main() {
 	server.Start("main")
 }
 
+// describe formats err for logging, adding a hint for known pup errors.
+func describe(err error) string {
+	if hint := pup.Hint(err); hint != "" {
+		return fmt.Sprintf("%s (%s)", err, hint)
+	}
+	return err.Error()
+}
+
+// waitPinned waits until the pup finishes pinning hash, reporting progress
+// via the update callback.
+func waitPinned(sc pup.StatusChecker, name, hash string, update func(pup.PinStatus)) {
+	ctx, release := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer release()
+	status, err := pup.WaitPinned(ctx, sc, hash, func(status pup.PinStatus) {
+		if status.InProgress() {
+			update(status)
+		}
+	})
+	if err != nil {
+		log.Printf("%s: %s", name, describe(err))
+		if status != pup.StatusFailed {
+			// We don't know what's going on; clear the cell and let the
+			// next fetch decide.
+			status = ""
+		}
+	}
+	update(status)
+}
+
+// retryLater retries op in background after it failed with a temporary error
+// err, calling done if it eventually succeeds.
+func retryLater(what string, err error, op func(ctx context.Context) error, done func()) {
+	go func() {
+		wait := pup.RetryAfter(err)
+		if wait == 0 {
+			wait = 2 * time.Second
+		}
+		time.Sleep(wait)
+
+		// The pups retry throttled requests themselves, within the timeout
+		ctx, release := context.WithTimeout(context.Background(), time.Minute)
+		defer release()
+		err := op(ctx)
+		if err != nil {
+			log.Printf("%s error after retrying: %s", what, describe(err))
+			return
+		}
+		log.Printf("%s success", what)
+		done()
+	}()
+}
+
+// pinNamed pins the hash, keeping its name known from other pups if the pup
+// supports naming pins.
+func pinNamed(ctx context.Context, p pup.Pup, hash pup.Hash, name string) error {
+	if op, ok := p.(pup.OptionsPinner); ok && name != "" {
+		return op.PinWithOptions(ctx, hash, pup.PinOptions{Metadata: pup.Metadata{Name: name}})
+	}
+	return p.Pin(ctx, hash)
+}
+
 func readConfig() config {
 	raw, err := ioutil.ReadFile("config.json")
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "error: cannot read config.json:", err)
 		fmt.Fprintln(os.Stderr, "HINT: example config.json (not all entries are required!):")
 		v, _ := json.MarshalIndent(config{
-			Pinata:  &pinata.API{},
-			Pipin:   &pipin.Client{},
-			Eternum: &eternum.Client{},
+			Pinata:   &pinata.API{},
+			Pipin:    &pipin.Client{},
+			Eternum:  &eternum.Client{},
+			Temporal: &temporal.Client{},
+			Daemons: []*ipfsnode.Node{
+				{Name: "my desktop", URL: "http://127.0.0.1:5001"},
+			},
+			Clusters: []*cluster.Client{
+				{Name: "my cluster", URL: "http://127.0.0.1:9094"},
+			},
+			S3: []*s3.Store{
+				{Endpoint: "http://127.0.0.1:9000", Bucket: "catation"},
+			},
+			Directories: []*car.Dir{
+				{Name: "USB drive", Path: "/media/usb/catation"},
+			},
+			Services: []*psa.Client{
+				{},
+			},
 		}, "", "  ")
 		fmt.Fprintln(os.Stderr, string(v))
 		os.Exit(1)
@@ -330,7 +704,6 @@ type file struct {
 	// contents []byte
 	filename string
 	hash     string
-	pinned   []bool
 }
 
 func thumbnailImage(r io.Reader, maxw, maxh int) ([]byte, error) {
@@ -376,7 +749,7 @@ func thumbnailImage(r io.Reader, maxw, maxh int) ([]byte, error) {
 	}
 }
 
-func fetchThumbnail(fetched chan<- string, thumbnailsByHash *sync.Map, node *ipfs.Node, hash string) {
+func fetchThumbnail(fetched chan<- string, albums chan<- *album.Album, thumbnailsByHash *sync.Map, node *ipfs.Node, hash string) {
 	log.Printf("%s - starting to fetch...", hash)
 	tree, err := node.API.Unixfs().Get(context.Background(), icorepath.New(hash))
 	if err != nil {
@@ -395,6 +768,18 @@ func fetchThumbnail(fetched chan<- string, thumbnailsByHash *sync.Map, node *ipf
 		thumbnailsByHash.Store(hash, th)
 		log.Printf("%s - DONE", hash)
 		fetched <- hash
+	case ifiles.Directory:
+		a, err := album.Resolve(context.Background(), node.API, hash)
+		if errors.Is(err, album.ErrNotAlbum) {
+			log.Printf("%s - is not an album, ignoring", hash)
+			return
+		}
+		if err != nil {
+			log.Printf("Could not resolve album: %s", err)
+			return
+		}
+		log.Printf("%s - is an album with %d images", hash, len(a.Members))
+		albums <- a
 	default:
 		log.Printf("%s - is not a file, ignoring", hash)
 	}
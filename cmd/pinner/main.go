@@ -21,33 +21,47 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"time"
 
-	"github.com/wpengine/hackathon-catation/cmd/pinner/pinata"
-	"github.com/wpengine/hackathon-catation/cmd/pinner/temporal"
 	"github.com/wpengine/hackathon-catation/internal"
+	"github.com/wpengine/hackathon-catation/pup"
+	"github.com/wpengine/hackathon-catation/pup/pinata"
+	"github.com/wpengine/hackathon-catation/pup/temporal"
 )
 
 func main() {
 	internal.PrintGPLBanner("catation", "2020")
 
-	pAPI := pinata.API{
-		Key:    os.Getenv("PINATA_API_KEY"),
-		Secret: os.Getenv("PINATA_SECRET_API_KEY"),
+	if len(os.Args) != 2 {
+		fmt.Fprintf(os.Stderr, "Usage: %s HASH\n", os.Args[0])
+		os.Exit(2)
 	}
+	hash := os.Args[1]
+	ctx := context.Background()
 
-	tAPI, err := temporal.New(context.Background(), os.Getenv("TEMPORAL_USERNAME"), os.Getenv("TEMPORAL_PASSWORD"))
-	if err != nil {
-		die("unable to connect to temporal: ", err)
+	pAPI := pinata.New(os.Getenv("PINATA_API_KEY"), os.Getenv("PINATA_SECRET_API_KEY"))
+	if err := pAPI.TestAuthentication(ctx); err != nil {
+		die(describe(err))
 	}
 
-	if err = tAPI.Pin(context.Background(), os.Args[1]); err != nil {
-		die("unable to pin to temporal ", err)
-		os.Exit(1)
+	tAPI := temporal.New(os.Getenv("TEMPORAL_USERNAME"), os.Getenv("TEMPORAL_PASSWORD"))
+	if months := os.Getenv("TEMPORAL_HOLD_TIME"); months != "" {
+		n, err := strconv.Atoi(months)
+		if err != nil {
+			die("bad TEMPORAL_HOLD_TIME: ", err)
+		}
+		tAPI.HoldTime = n
+	}
+	// The clients retry throttled requests themselves
+	err := tAPI.Pin(ctx, hash)
+	if err != nil {
+		die("unable to pin to temporal ", describe(err))
 	}
 
-	resp, err := pAPI.Pin(os.Args[1])
+	resp, err := pAPI.PinByHash(ctx, hash, pup.PinOptions{})
 	if err != nil {
-		die("unable to pin to pinata ", err)
+		die("unable to pin to pinata ", describe(err))
 	}
 
 	// format output
@@ -59,17 +73,23 @@ func main() {
 	fmt.Println(string(s))
 
 	// Wait until verified successful pin
-	for {
-		fmt.Fprintf(os.Stderr, ".")
-		done, err := pAPI.IsPinned(os.Args[1])
-		if err != nil {
-			panic(err)
-		}
-		if done {
-			log.Println("pinned!")
-			break
-		}
+	waitCtx, cancel := context.WithTimeout(ctx, time.Hour)
+	defer cancel()
+	_, err = pup.WaitPinned(waitCtx, pAPI, hash, func(status pup.PinStatus) {
+		log.Printf("pinata: %s", status)
+	})
+	if err != nil {
+		die(describe(err))
+	}
+	log.Println("pinned!")
+}
+
+// describe formats err, adding a hint for known pup errors.
+func describe(err error) string {
+	if hint := pup.Hint(err); hint != "" {
+		return fmt.Sprintf("%s\nHINT: %s", err, hint)
 	}
+	return err.Error()
 }
 
 func die(msg ...interface{}) {
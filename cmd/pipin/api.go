@@ -16,20 +16,42 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
 
+	files "github.com/ipfs/go-ipfs-files"
 	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
 	icorepath "github.com/ipfs/interface-go-ipfs-core/path"
 
 	"github.com/gorilla/mux"
+
+	"github.com/wpengine/hackathon-catation/pup/psa"
 )
 
 // API is the public interface over HTTP
 type API struct {
-	ipfs iface.CoreAPI
+	ipfs    iface.CoreAPI
+	queue   *Queue
+	store   *Store
+	storage *Storage
+}
+
+// Register adds the API routes to the router. Requests must be authenticated
+// with newAuthMiddleware.
+func (api *API) Register(r *mux.Router) {
+	r.HandleFunc("/pins", requireScope(api.pinListHandler, ScopeList)).Methods("GET")
+	r.HandleFunc("/pin/{hash}", requireScope(api.pinCreateHandler, ScopePin)).Methods("POST")
+	r.HandleFunc("/pin/{hash}", requireScope(api.pinStatusHandler, ScopeList)).Methods("GET")
+	r.HandleFunc("/pin/{hash}", requireScope(api.pinRemoveHandler, ScopeUnpin)).Methods("DELETE")
+	r.HandleFunc("/upload", requireScope(api.uploadHandler, ScopePin)).Methods("POST")
+	r.HandleFunc("/jobs/{id}", requireScope(api.jobHandler, ScopeList)).Methods("GET")
+	r.HandleFunc("/admin/stats", requireScope(api.statsHandler, ScopeAdmin)).Methods("GET")
 }
 
 type pinResponse struct {
@@ -37,17 +59,51 @@ type pinResponse struct {
 	Path string `json:"path"`
 }
 
+// jobResponse describes a queued pin job.
+type jobResponse struct {
+	ID     string `json:"id"`
+	Hash   string `json:"hash"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func newJobResponse(job Job) jobResponse {
+	return jobResponse{
+		ID:     job.ID,
+		Hash:   job.Pin.CID,
+		Status: job.Status,
+		Error:  job.Error,
+	}
+}
+
 func (api *API) pinListHandler(w http.ResponseWriter, r *http.Request) {
-	pinchan, err := api.ipfs.Pin().Ls(context.Background())
+	pinchan, err := api.ipfs.Pin().Ls(r.Context())
 	if err != nil {
 		log.Printf("error fetching pins: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
-	pins := []string{}
+	records, err := api.store.All()
+	if err != nil {
+		log.Printf("error fetching pins metadata: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	token := tokenFrom(r)
+	pins := []PinRecord{}
 	for pin := range pinchan {
-		pins = append(pins, pin.Path().Cid().String())
+		hash := pin.Path().Cid().String()
+		rec, found := records[hash]
+		if !found {
+			// pinned before metadata was tracked, or indirectly
+			rec = PinRecord{Hash: hash}
+		}
+		if !token.Admin() && !rec.OwnedBy(token.Name) {
+			continue
+		}
+		pins = append(pins, rec)
 	}
 
 	if err = json.NewEncoder(w).Encode(pins); err != nil {
@@ -55,52 +111,262 @@ func (api *API) pinListHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// pinCreateRequest is an optional body of a pin creation request.
+type pinCreateRequest struct {
+	Name    string            `json:"name"`
+	Tags    map[string]string `json:"tags"`
+	Origins []string          `json:"origins"`
+}
+
+// pinCreateHandler queues the hash for pinning, and returns the job
+// immediately. Progress can be checked via pinStatusHandler or jobHandler.
 func (api *API) pinCreateHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
-	testCID := icorepath.New(vars["hash"])
+	if err := icorepath.New(vars["hash"]).IsValid(); err != nil {
+		http.Error(w, "Bad Request: invalid hash", http.StatusBadRequest)
+		return
+	}
+
+	token := tokenFrom(r)
+	if !api.admit(w, r, token) {
+		return
+	}
+
+	var body pinCreateRequest
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil && err != io.EOF {
+		http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	_, err := api.ipfs.Unixfs().Get(context.Background(), testCID)
+	job, err := api.queue.Add(psa.Pin{
+		CID:     vars["hash"],
+		Name:    body.Name,
+		Meta:    body.Tags,
+		Origins: body.Origins,
+	}, "", token.Name)
 	if err != nil {
-		log.Printf("Could not get file with CID: %v", err)
+		log.Printf("Could not queue pinning file with CID: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
-	err = api.ipfs.Pin().Add(context.Background(), testCID)
+	w.WriteHeader(http.StatusAccepted)
+	if err = json.NewEncoder(w).Encode(newJobResponse(job)); err != nil {
+		log.Printf("error encoding to json: %v", err)
+	}
+}
+
+// uploadHandler adds and pins content uploaded as a multipart form, in the
+// format written by files.MultiFileReader. The form must contain a single
+// top-level file or directory, which is recorded under its name. Uploads
+// larger than the remaining space of the repo or the token's quota are
+// rejected and their blocks collected as garbage.
+func (api *API) uploadHandler(w http.ResponseWriter, r *http.Request) {
+	token := tokenFrom(r)
+	if !api.admit(w, r, token) {
+		return
+	}
+	headroom, err := api.storage.Headroom(r.Context(), token)
 	if err != nil {
-		log.Printf("Could not pin file with CID: %v", err)
+		log.Printf("Could not check storage: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	body := &countingReader{r: r.Body}
+	if headroom >= 0 {
+		// The form encoding counts too, which only makes the limit stricter
+		r.Body = http.MaxBytesReader(w, body, headroom)
+	} else {
+		r.Body = body
+	}
+
+	mediatype, params, err := mime.ParseMediaType(r.Header.Get("content-type"))
+	if err != nil || mediatype != "multipart/form-data" {
+		http.Error(w, "Bad Request: expected multipart/form-data", http.StatusBadRequest)
+		return
+	}
+	dir, err := files.NewFileFromPartReader(multipart.NewReader(r.Body, params["boundary"]), mediatype)
+	if err != nil {
+		http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries := dir.Entries()
+	if !entries.Next() {
+		msg := "no file"
+		if entries.Err() != nil {
+			msg = entries.Err().Error()
+		}
+		http.Error(w, "Bad Request: "+msg, http.StatusBadRequest)
+		return
+	}
+	name := entries.Name()
 
-	if err = json.NewEncoder(w).Encode([]string{vars["hash"]}); err != nil {
+	path, err := api.ipfs.Unixfs().Add(r.Context(), entries.Node(), options.Unixfs.Pin(true))
+	if err != nil {
+		// Blocks added before the failure are not pinned
+		api.storage.ScheduleGC()
+		if headroom >= 0 && body.n > headroom {
+			http.Error(w, "Request Entity Too Large: upload exceeds the remaining storage", http.StatusRequestEntityTooLarge)
+			return
+		}
+		log.Printf("Could not add uploaded %q: %v", name, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	size, err := dagSize(r.Context(), api.ipfs, path)
+	if err != nil {
+		log.Printf("error: %v", err)
+	}
+	hash := path.Cid().String()
+	if headroom >= 0 && size > headroom {
+		// The DAG can be larger than the uploaded data; unless the content
+		// was stored already, it takes more space than is left.
+		_, found, err := api.store.Get(hash)
+		if err != nil {
+			log.Printf("error: %v", err)
+		}
+		if !found {
+			if err := api.ipfs.Pin().Rm(r.Context(), path); err != nil {
+				log.Printf("Could not unpin oversize upload %s: %v", hash, err)
+			}
+			api.storage.ScheduleGC()
+			http.Error(w, "Insufficient Storage: upload exceeds the remaining storage", http.StatusInsufficientStorage)
+			return
+		}
+	}
+	err = api.store.Put(PinRecord{
+		Hash:   hash,
+		Name:   name,
+		Size:   size,
+		Owners: owners(token.Name),
+	})
+	if err != nil {
+		log.Printf("Could not save metadata of uploaded %q: %v", name, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Uploaded %q as %s", name, hash)
+
+	rec, _, err := api.store.Get(hash)
+	if err != nil {
+		log.Printf("error: %v", err)
+	}
+	if err = json.NewEncoder(w).Encode(rec); err != nil {
 		log.Printf("error encoding to json: %v", err)
 	}
 }
 
+// countingReader counts bytes read from r.
+type countingReader struct {
+	r io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) Close() error {
+	return c.r.Close()
+}
+
+// admit checks whether new content can be pinned with the token, replying
+// with an error if not.
+func (api *API) admit(w http.ResponseWriter, r *http.Request, token *Token) bool {
+	err := api.storage.Admit(r.Context(), token)
+	if errors.Is(err, errRepoFull) || errors.Is(err, errQuotaExceeded) {
+		http.Error(w, "Insufficient Storage: "+err.Error(), http.StatusInsufficientStorage)
+		return false
+	}
+	if err != nil {
+		log.Printf("Could not check storage: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
 func (api *API) pinStatusHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	_, pinned, err := api.ipfs.Pin().IsPinned(context.Background(), icorepath.New(vars["hash"]))
+	_, pinned, err := api.ipfs.Pin().IsPinned(r.Context(), icorepath.New(vars["hash"]))
 	if err != nil {
 		log.Printf("Could not check pin status: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
 	}
 
-	if err = json.NewEncoder(w).Encode(map[string]interface{}{"pinned": pinned}); err != nil {
+	resp := struct {
+		Pinned bool   `json:"pinned"`
+		Status string `json:"status"` // queued, pinning, pinned, failed or unpinned
+		Job    string `json:"job,omitempty"`
+		Error  string `json:"error,omitempty"`
+	}{Pinned: pinned, Status: "unpinned"}
+	token := tokenFrom(r)
+	job, found := api.queue.Latest(vars["hash"])
+	if found && (token.Admin() || job.Owner == token.Name) {
+		resp.Job = job.ID
+		resp.Status = job.Status
+		resp.Error = job.Error
+	}
+	if pinned {
+		resp.Status = psa.Pinned
+	}
+
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
 		log.Printf("error encoding to json: %v", err)
 	}
 }
 
 func (api *API) pinRemoveHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	err := api.ipfs.Pin().Rm(context.Background(), icorepath.New(vars["hash"]))
+	token := tokenFrom(r)
+	owner := token.Name
+	if token.Admin() {
+		// unpin regardless of other owners
+		owner = ""
+	} else if !api.queue.Owns(vars["hash"], owner) {
+		http.Error(w, "Forbidden: not pinned with this token", http.StatusForbidden)
+		return
+	}
+	err := api.queue.RemoveCID(r.Context(), vars["hash"], owner)
 	if err != nil {
 		log.Printf("Could not delete pin: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
 	}
 
-	if _, err = w.Write([]byte(`{"pinned": false}\n`)); err != nil {
+	if _, err = w.Write([]byte(`{"pinned": false}` + "\n")); err != nil {
 		log.Printf("error writing response: %v", err)
 	}
 }
+
+func (api *API) jobHandler(w http.ResponseWriter, r *http.Request) {
+	token := tokenFrom(r)
+	job, found := api.queue.Get(mux.Vars(r)["id"])
+	if !found || !(token.Admin() || job.Owner == token.Name) {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(newJobResponse(job)); err != nil {
+		log.Printf("error encoding to json: %v", err)
+	}
+}
+
+// statsHandler reports disk usage, for admins.
+func (api *API) statsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := api.storage.Stats(r.Context())
+	if err != nil {
+		log.Printf("Could not check storage: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		log.Printf("error encoding to json: %v", err)
+	}
+}
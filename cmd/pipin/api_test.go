@@ -0,0 +1,89 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+// upload sends data as the file name via the upload endpoint.
+func upload(h http.Handler, token, name string, data []byte) *httptest.ResponseRecorder {
+	mfr := files.NewMultiFileReader(files.NewMapDirectory(map[string]files.Node{
+		name: files.NewBytesFile(data),
+	}), true)
+	body, _ := ioutil.ReadAll(mfr)
+	r := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader(body))
+	r.Header.Set("content-type", "multipart/form-data; boundary="+mfr.Boundary())
+	r.Header.Set("authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestUploadLimits(t *testing.T) {
+	api, ipfs, h := newTestAPI(t)
+	repo := &fakeRepo{size: 500}
+	api.storage = newTestStorage(t, repo, 2000)
+	api.storage.store = api.store
+
+	pins := func() int {
+		ipfs.mu.Lock()
+		defer ipfs.mu.Unlock()
+		return len(ipfs.pins)
+	}
+	gcScheduled := func() bool {
+		select {
+		case <-api.storage.gc:
+			return true
+		default:
+			return false
+		}
+	}
+
+	if w := upload(h, "alice", "small.txt", bytes.Repeat([]byte("a"), 1000)); w.Code != http.StatusOK {
+		t.Fatalf("upload within limit: got %d %s", w.Code, w.Body)
+	}
+	if n := pins(); n != 1 {
+		t.Errorf("%d pins after upload, want 1", n)
+	}
+
+	// The repo has 1500 bytes left
+	w := upload(h, "alice", "big.txt", bytes.Repeat([]byte("b"), 1600))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("upload over repo limit: got %d %s, want %d", w.Code, w.Body, http.StatusRequestEntityTooLarge)
+	}
+	if n := pins(); n != 1 {
+		t.Errorf("%d pins after rejected upload, want 1", n)
+	}
+	if !gcScheduled() {
+		t.Error("no collection scheduled after rejected upload")
+	}
+
+	// Unlimited repo
+	api.storage.maxSize = 0
+	if w := upload(h, "alice", "big.txt", bytes.Repeat([]byte("b"), 1600)); w.Code != http.StatusOK {
+		t.Errorf("upload to unlimited repo: got %d %s", w.Code, w.Body)
+	}
+	if n := pins(); n != 2 {
+		t.Errorf("%d pins after upload to unlimited repo, want 2", n)
+	}
+}
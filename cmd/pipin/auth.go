@@ -15,16 +15,58 @@
 
 package main
 
-import "net/http"
+import (
+	"context"
+	"net/http"
+	"strings"
+)
 
-func newAuthMiddleware(token string) func(http.Handler) http.Handler {
+type ctxKey int
+
+const tokenKey ctxKey = 0
+
+// newAuthMiddleware rejects requests without a known bearer token, and
+// attaches the token to the context of accepted requests.
+func newAuthMiddleware(tokens *Tokens) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if "Bearer "+token != r.Header.Get("authorization") {
+			auth := r.Header.Get("authorization")
+			if !strings.HasPrefix(auth, "Bearer ") {
 				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 				return
 			}
-			next.ServeHTTP(w, r)
+			token, ok := tokens.Authenticate(strings.TrimPrefix(auth, "Bearer "))
+			if !ok {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			ctx := context.WithValue(r.Context(), tokenKey, token)
+			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
+
+// requireScope wraps the handler, so that it is only called for requests
+// with a token granted all the scopes.
+func requireScope(h http.HandlerFunc, scopes ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := tokenFrom(r)
+		for _, s := range scopes {
+			if !token.Can(s) {
+				http.Error(w, "Forbidden: token lacks scope "+s, http.StatusForbidden)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+// tokenFrom returns the token which authenticated the request.
+func tokenFrom(r *http.Request) *Token {
+	token, ok := r.Context().Value(tokenKey).(*Token)
+	if !ok {
+		// not authenticated, should never happen with newAuthMiddleware
+		return &Token{}
+	}
+	return token
+}
@@ -0,0 +1,205 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+
+	"github.com/wpengine/hackathon-catation/pup/psa"
+)
+
+func TestRequireScope(t *testing.T) {
+	tests := []struct {
+		scopes   []string // granted to the token
+		required []string
+		want     int
+	}{
+		{[]string{ScopeList}, []string{ScopeList}, http.StatusOK},
+		{[]string{ScopeList}, []string{ScopePin}, http.StatusForbidden},
+		{[]string{ScopePin}, []string{ScopePin, ScopeUnpin}, http.StatusForbidden},
+		{[]string{ScopePin, ScopeUnpin}, []string{ScopePin, ScopeUnpin}, http.StatusOK},
+		{[]string{ScopeAdmin}, []string{ScopePin, ScopeUnpin}, http.StatusOK},
+		{[]string{ScopeList, ScopePin, ScopeUnpin}, []string{ScopeAdmin}, http.StatusForbidden},
+		{nil, []string{ScopeList}, http.StatusForbidden},
+		{nil, nil, http.StatusOK},
+	}
+	for _, tt := range tests {
+		h := requireScope(func(w http.ResponseWriter, r *http.Request) {}, tt.required...)
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r = r.WithContext(context.WithValue(r.Context(), tokenKey, &Token{Name: "t", Scopes: tt.scopes}))
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != tt.want {
+			t.Errorf("token with %v for handler requiring %v: got %d, want %d", tt.scopes, tt.required, w.Code, tt.want)
+		}
+	}
+
+	// Requests which somehow bypassed authentication get nothing
+	w := httptest.NewRecorder()
+	requireScope(func(w http.ResponseWriter, r *http.Request) {}, ScopeList)(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("unauthenticated request: got %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+// newTestAPI serves the API with static tokens alice, bob (both without
+// the admin scope), lister (only list) and admin, whose secrets are their
+// names.
+func newTestAPI(t *testing.T) (*API, *fakeIPFS, http.Handler) {
+	ipfs := newFakeIPFS()
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	store := NewStore(ds)
+	queue, err := NewQueue(ipfs, ds, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start(t, queue, 1)
+	api := &API{ipfs: ipfs, queue: queue, store: store}
+
+	tokens, err := LoadTokens(t.TempDir() + "/tokens.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, scopes := range map[string][]string{
+		"alice":  {ScopeList, ScopePin, ScopeUnpin},
+		"bob":    {ScopeList, ScopePin, ScopeUnpin},
+		"lister": {ScopeList},
+		"admin":  {ScopeAdmin},
+	} {
+		if err := tokens.AddStatic(name, name, scopes...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := mux.NewRouter()
+	api.Register(r)
+	r.Use(newAuthMiddleware(tokens))
+	return api, ipfs, r
+}
+
+func serve(h http.Handler, token, method, path string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		r.Header.Set("authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// pinAs pins the CID via a job owned by the token, and waits until it's
+// done.
+func pinAs(t *testing.T, api *API, owner, cid string) Job {
+	job, err := api.queue.Add(psa.Pin{CID: cid}, "", owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "job of "+owner, jobStatusIs(api.queue, job.ID, psa.Pinned))
+	return job
+}
+
+func TestOwnership(t *testing.T) {
+	api, ipfs, h := newTestAPI(t)
+	aliceJob := pinAs(t, api, "alice", cidA)
+	pinAs(t, api, "bob", cidB)
+	// Pinned by other means, without an owner
+	ipfs.mu.Lock()
+	ipfs.pins[cidC] = true
+	ipfs.mu.Unlock()
+
+	if w := serve(h, "", http.MethodGet, "/pins"); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /pins without token: got %d, want 401", w.Code)
+	}
+	if w := serve(h, "mallory", http.MethodGet, "/pins"); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /pins with unknown token: got %d, want 401", w.Code)
+	}
+
+	lists := []struct {
+		token string
+		want  []string
+	}{
+		{"alice", []string{cidA}},
+		{"bob", []string{cidB}},
+		{"lister", []string{}},
+		{"admin", []string{cidA, cidB, cidC}},
+	}
+	for _, tt := range lists {
+		w := serve(h, tt.token, http.MethodGet, "/pins")
+		var pins []PinRecord
+		if err := json.NewDecoder(w.Body).Decode(&pins); err != nil {
+			t.Errorf("GET /pins as %s: %d %v", tt.token, w.Code, err)
+			continue
+		}
+		got := []string{}
+		for _, p := range pins {
+			got = append(got, p.Hash)
+		}
+		sort.Strings(got)
+		sort.Strings(tt.want)
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("GET /pins as %s = %v, want %v", tt.token, got, tt.want)
+		}
+	}
+
+	jobs := []struct {
+		token string
+		want  int
+	}{
+		{"alice", http.StatusOK},
+		{"bob", http.StatusNotFound},
+		{"lister", http.StatusNotFound},
+		{"admin", http.StatusOK},
+	}
+	for _, tt := range jobs {
+		if w := serve(h, tt.token, http.MethodGet, "/jobs/"+aliceJob.ID); w.Code != tt.want {
+			t.Errorf("GET job of alice as %s: got %d, want %d", tt.token, w.Code, tt.want)
+		}
+	}
+	if w := serve(h, "admin", http.MethodGet, "/jobs/nope"); w.Code != http.StatusNotFound {
+		t.Errorf("GET missing job: got %d, want 404", w.Code)
+	}
+
+	removals := []struct {
+		token  string
+		cid    string
+		want   int
+		pinned bool // afterwards
+	}{
+		{"bob", cidA, http.StatusForbidden, true},
+		{"lister", cidA, http.StatusForbidden, true},
+		{"bob", cidC, http.StatusForbidden, true},
+		{"alice", cidA, http.StatusOK, false},
+		{"admin", cidB, http.StatusOK, false},
+		{"admin", cidC, http.StatusOK, false},
+	}
+	for _, tt := range removals {
+		if w := serve(h, tt.token, http.MethodDelete, "/pin/"+tt.cid); w.Code != tt.want {
+			t.Errorf("DELETE %s as %s: got %d, want %d", tt.cid, tt.token, w.Code, tt.want)
+		}
+		if ipfs.pinned(tt.cid) != tt.pinned {
+			t.Errorf("after DELETE %s as %s: pinned = %v, want %v", tt.cid, tt.token, !tt.pinned, tt.pinned)
+		}
+	}
+}
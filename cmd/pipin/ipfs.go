@@ -19,45 +19,108 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"log"
+	"os"
 	"path/filepath"
 
 	config "github.com/ipfs/go-ipfs-config"
 	libp2p "github.com/ipfs/go-ipfs/core/node/libp2p"
 	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
 
 	"github.com/ipfs/go-ipfs/core"
 	"github.com/ipfs/go-ipfs/core/coreapi"
 	"github.com/ipfs/go-ipfs/plugin/loader"
 	"github.com/ipfs/go-ipfs/repo/fsrepo"
+	migrations "github.com/ipfs/go-ipfs/repo/fsrepo/migrations"
 )
 
-func openRepo(ctx context.Context, path string) (iface.CoreAPI, error) {
+// initOptions configure a new repository created by initRepo.
+type initOptions struct {
+	KeyType    string   // rsa or ed25519
+	KeySize    int      // in bits, for rsa keys only
+	SwarmAddrs []string // optional; defaults of go-ipfs are used if empty
+	Profiles   []string // optional; e.g. lowpower, see config.Profiles
+}
+
+// loadPlugins loads plugins of the repo, including the preloaded ones which
+// provide datastores. It must be called before the repo is initialized or
+// opened, and only once.
+func loadPlugins(path string) error {
 	plugins, err := loader.NewPluginLoader(filepath.Join(path, "plugins"))
 	if err != nil {
-		return nil, fmt.Errorf("error loading plugins: %s", err)
+		return fmt.Errorf("error loading plugins: %s", err)
 	}
 
 	if err := plugins.Initialize(); err != nil {
-		return nil, fmt.Errorf("error initializing plugins: %s", err)
+		return fmt.Errorf("error initializing plugins: %s", err)
 	}
 
 	if err := plugins.Inject(); err != nil {
-		return nil, fmt.Errorf("error initializing plugins: %s", err)
+		return fmt.Errorf("error initializing plugins: %s", err)
+	}
+	return nil
+}
+
+// initRepo creates a new repository at path, unless there already is one.
+func initRepo(path string, opts initOptions) error {
+	if fsrepo.IsInitialized(path) {
+		log.Printf("IPFS repository already exists at %s", path)
+		return nil
 	}
 
-	cfg, err := config.Init(ioutil.Discard, 2048)
+	keyOpts := []options.KeyGenerateOption{options.Key.Type(opts.KeyType)}
+	if opts.KeyType == options.RSAKey {
+		keyOpts = append(keyOpts, options.Key.Size(opts.KeySize))
+	}
+	identity, err := config.CreateIdentity(ioutil.Discard, keyOpts)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	cfg, err := config.InitWithIdentity(identity)
+	if err != nil {
+		return err
+	}
+	if len(opts.SwarmAddrs) > 0 {
+		cfg.Addresses.Swarm = opts.SwarmAddrs
+	}
+	for _, name := range opts.Profiles {
+		profile, found := config.Profiles[name]
+		if !found {
+			return fmt.Errorf("unknown profile %q", name)
+		}
+		if err := profile.Transform(cfg); err != nil {
+			return fmt.Errorf("applying profile %q: %w", name, err)
+		}
 	}
 
 	err = fsrepo.Init(path, cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to init node: %s", err)
+		return fmt.Errorf("failed to init node: %s", err)
+	}
+	log.Printf("Initialized IPFS repository at %s, peer identity: %s", path, identity.PeerID)
+	return nil
+}
+
+// openRepo opens an existing repository, migrating it to the current version
+// first if needed, and starts an IPFS node using it. The node runs until
+// closed.
+func openRepo(ctx context.Context, path string) (*core.IpfsNode, iface.CoreAPI, error) {
+	if !fsrepo.IsInitialized(path) {
+		return nil, nil, fmt.Errorf("no IPFS repository at %s, create one with -init", path)
 	}
 
 	repo, err := fsrepo.Open(path)
+	if err == fsrepo.ErrNeedMigration {
+		log.Printf("IPFS repository at %s is outdated, running migrations...", path)
+		err = migrate(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		repo, err = fsrepo.Open(path)
+	}
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	nodeOptions := &core.BuildCfg{
@@ -68,8 +131,31 @@ func openRepo(ctx context.Context, path string) (iface.CoreAPI, error) {
 
 	node, err := core.NewNode(ctx, nodeOptions)
 	if err != nil {
-		return nil, err
+		repo.Close()
+		return nil, nil, err
 	}
 
-	return coreapi.NewCoreAPI(node)
+	api, err := coreapi.NewCoreAPI(node)
+	if err != nil {
+		node.Close()
+		return nil, nil, err
+	}
+	return node, api, nil
+}
+
+// migrate runs fs-repo-migrations on the repository, downloading the tool
+// if it's not in PATH.
+func migrate(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	// fs-repo-migrations finds the repository through the environment
+	if err := os.Setenv("IPFS_PATH", abs); err != nil {
+		return err
+	}
+	if err := migrations.RunMigration(fsrepo.RepoVersion); err != nil {
+		return fmt.Errorf("migrating IPFS repository: %w", err)
+	}
+	return nil
 }
@@ -19,8 +19,15 @@ import (
 	"context"
 	"flag"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/gorilla/mux"
 
 	"github.com/wpengine/hackathon-catation/internal"
@@ -31,31 +38,196 @@ import (
 func main() {
 	internal.PrintGPLBanner("pipin", "2020")
 
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		tokenCommand(os.Args[2:])
+		return
+	}
+
 	var (
-		token    *string = flag.String("token", "change-me", "HTTP auth token")
-		repoPath *string = flag.String("repo", "./repo", "IPFS repository path")
-		addr     *string = flag.String("addr", ":9229", "Address to bind HTTP API on")
+		token      *string        = flag.String("token", "", "HTTP auth token with admin scope, in addition to ones from -tokens")
+		tokensPath *string        = flag.String("tokens", "./tokens.json", "Path of file with HTTP auth tokens, managed with 'pipin token'")
+		repoPath   *string        = flag.String("repo", "./repo", "IPFS repository path")
+		addr       *string        = flag.String("addr", ":9229", "Address to bind HTTP API on, or unix:///path/to/socket")
+		workers    *int           = flag.Int("workers", 2, "Number of pin jobs processed concurrently")
+		maxSize    *string        = flag.String("max-size", "", "Maximum size of the IPFS repository, e.g. 25GB; new pins are refused above it")
+		gcDelay    *time.Duration = flag.Duration("gc-delay", time.Minute, "Delay of garbage collection after content is unpinned")
+		retention  *time.Duration = flag.Duration("job-retention", 7*24*time.Hour, "How long finished pin jobs are kept; forever if 0")
+
+		tlsCert       *string = flag.String("tls-cert", "", "Path of TLS certificate to serve HTTPS with; requires -tls-key")
+		tlsKey        *string = flag.String("tls-key", "", "Path of TLS private key to serve HTTPS with; requires -tls-cert")
+		tlsSelfSigned *bool   = flag.Bool("tls-self-signed", false, "Serve HTTPS with a self-signed certificate kept in the repository, generating it if needed")
+		tlsHosts      *string = flag.String("tls-hosts", "localhost,127.0.0.1", "With -tls-self-signed, comma-separated host names and IPs of a new certificate")
+
+		metricsAddr  *string = flag.String("metrics-addr", "", "Address to bind Prometheus metrics on, e.g. :9230; disabled if empty")
+		metricsToken *string = flag.String("metrics-token", "", "Optional bearer token required for fetching metrics")
+
+		initRepoFlag *bool   = flag.Bool("init", false, "Create the IPFS repository if it doesn't exist yet")
+		keyType      *string = flag.String("key-type", "rsa", "With -init, type of the node's key: rsa or ed25519")
+		keySize      *int    = flag.Int("key-size", 2048, "With -init, size of the node's rsa key in bits")
+		swarmAddrs   *string = flag.String("swarm", "", "With -init, comma-separated multiaddrs to listen for peers on, instead of the defaults")
+		profiles     *string = flag.String("profile", "", "With -init, comma-separated config profiles to apply, e.g. lowpower for a Raspberry Pi")
 	)
 	flag.Parse()
 
-	ctx := context.Background()
+	var limit uint64
+	if *maxSize != "" {
+		var err error
+		limit, err = humanize.ParseBytes(*maxSize)
+		if err != nil {
+			log.Fatalf("Invalid -max-size: %v", err)
+		}
+	}
+
+	tokens, err := LoadTokens(*tokensPath)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if *token != "" {
+		if err := tokens.AddStatic(adminTokenName, *token, ScopeAdmin); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+	if tokens.Len() == 0 {
+		log.Fatalf("No tokens in %s, create one with: %s token add -scopes %s NAME",
+			*tokensPath, os.Args[0], strings.Join([]string{ScopeList, ScopePin, ScopeUnpin}, ","))
+	}
+
+	if err := loadPlugins(*repoPath); err != nil {
+		log.Fatal(err.Error())
+	}
+	if *initRepoFlag {
+		err := initRepo(*repoPath, initOptions{
+			KeyType:    *keyType,
+			KeySize:    *keySize,
+			SwarmAddrs: splitList(*swarmAddrs),
+			Profiles:   splitList(*profiles),
+		})
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+	}
 
 	log.Println("Starting IPFS node...")
 
-	ipfs, err := openRepo(ctx, *repoPath)
+	node, ipfs, err := openRepo(context.Background(), *repoPath)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	// ctx stops background work when shutting down
+	ctx, stop := context.WithCancel(context.Background())
+
+	store := NewStore(node.Repo.Datastore())
+	queue, err := NewQueue(ipfs, node.Repo.Datastore(), store)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
+	storage := NewStorage(node, *repoPath, limit, store)
+	storage.Start(ctx, *gcDelay)
+	queue.OnUnpin = storage.ScheduleGC
+	queue.Retention = *retention
+	queue.Start(ctx, *workers)
 
-	api := &API{ipfs}
+	api := &API{ipfs, queue, store, storage}
 
 	r := mux.NewRouter()
-	r.HandleFunc("/pins", api.pinListHandler).Methods("GET")
-	r.HandleFunc("/pin/{hash}", api.pinCreateHandler).Methods("POST")
-	r.HandleFunc("/pin/{hash}", api.pinStatusHandler).Methods("GET")
-	r.HandleFunc("/pin/{hash}", api.pinRemoveHandler).Methods("DELETE")
-	r.Use(newAuthMiddleware(*token))
-
-	log.Printf("Starting HTTP API on %s...", *addr)
-	log.Fatal(http.ListenAndServe(*addr, r))
+	api.Register(r)
+	NewPinService(ipfs, queue, store, storage).Register(r.PathPrefix("/psa").Subrouter())
+	r.Use(metricsMiddleware)
+	r.Use(newAuthMiddleware(tokens))
+
+	var metricsSrv *http.Server
+	if *metricsAddr != "" {
+		collector := &nodeCollector{node: node, ipfs: ipfs, queue: queue, store: store}
+		metricsSrv = &http.Server{Addr: *metricsAddr, Handler: newMetricsRouter(collector, *metricsToken)}
+		go func() {
+			log.Printf("Starting metrics server on %s...", *metricsAddr)
+			if err := metricsSrv.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal(err.Error())
+			}
+		}()
+	}
+
+	srv := &http.Server{Addr: *addr, Handler: r}
+	drained := make(chan struct{})
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		sig := <-sigs
+		log.Printf("Received %v, shutting down...", sig)
+
+		// let requests in progress finish
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Could not shut down HTTP API cleanly: %v", err)
+		}
+		if metricsSrv != nil {
+			metricsSrv.Close()
+		}
+		close(drained)
+	}()
+
+	if *tlsSelfSigned {
+		hosts := splitList(*tlsHosts)
+		if name, err := os.Hostname(); err == nil {
+			hosts = append(hosts, name, name+".local")
+		}
+		*tlsCert, *tlsKey, err = selfSignedCert(*repoPath, hosts)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+	ln, err := listen(*addr)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if *tlsCert != "" || *tlsKey != "" {
+		fingerprint, err := certFingerprint(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		log.Printf("TLS certificate fingerprint (SHA-256): %s", fingerprint)
+		log.Printf("Starting HTTPS API on %s...", *addr)
+		err = srv.ServeTLS(ln, *tlsCert, *tlsKey)
+	} else {
+		log.Printf("Starting HTTP API on %s...", *addr)
+		err = srv.Serve(ln)
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err.Error())
+	}
+	<-drained
+
+	stop()
+	queue.Wait()
+	if err := node.Close(); err != nil {
+		log.Fatalf("Could not stop IPFS node cleanly: %v", err)
+	}
+	log.Println("Stopped")
+}
+
+// listen listens on a TCP address, or on a Unix socket for an address like
+// unix:///run/pipin.sock.
+func listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(strings.TrimPrefix(addr, "unix:"), "//")
+	// remove a stale socket left after a crash
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
+
+// splitList splits a comma-separated list, ignoring empty items.
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
 }
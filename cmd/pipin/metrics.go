@@ -0,0 +1,174 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/core/corerepo"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pipin_http_requests_total",
+		Help: "Number of HTTP API requests, by route and status code.",
+	}, []string{"route", "method", "code"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pipin_http_request_duration_seconds",
+		Help:    "Latency of HTTP API requests, by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+	jobsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pipin_pin_jobs_total",
+		Help: "Number of finished pin jobs, by outcome (pinned or failed).",
+	}, []string{"outcome"})
+	jobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pipin_pin_job_duration_seconds",
+		Help:    "Time taken by pin jobs, from start of pinning, by outcome.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 8), // 1s to ~4.5h
+	}, []string{"outcome"})
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, requestDuration, jobsTotal, jobDuration)
+}
+
+// metricsMiddleware records count and latency of requests, labelled by the
+// route template rather than the path, so that hashes don't blow up the
+// number of series.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if cur := mux.CurrentRoute(r); cur != nil {
+			if tmpl, err := cur.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+		requestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+		requestsTotal.WithLabelValues(route, r.Method, strconv.Itoa(rec.code)).Inc()
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// nodeCollector exports gauges of the PiPin node, computed on each scrape.
+type nodeCollector struct {
+	node  *core.IpfsNode
+	ipfs  iface.CoreAPI
+	queue *Queue
+	store *Store
+}
+
+var (
+	pinsDesc = prometheus.NewDesc("pipin_pins",
+		"Number of pins with metadata recorded by PiPin.", nil, nil)
+	queueDepthDesc = prometheus.NewDesc("pipin_queue_depth",
+		"Number of pin jobs waiting for a worker.", nil, nil)
+	repoSizeDesc = prometheus.NewDesc("pipin_repo_size_bytes",
+		"Size of the IPFS repository.", nil, nil)
+	peersDesc = prometheus.NewDesc("pipin_peers",
+		"Number of peers the IPFS node is connected to.", nil, nil)
+	bandwidthDesc = prometheus.NewDesc("pipin_bandwidth_bytes_total",
+		"Bytes transferred by the IPFS node, by direction (in or out).", []string{"direction"}, nil)
+	bandwidthRateDesc = prometheus.NewDesc("pipin_bandwidth_rate_bytes",
+		"Current transfer rate of the IPFS node in bytes per second, by direction (in or out).", []string{"direction"}, nil)
+)
+
+func (c *nodeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pinsDesc
+	ch <- queueDepthDesc
+	ch <- repoSizeDesc
+	ch <- peersDesc
+	ch <- bandwidthDesc
+	ch <- bandwidthRateDesc
+}
+
+func (c *nodeCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(c.queue.Len()))
+
+	if records, err := c.store.All(); err != nil {
+		log.Printf("metrics: %v", err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(pinsDesc, prometheus.GaugeValue, float64(len(records)))
+	}
+
+	if stat, err := corerepo.RepoSize(ctx, c.node); err != nil {
+		log.Printf("metrics: %v", err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(repoSizeDesc, prometheus.GaugeValue, float64(stat.RepoSize))
+	}
+
+	if peers, err := c.ipfs.Swarm().Peers(ctx); err != nil {
+		log.Printf("metrics: %v", err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(peersDesc, prometheus.GaugeValue, float64(len(peers)))
+	}
+
+	if c.node.Reporter != nil {
+		bw := c.node.Reporter.GetBandwidthTotals()
+		ch <- prometheus.MustNewConstMetric(bandwidthDesc, prometheus.CounterValue, float64(bw.TotalIn), "in")
+		ch <- prometheus.MustNewConstMetric(bandwidthDesc, prometheus.CounterValue, float64(bw.TotalOut), "out")
+		ch <- prometheus.MustNewConstMetric(bandwidthRateDesc, prometheus.GaugeValue, bw.RateIn, "in")
+		ch <- prometheus.MustNewConstMetric(bandwidthRateDesc, prometheus.GaugeValue, bw.RateOut, "out")
+	}
+}
+
+// newMetricsRouter returns a router serving metrics at /metrics. If token is
+// not empty, requests must provide it as a bearer token.
+func newMetricsRouter(c *nodeCollector, token string) *mux.Router {
+	prometheus.MustRegister(c)
+
+	r := mux.NewRouter()
+	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	if token != "" {
+		want := []byte("Bearer " + token)
+		r.Use(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got := []byte(r.Header.Get("authorization"))
+				if subtle.ConstantTimeCompare(got, want) != 1 {
+					http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		})
+	}
+	return r
+}
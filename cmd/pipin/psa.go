@@ -0,0 +1,286 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	icorepath "github.com/ipfs/interface-go-ipfs-core/path"
+
+	"github.com/wpengine/hackathon-catation/pup/psa"
+)
+
+// PinService implements the IPFS Pinning Service API over the IPFS node, so
+// that PiPin can be used as a remote pinning service by third-party tools,
+// e.g.:
+//
+//	ipfs pin remote service add pipin https://pipin.local:9229/psa TOKEN
+//
+// Pin requests are jobs in the Queue, with the job ID used as request ID.
+type PinService struct {
+	ipfs    iface.CoreAPI
+	queue   *Queue
+	store   *Store
+	storage *Storage
+	started time.Time
+}
+
+func NewPinService(ipfs iface.CoreAPI, queue *Queue, store *Store, storage *Storage) *PinService {
+	return &PinService{
+		ipfs:    ipfs,
+		queue:   queue,
+		store:   store,
+		storage: storage,
+		started: time.Now(),
+	}
+}
+
+// Register adds the API routes to the router. Requests must be authenticated
+// with newAuthMiddleware.
+func (s *PinService) Register(r *mux.Router) {
+	r.HandleFunc("/pins", requireScope(s.listHandler, ScopeList)).Methods("GET")
+	r.HandleFunc("/pins", requireScope(s.addHandler, ScopePin)).Methods("POST")
+	r.HandleFunc("/pins/{requestid}", requireScope(s.getHandler, ScopeList)).Methods("GET")
+	r.HandleFunc("/pins/{requestid}", requireScope(s.replaceHandler, ScopePin, ScopeUnpin)).Methods("POST")
+	r.HandleFunc("/pins/{requestid}", requireScope(s.removeHandler, ScopeUnpin)).Methods("DELETE")
+}
+
+func (s *PinService) listHandler(w http.ResponseWriter, r *http.Request) {
+	q, err := psa.ParseQuery(r.URL.Query())
+	if err != nil {
+		psaError(w, http.StatusBadRequest, "BAD_REQUEST", err.Error())
+		return
+	}
+	all, err := s.all(r.Context(), tokenFrom(r))
+	if err != nil {
+		log.Printf("error listing pins: %v", err)
+		psaError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR", "")
+		return
+	}
+	psaReply(w, http.StatusOK, q.Apply(all))
+}
+
+func (s *PinService) addHandler(w http.ResponseWriter, r *http.Request) {
+	pin, ok := decodePin(w, r)
+	if !ok {
+		return
+	}
+	s.enqueue(w, r, pin, "")
+}
+
+func (s *PinService) getHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.find(w, r)
+	if !ok {
+		return
+	}
+	psaReply(w, http.StatusOK, req)
+}
+
+func (s *PinService) replaceHandler(w http.ResponseWriter, r *http.Request) {
+	old, ok := s.find(w, r)
+	if !ok {
+		return
+	}
+	pin, ok := decodePin(w, r)
+	if !ok {
+		return
+	}
+	s.enqueue(w, r, pin, old.RequestID)
+}
+
+func (s *PinService) removeHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.find(w, r)
+	if !ok {
+		return
+	}
+	err := s.queue.Remove(r.Context(), req.RequestID)
+	if errors.Is(err, errJobNotFound) {
+		// pinned by other means than a job
+		token := tokenFrom(r)
+		owner := token.Name
+		if token.Admin() {
+			owner = ""
+		}
+		err = s.queue.RemoveCID(r.Context(), req.Pin.CID, owner)
+	}
+	if err != nil {
+		log.Printf("Could not delete pin: %v", err)
+		psaError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR", "")
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *PinService) enqueue(w http.ResponseWriter, r *http.Request, pin psa.Pin, replaces string) {
+	token := tokenFrom(r)
+	err := s.storage.Admit(r.Context(), token)
+	switch {
+	case errors.Is(err, errQuotaExceeded):
+		psaError(w, http.StatusPaymentRequired, "INSUFFICIENT_FUNDS", err.Error())
+		return
+	case errors.Is(err, errRepoFull):
+		psaError(w, http.StatusInsufficientStorage, "INSUFFICIENT_STORAGE", err.Error())
+		return
+	case err != nil:
+		log.Printf("Could not check storage: %v", err)
+		psaError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR", "")
+		return
+	}
+	job, err := s.queue.Add(pin, replaces, token.Name)
+	if err != nil {
+		log.Printf("Could not queue pin: %v", err)
+		psaError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR", "")
+		return
+	}
+	psaReply(w, http.StatusAccepted, jobStatus(job, s.delegates(r.Context())))
+}
+
+// find looks up the pin request from the URL, replying with an error if
+// there's no such request.
+func (s *PinService) find(w http.ResponseWriter, r *http.Request) (psa.PinStatus, bool) {
+	id := mux.Vars(r)["requestid"]
+	all, err := s.all(r.Context(), tokenFrom(r))
+	if err != nil {
+		log.Printf("error listing pins: %v", err)
+		psaError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR", "")
+		return psa.PinStatus{}, false
+	}
+	for _, req := range all {
+		if req.RequestID == id {
+			return req, true
+		}
+	}
+	psaError(w, http.StatusNotFound, "NOT_FOUND", "no pin request with id "+id)
+	return psa.PinStatus{}, false
+}
+
+// all returns all pin requests of the token known to the service, or of all
+// tokens for an admin token. Content pinned in the node by other means than a
+// job is shown as pinned requests with the CID as request ID, and with
+// metadata from the Store, if any.
+func (s *PinService) all(ctx context.Context, token *Token) ([]psa.PinStatus, error) {
+	pins, err := s.ipfs.Pin().Ls(ctx)
+	if err != nil {
+		return nil, err
+	}
+	records, err := s.store.All()
+	if err != nil {
+		return nil, err
+	}
+	delegates := s.delegates(ctx)
+
+	all := []psa.PinStatus{}
+	known := map[string]bool{}
+	for _, job := range s.queue.List() {
+		if !token.Admin() && job.Owner != token.Name {
+			continue
+		}
+		all = append(all, jobStatus(job, delegates))
+		known[job.Pin.CID] = true
+	}
+	for pin := range pins {
+		if pin.Type() != "recursive" {
+			continue
+		}
+		cid := pin.Path().Cid().String()
+		if known[cid] {
+			continue
+		}
+		created := s.started
+		rec, found := records[cid]
+		if !token.Admin() && !rec.OwnedBy(token.Name) {
+			continue
+		}
+		if found {
+			created = rec.Created
+		}
+		all = append(all, psa.PinStatus{
+			RequestID: cid,
+			Status:    psa.Pinned,
+			Created:   created,
+			Pin:       psa.Pin{CID: cid, Name: rec.Name, Meta: rec.Tags},
+			Delegates: delegates,
+		})
+	}
+	return all, nil
+}
+
+func jobStatus(job Job, delegates []string) psa.PinStatus {
+	status := psa.PinStatus{
+		RequestID: job.ID,
+		Status:    job.Status,
+		Created:   job.Created,
+		Pin:       job.Pin,
+		Delegates: delegates,
+	}
+	if job.Error != "" {
+		status.Info = map[string]string{"error": job.Error}
+	}
+	return status
+}
+
+// delegates returns multiaddrs of the node, which clients can connect to, to
+// provide content to us.
+func (s *PinService) delegates(ctx context.Context) []string {
+	delegates := []string{}
+	self, err := s.ipfs.Key().Self(ctx)
+	if err != nil {
+		return delegates
+	}
+	addrs, err := s.ipfs.Swarm().LocalAddrs(ctx)
+	if err != nil {
+		return delegates
+	}
+	for _, a := range addrs {
+		delegates = append(delegates, a.String()+"/p2p/"+self.ID().Pretty())
+	}
+	return delegates
+}
+
+func decodePin(w http.ResponseWriter, r *http.Request) (psa.Pin, bool) {
+	var pin psa.Pin
+	if err := json.NewDecoder(r.Body).Decode(&pin); err != nil {
+		psaError(w, http.StatusBadRequest, "BAD_REQUEST", err.Error())
+		return pin, false
+	}
+	if err := icorepath.New(pin.CID).IsValid(); pin.CID == "" || err != nil {
+		psaError(w, http.StatusBadRequest, "BAD_REQUEST", "invalid cid")
+		return pin, false
+	}
+	return pin, true
+}
+
+func psaReply(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("error encoding to json: %v", err)
+	}
+}
+
+func psaError(w http.ResponseWriter, code int, reason, details string) {
+	var f psa.Failure
+	f.Error.Reason = reason
+	f.Error.Details = details
+	psaReply(w, code, f)
+}
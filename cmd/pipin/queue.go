@@ -0,0 +1,623 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	icorepath "github.com/ipfs/interface-go-ipfs-core/path"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+
+	"github.com/wpengine/hackathon-catation/pup/psa"
+)
+
+// Job is a request to pin some content, processed in background by the
+// Queue. Its Status is one of the statuses defined by the Pinning Service API.
+type Job struct {
+	ID      string
+	Pin     psa.Pin
+	Status  string
+	Error   string `json:",omitempty"`
+	Created time.Time
+	Updated time.Time
+	// Replaces is an optional ID of a job to remove once this one is done.
+	Replaces string `json:",omitempty"`
+	// Owner is the name of the token which created the job.
+	Owner string `json:",omitempty"`
+}
+
+// Done reports whether the job finished, successfully or not.
+func (j *Job) Done() bool {
+	return j.Status == psa.Pinned || j.Status == psa.Failed
+}
+
+var errJobNotFound = errors.New("job not found")
+
+// pruneInterval is how often finished jobs are checked for expiry.
+const pruneInterval = time.Hour
+
+// Queue keeps track of pin jobs, and runs them on a pool of workers. Jobs are
+// persisted in a datastore, so that unfinished ones are resumed after
+// restart.
+type Queue struct {
+	ipfs  iface.CoreAPI
+	ds    datastore.Datastore
+	store *Store // updated with metadata of pinned content
+
+	// OnUnpin is optionally called after content is unpinned.
+	OnUnpin func()
+	// Retention is how long finished jobs are kept after they finish, e.g.
+	// to report why they failed; forever if zero. Content pinned by a
+	// forgotten job stays pinned, with its owner kept in the Store.
+	Retention time.Duration
+
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	byCID   map[string]map[string]*Job    // jobs by CID of their pin
+	pending []string                      // IDs of jobs waiting for a worker
+	cancels map[string]context.CancelFunc // for jobs being worked on
+	wake    chan struct{}
+	workers sync.WaitGroup
+}
+
+// NewQueue loads jobs persisted in the datastore under the /pipin/jobs
+// prefix.
+func NewQueue(ipfs iface.CoreAPI, ds datastore.Datastore, store *Store) (*Queue, error) {
+	q := &Queue{
+		ipfs:    ipfs,
+		ds:      namespace.Wrap(ds, datastore.NewKey("/pipin/jobs")),
+		store:   store,
+		jobs:    map[string]*Job{},
+		byCID:   map[string]map[string]*Job{},
+		cancels: map[string]context.CancelFunc{},
+		wake:    make(chan struct{}, 1),
+	}
+
+	res, err := q.ds.Query(query.Query{})
+	if err != nil {
+		return nil, fmt.Errorf("loading jobs: %w", err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, fmt.Errorf("loading jobs: %w", err)
+	}
+	for _, e := range entries {
+		job := &Job{}
+		if err := json.Unmarshal(e.Value, job); err != nil {
+			log.Printf("Skipping corrupted job %s: %v", e.Key, err)
+			continue
+		}
+		q.index(job)
+	}
+
+	// Resume unfinished jobs, oldest first
+	unfinished := []*Job{}
+	for _, job := range q.jobs {
+		if !job.Done() {
+			unfinished = append(unfinished, job)
+		}
+	}
+	sort.Slice(unfinished, func(i, j int) bool {
+		return unfinished[i].Created.Before(unfinished[j].Created)
+	})
+	for _, job := range unfinished {
+		job.Status = psa.Queued
+		q.pending = append(q.pending, job.ID)
+	}
+	if len(unfinished) > 0 {
+		log.Printf("Resuming %d unfinished pin jobs", len(unfinished))
+	}
+	return q, nil
+}
+
+// Start runs n workers processing the queue, until ctx is cancelled. Jobs
+// interrupted by the cancellation are resumed on next start. Finished jobs
+// are forgotten after Retention, checked now and every pruneInterval.
+func (q *Queue) Start(ctx context.Context, n int) {
+	for i := 0; i < n; i++ {
+		q.workers.Add(1)
+		go func() {
+			defer q.workers.Done()
+			q.work(ctx)
+		}()
+	}
+	q.signal()
+
+	if q.Retention > 0 {
+		q.prune()
+		q.workers.Add(1)
+		go func() {
+			defer q.workers.Done()
+			ticker := time.NewTicker(pruneInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					q.prune()
+				}
+			}
+		}()
+	}
+}
+
+// Wait blocks until all workers stop, after ctx passed to Start is
+// cancelled.
+func (q *Queue) Wait() {
+	q.workers.Wait()
+}
+
+// Add creates a new job pinning the content on behalf of the owner, and
+// queues it for processing.
+func (q *Queue) Add(pin psa.Pin, replaces, owner string) (Job, error) {
+	now := time.Now().UTC()
+	job := &Job{
+		ID:       newJobID(),
+		Pin:      pin,
+		Status:   psa.Queued,
+		Created:  now,
+		Updated:  now,
+		Replaces: replaces,
+		Owner:    owner,
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.save(job); err != nil {
+		return Job{}, err
+	}
+	q.index(job)
+	q.pending = append(q.pending, job.ID)
+	q.signal()
+	return *job, nil
+}
+
+// Get returns a copy of the job with the ID.
+func (q *Queue) Get(id string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, found := q.jobs[id]
+	if !found {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// List returns copies of all jobs.
+func (q *Queue) List() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	list := make([]Job, 0, len(q.jobs))
+	for _, job := range q.jobs {
+		list = append(list, *job)
+	}
+	return list
+}
+
+// Latest returns a copy of the most recently created job pinning the CID.
+func (q *Queue) Latest(cid string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var latest *Job
+	for _, job := range q.byCID[cid] {
+		if latest == nil || job.Created.After(latest.Created) {
+			latest = job
+		}
+	}
+	if latest == nil {
+		return Job{}, false
+	}
+	return *latest, true
+}
+
+// Owns reports whether the owner has a job pinning the CID, or is recorded
+// as one of owners of the already pinned CID.
+func (q *Queue) Owns(cid, owner string) bool {
+	q.mu.Lock()
+	for _, job := range q.byCID[cid] {
+		if job.Owner == owner {
+			q.mu.Unlock()
+			return true
+		}
+	}
+	q.mu.Unlock()
+	rec, found, err := q.store.Get(cid)
+	if err != nil {
+		log.Printf("error: %v", err)
+	}
+	return found && rec.OwnedBy(owner)
+}
+
+// Len returns the number of jobs waiting for a worker.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// Remove deletes the job, cancelling it if it is being worked on, and unpins
+// its content if no other job or owner refers to it.
+func (q *Queue) Remove(ctx context.Context, id string) error {
+	q.mu.Lock()
+	job, found := q.jobs[id]
+	if !found {
+		q.mu.Unlock()
+		return errJobNotFound
+	}
+	if err := q.forget(job); err != nil {
+		q.mu.Unlock()
+		return err
+	}
+	others, mine := false, false
+	for _, other := range q.byCID[job.Pin.CID] {
+		others = true
+		mine = mine || other.Owner == job.Owner
+	}
+	q.mu.Unlock()
+
+	owners := 0
+	if !mine {
+		var err error
+		owners, err = q.store.Disown(job.Pin.CID, job.Owner)
+		if err != nil {
+			return err
+		}
+	}
+	if others || owners > 0 {
+		return nil
+	}
+	err := q.unpin(ctx, job.Pin.CID)
+	if err != nil && job.Status != psa.Pinned {
+		// probably never got pinned
+		return nil
+	}
+	return err
+}
+
+// RemoveCID deletes all jobs of the owner pinning the CID, and unpins it if
+// no other owners refer to it. An empty owner means all owners, so that the
+// CID is always unpinned.
+func (q *Queue) RemoveCID(ctx context.Context, cid, owner string) error {
+	q.mu.Lock()
+	others := false
+	for _, job := range q.byCID[cid] {
+		if owner != "" && job.Owner != owner {
+			others = true
+			continue
+		}
+		if err := q.forget(job); err != nil {
+			q.mu.Unlock()
+			return err
+		}
+	}
+	q.mu.Unlock()
+	if owner == "" {
+		return q.unpin(ctx, cid)
+	}
+
+	owners, err := q.store.Disown(cid, owner)
+	if err != nil {
+		return err
+	}
+	if others || owners > 0 {
+		return nil
+	}
+	return q.unpin(ctx, cid)
+}
+
+// unpin removes the pin and its metadata from the node.
+func (q *Queue) unpin(ctx context.Context, cid string) error {
+	if err := q.store.Delete(cid); err != nil {
+		return err
+	}
+	if err := q.ipfs.Pin().Rm(ctx, icorepath.New(cid)); err != nil {
+		return err
+	}
+	if q.OnUnpin != nil {
+		q.OnUnpin()
+	}
+	return nil
+}
+
+// unpinOrphan unpins the CID pinned by a job which was removed while being
+// worked on, too late to stop it, unless other jobs or owners refer to it.
+func (q *Queue) unpinOrphan(cid string) {
+	q.mu.Lock()
+	others := len(q.byCID[cid]) > 0
+	q.mu.Unlock()
+	rec, found, err := q.store.Get(cid)
+	if err != nil {
+		log.Printf("error: %v", err)
+		return
+	}
+	if others || (found && len(rec.Owners) > 0) {
+		return
+	}
+	ctx := context.Background()
+	_, pinned, err := q.ipfs.Pin().IsPinned(ctx, icorepath.New(cid), options.Pin.IsPinned.Recursive())
+	if err != nil || !pinned {
+		// already unpinned by Remove
+		return
+	}
+	if err := q.unpin(ctx, cid); err != nil {
+		log.Printf("Could not unpin %s of removed job: %v", cid, err)
+	}
+}
+
+// prune forgets jobs which finished more than Retention ago.
+func (q *Queue) prune() {
+	cutoff := time.Now().Add(-q.Retention)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for _, job := range q.jobs {
+		if !job.Done() || !job.Updated.Before(cutoff) {
+			continue
+		}
+		if err := q.forget(job); err != nil {
+			log.Printf("error: %v", err)
+			continue
+		}
+		n++
+	}
+	if n > 0 {
+		log.Printf("Forgot %d finished pin jobs", n)
+	}
+}
+
+// index adds the job to the queue. It must be called with q.mu locked.
+func (q *Queue) index(job *Job) {
+	q.jobs[job.ID] = job
+	if q.byCID[job.Pin.CID] == nil {
+		q.byCID[job.Pin.CID] = map[string]*Job{}
+	}
+	q.byCID[job.Pin.CID][job.ID] = job
+}
+
+// forget deletes the job from the queue and datastore. It must be called with
+// q.mu locked.
+func (q *Queue) forget(job *Job) error {
+	if err := q.ds.Delete(datastore.NewKey(job.ID)); err != nil {
+		return fmt.Errorf("deleting job %s: %w", job.ID, err)
+	}
+	delete(q.jobs, job.ID)
+	delete(q.byCID[job.Pin.CID], job.ID)
+	if len(q.byCID[job.Pin.CID]) == 0 {
+		delete(q.byCID, job.Pin.CID)
+	}
+	if cancel, found := q.cancels[job.ID]; found {
+		cancel()
+	}
+	for i, id := range q.pending {
+		if id == job.ID {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// save persists the job. It must be called with q.mu locked.
+func (q *Queue) save(job *Job) error {
+	buf, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	if err := q.ds.Put(datastore.NewKey(job.ID), buf); err != nil {
+		return fmt.Errorf("saving job %s: %w", job.ID, err)
+	}
+	return nil
+}
+
+// signal wakes up a waiting worker, if any. It's safe to call it with q.mu
+// locked.
+func (q *Queue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) work(ctx context.Context) {
+	for {
+		job, jobCtx, ok := q.next(ctx)
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-q.wake:
+			}
+			continue
+		}
+		start := time.Now()
+		size, err := q.pin(jobCtx, job)
+		if ctx.Err() != nil {
+			// shutting down; leave the job unfinished, to resume it later
+			return
+		}
+		outcome := psa.Pinned
+		if err != nil {
+			outcome = psa.Failed
+		}
+		took := time.Since(start)
+		if q.finish(job, size, err) {
+			jobsTotal.WithLabelValues(outcome).Inc()
+			jobDuration.WithLabelValues(outcome).Observe(took.Seconds())
+		}
+	}
+}
+
+// next takes the first pending job off the queue, marking it as being pinned.
+func (q *Queue) next(ctx context.Context) (Job, context.Context, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) == 0 {
+		return Job{}, nil, false
+	}
+	job := q.jobs[q.pending[0]]
+	q.pending = q.pending[1:]
+	if len(q.pending) > 0 {
+		// let other workers help
+		q.signal()
+	}
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	q.cancels[job.ID] = cancel
+	q.update(job, psa.Pinning, nil)
+	return *job, jobCtx, true
+}
+
+// finish records the outcome of the job, and does any cleanup required. It
+// returns false if the job was removed while being worked on.
+func (q *Queue) finish(job Job, size int64, err error) bool {
+	q.mu.Lock()
+	if cancel, found := q.cancels[job.ID]; found {
+		cancel()
+		delete(q.cancels, job.ID)
+	}
+	stored, found := q.jobs[job.ID]
+	if !found {
+		// Removed in the meantime, but cancelling may have come too late
+		q.mu.Unlock()
+		if err == nil {
+			q.unpinOrphan(job.Pin.CID)
+		}
+		return false
+	}
+	if err != nil {
+		log.Printf("Could not pin %s: %v", job.Pin.CID, err)
+		q.update(stored, psa.Failed, err)
+		q.mu.Unlock()
+		return true
+	}
+	q.update(stored, psa.Pinned, nil)
+	// Record the pin before Remove may see the job as pinned, so that it
+	// doesn't unpin content which is then recorded as owned.
+	err = q.store.Put(PinRecord{
+		Hash:   job.Pin.CID,
+		Name:   job.Pin.Name,
+		Size:   size,
+		Tags:   job.Pin.Meta,
+		Owners: owners(job.Owner),
+	})
+	q.mu.Unlock()
+	if err != nil {
+		log.Printf("error: %v", err)
+	}
+
+	if job.Replaces != "" {
+		err := q.Remove(context.Background(), job.Replaces)
+		if errors.Is(err, errJobNotFound) {
+			// maybe a pin not created via a job
+			err = q.RemoveCID(context.Background(), job.Replaces, job.Owner)
+		}
+		if err != nil {
+			log.Printf("Could not remove replaced pin %s: %v", job.Replaces, err)
+		}
+	}
+	return true
+}
+
+// update changes status of the job and persists it. It must be called with
+// q.mu locked.
+func (q *Queue) update(job *Job, status string, err error) {
+	job.Status = status
+	job.Error = ""
+	if err != nil {
+		job.Error = err.Error()
+	}
+	job.Updated = time.Now().UTC()
+	if err := q.save(job); err != nil {
+		log.Printf("error: %v", err)
+	}
+}
+
+// pin connects to the job's origins, if any, pins its content, and returns
+// its cumulative size.
+func (q *Queue) pin(ctx context.Context, job Job) (int64, error) {
+	path := icorepath.New(job.Pin.CID)
+	if err := path.IsValid(); err != nil {
+		return 0, err
+	}
+	for _, o := range job.Pin.Origins {
+		addr, err := ma.NewMultiaddr(o)
+		if err != nil {
+			continue
+		}
+		info, err := peer.AddrInfoFromP2pAddr(addr)
+		if err != nil {
+			continue
+		}
+		if err := q.ipfs.Swarm().Connect(ctx, *info); err != nil {
+			log.Printf("Could not connect to origin %s: %v", o, err)
+		}
+	}
+	if err := q.ipfs.Pin().Add(ctx, path); err != nil {
+		return 0, err
+	}
+	size, err := dagSize(ctx, q.ipfs, path)
+	if err != nil {
+		// content is pinned, so that's not worth failing the job for
+		log.Printf("error: %v", err)
+	}
+	return size, nil
+}
+
+// dagSize returns the cumulative size of the DAG rooted at path.
+func dagSize(ctx context.Context, ipfs iface.CoreAPI, path icorepath.Path) (int64, error) {
+	stat, err := ipfs.Object().Stat(ctx, path)
+	if err == nil {
+		return int64(stat.CumulativeSize), nil
+	}
+	// Not a dag-pb node (e.g. a raw block), so it has no links
+	block, err := ipfs.Block().Stat(ctx, path)
+	if err != nil {
+		return 0, fmt.Errorf("checking size of %s: %w", path, err)
+	}
+	return int64(block.Size()), nil
+}
+
+func owners(owner string) []string {
+	if owner == "" {
+		return nil
+	}
+	return []string{owner}
+}
+
+func newJobID() string {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		// Should never happen
+		panic(err)
+	}
+	return hex.EncodeToString(buf[:])
+}
@@ -0,0 +1,434 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	files "github.com/ipfs/go-ipfs-files"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	icorepath "github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/wpengine/hackathon-catation/pup/psa"
+)
+
+// Valid CIDs for tests
+const (
+	cidA = "QmPZ9gcCEpqKTo6aq61g2nXGUhM4iCL3ewB6LDXZCtioEB"
+	cidB = "QmWATWQ7fVPP2EFGu71UkfnqhYXDYH566qy47CnJDgvs8u"
+	cidC = "QmRgutAxd8t7oGkSm4wmeuByG6M51wcTso6cubDdQtuEfL"
+)
+
+// fakeIPFS implements the parts of the CoreAPI used by PiPin, keeping pins
+// in memory. Pinning blocks while the gate is closed, and then succeeds even
+// if cancelled, to emulate the race with removal of running jobs.
+type fakeIPFS struct {
+	iface.CoreAPI
+
+	mu       sync.Mutex
+	pins     map[string]bool
+	sizes    map[string]int64 // 100 if missing
+	gate     chan struct{}    // pinning waits until it's closed, if non-nil
+	inFlight int
+	maxIn    int
+}
+
+func newFakeIPFS() *fakeIPFS {
+	return &fakeIPFS{pins: map[string]bool{}, sizes: map[string]int64{}}
+}
+
+func (f *fakeIPFS) Pin() iface.PinAPI       { return fakePinAPI{fakeIPFS: f} }
+func (f *fakeIPFS) Object() iface.ObjectAPI { return fakeObjectAPI{fakeIPFS: f} }
+func (f *fakeIPFS) Unixfs() iface.UnixfsAPI { return fakeUnixfsAPI{fakeIPFS: f} }
+
+func (f *fakeIPFS) pinned(cid string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.pins[cid]
+}
+
+type fakePinAPI struct {
+	*fakeIPFS
+	iface.PinAPI
+}
+
+func (f fakePinAPI) Add(ctx context.Context, p icorepath.Path, _ ...options.PinAddOption) error {
+	f.mu.Lock()
+	f.inFlight++
+	if f.inFlight > f.maxIn {
+		f.maxIn = f.inFlight
+	}
+	gate := f.gate
+	f.mu.Unlock()
+	if gate != nil {
+		<-gate
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inFlight--
+	f.pins[cidOf(p)] = true
+	return nil
+}
+
+func (f fakePinAPI) IsPinned(ctx context.Context, p icorepath.Path, _ ...options.PinIsPinnedOption) (string, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return "recursive", f.pins[cidOf(p)], nil
+}
+
+func (f fakePinAPI) Ls(ctx context.Context, _ ...options.PinLsOption) (<-chan iface.Pin, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ch := make(chan iface.Pin, len(f.pins))
+	for c := range f.pins {
+		parsed, err := cid.Decode(c)
+		if err != nil {
+			return nil, err
+		}
+		ch <- fakePin{icorepath.IpfsPath(parsed)}
+	}
+	close(ch)
+	return ch, nil
+}
+
+type fakePin struct {
+	path icorepath.Resolved
+}
+
+func (p fakePin) Path() icorepath.Resolved { return p.path }
+func (p fakePin) Type() string             { return "recursive" }
+func (p fakePin) Err() error               { return nil }
+
+func (f fakePinAPI) Rm(ctx context.Context, p icorepath.Path, _ ...options.PinRmOption) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.pins[cidOf(p)] {
+		return errors.New("not pinned or pinned indirectly")
+	}
+	delete(f.pins, cidOf(p))
+	return nil
+}
+
+type fakeObjectAPI struct {
+	*fakeIPFS
+	iface.ObjectAPI
+}
+
+func (f fakeObjectAPI) Stat(ctx context.Context, p icorepath.Path) (*iface.ObjectStat, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	size, found := f.sizes[cidOf(p)]
+	if !found {
+		size = 100
+	}
+	return &iface.ObjectStat{CumulativeSize: int(size)}, nil
+}
+
+// fakeUnixfsAPI adds the contents of files as a single raw block, which is
+// pinned.
+type fakeUnixfsAPI struct {
+	*fakeIPFS
+	iface.UnixfsAPI
+}
+
+func (f fakeUnixfsAPI) Add(ctx context.Context, node files.Node, _ ...options.UnixfsAddOption) (icorepath.Resolved, error) {
+	var data []byte
+	err := files.Walk(node, func(fpath string, nd files.Node) error {
+		if file, ok := nd.(files.File); ok {
+			b, err := ioutil.ReadAll(file)
+			data = append(data, b...)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	prefix := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: 0x12, MhLength: -1} // sha2-256
+	c, err := prefix.Sum(data)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pins[c.String()] = true
+	f.sizes[c.String()] = int64(len(data))
+	return icorepath.IpfsPath(c), nil
+}
+
+func cidOf(p icorepath.Path) string {
+	return p.String()[len("/ipfs/"):]
+}
+
+func newTestQueue(t *testing.T, ipfs *fakeIPFS, ds datastore.Datastore) *Queue {
+	q, err := NewQueue(ipfs, ds, NewStore(ds))
+	if err != nil {
+		t.Fatalf("NewQueue: %v", err)
+	}
+	return q
+}
+
+// start runs the queue's workers until the end of the test.
+func start(t *testing.T, q *Queue, workers int) {
+	ctx, cancel := context.WithCancel(context.Background())
+	q.Start(ctx, workers)
+	t.Cleanup(func() {
+		cancel()
+		q.Wait()
+	})
+}
+
+// waitFor polls cond until it's true, failing the test after a while.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for i := 0; i < 500; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func jobStatusIs(q *Queue, id, status string) func() bool {
+	return func() bool {
+		job, found := q.Get(id)
+		return found && job.Status == status
+	}
+}
+
+func TestQueuePersistence(t *testing.T) {
+	ipfs := newFakeIPFS()
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+
+	q := newTestQueue(t, ipfs, ds)
+	a, err := q.Add(psa.Pin{CID: cidA, Name: "a"}, "", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := q.Add(psa.Pin{CID: cidB}, "", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Not started, so both jobs are resumed by a new queue
+	q = newTestQueue(t, ipfs, ds)
+	if n := q.Len(); n != 2 {
+		t.Fatalf("reloaded queue has %d pending jobs, want 2", n)
+	}
+	got, found := q.Get(a.ID)
+	if !found || got.Pin.Name != "a" || got.Owner != "alice" || got.Status != psa.Queued {
+		t.Errorf("reloaded job = %+v, %v; want queued job of alice named a", got, found)
+	}
+	start(t, q, 1)
+	waitFor(t, "jobs to finish", func() bool {
+		return jobStatusIs(q, a.ID, psa.Pinned)() && jobStatusIs(q, b.ID, psa.Pinned)()
+	})
+	if !ipfs.pinned(cidA) || !ipfs.pinned(cidB) {
+		t.Errorf("pins = %v, want both CIDs", ipfs.pins)
+	}
+	rec, found, err := q.store.Get(cidA)
+	if err != nil || !found || rec.Size != 100 || !rec.OwnedBy("alice") {
+		t.Errorf("record of %s = %+v, %v, %v; want 100 bytes owned by alice", cidA, rec, found, err)
+	}
+
+	// Finished jobs are not resumed
+	q = newTestQueue(t, ipfs, ds)
+	if n := q.Len(); n != 0 {
+		t.Errorf("reloaded queue has %d pending jobs, want 0", n)
+	}
+	if got, _ := q.Get(b.ID); got.Status != psa.Pinned {
+		t.Errorf("reloaded job status = %q, want pinned", got.Status)
+	}
+}
+
+func TestQueueConcurrency(t *testing.T) {
+	ipfs := newFakeIPFS()
+	ipfs.gate = make(chan struct{})
+	q := newTestQueue(t, ipfs, dssync.MutexWrap(datastore.NewMapDatastore()))
+	start(t, q, 2)
+
+	var ids []string
+	for _, cid := range []string{cidA, cidB, cidC} {
+		job, err := q.Add(psa.Pin{CID: cid}, "", "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, job.ID)
+	}
+	waitFor(t, "two jobs to start", func() bool { return q.Len() == 1 })
+	time.Sleep(50 * time.Millisecond)
+	ipfs.mu.Lock()
+	if ipfs.inFlight != 2 {
+		t.Errorf("%d jobs in progress, want 2", ipfs.inFlight)
+	}
+	ipfs.mu.Unlock()
+
+	close(ipfs.gate)
+	for _, id := range ids {
+		waitFor(t, "job "+id, jobStatusIs(q, id, psa.Pinned))
+	}
+	if ipfs.maxIn != 2 {
+		t.Errorf("at most %d jobs were in progress, want 2", ipfs.maxIn)
+	}
+}
+
+func TestQueueRemoveRunning(t *testing.T) {
+	ipfs := newFakeIPFS()
+	ipfs.gate = make(chan struct{})
+	q := newTestQueue(t, ipfs, dssync.MutexWrap(datastore.NewMapDatastore()))
+	unpinned := 0
+	q.OnUnpin = func() { unpinned++ }
+	start(t, q, 1)
+
+	failed := testutil.ToFloat64(jobsTotal.WithLabelValues(psa.Failed))
+	job, err := q.Add(psa.Pin{CID: cidA}, "", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "job to start", jobStatusIs(q, job.ID, psa.Pinning))
+
+	// Pinning completes despite the cancellation
+	if err := q.Remove(context.Background(), job.ID); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	close(ipfs.gate)
+	waitFor(t, "orphaned pin to be removed", func() bool {
+		ipfs.mu.Lock()
+		defer ipfs.mu.Unlock()
+		return ipfs.inFlight == 0 && !ipfs.pins[cidA]
+	})
+	if _, found := q.Get(job.ID); found {
+		t.Error("removed job is still known")
+	}
+	if _, found, _ := q.store.Get(cidA); found {
+		t.Error("removed job left a pin record")
+	}
+	if got := testutil.ToFloat64(jobsTotal.WithLabelValues(psa.Failed)); got != failed {
+		t.Errorf("removed job counted as failed")
+	}
+
+	// Content still wanted by another job stays pinned
+	ipfs.mu.Lock()
+	ipfs.gate = make(chan struct{})
+	ipfs.mu.Unlock()
+	mine, _ := q.Add(psa.Pin{CID: cidB}, "", "alice")
+	theirs, _ := q.Add(psa.Pin{CID: cidB}, "", "bob")
+	waitFor(t, "job to start", jobStatusIs(q, mine.ID, psa.Pinning))
+	if err := q.Remove(context.Background(), mine.ID); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	ipfs.mu.Lock()
+	close(ipfs.gate)
+	ipfs.mu.Unlock()
+	waitFor(t, "other job", jobStatusIs(q, theirs.ID, psa.Pinned))
+	if !ipfs.pinned(cidB) {
+		t.Error("content of the other job got unpinned")
+	}
+}
+
+func TestQueueRemove(t *testing.T) {
+	ipfs := newFakeIPFS()
+	q := newTestQueue(t, ipfs, dssync.MutexWrap(datastore.NewMapDatastore()))
+	ctx := context.Background()
+
+	// Pending jobs are just dropped
+	pending, _ := q.Add(psa.Pin{CID: cidA}, "", "alice")
+	if err := q.Remove(ctx, pending.ID); err != nil {
+		t.Fatalf("Remove of pending job: %v", err)
+	}
+	if q.Len() != 0 {
+		t.Errorf("%d pending jobs after Remove, want 0", q.Len())
+	}
+	if err := q.Remove(ctx, pending.ID); !errors.Is(err, errJobNotFound) {
+		t.Errorf("second Remove = %v, want errJobNotFound", err)
+	}
+
+	start(t, q, 1)
+	alice, _ := q.Add(psa.Pin{CID: cidB}, "", "alice")
+	bob, _ := q.Add(psa.Pin{CID: cidB}, "", "bob")
+	waitFor(t, "jobs", func() bool {
+		return jobStatusIs(q, alice.ID, psa.Pinned)() && jobStatusIs(q, bob.ID, psa.Pinned)()
+	})
+	if !q.Owns(cidB, "alice") || !q.Owns(cidB, "bob") || q.Owns(cidB, "carol") {
+		t.Error("Owns doesn't match owners of jobs")
+	}
+
+	if err := q.RemoveCID(ctx, cidB, "alice"); err != nil {
+		t.Fatalf("RemoveCID: %v", err)
+	}
+	if q.Owns(cidB, "alice") || !ipfs.pinned(cidB) {
+		t.Errorf("after RemoveCID by alice: owned by alice %v, pinned %v; want false, true", q.Owns(cidB, "alice"), ipfs.pinned(cidB))
+	}
+	if err := q.RemoveCID(ctx, cidB, "bob"); err != nil {
+		t.Fatalf("RemoveCID: %v", err)
+	}
+	if ipfs.pinned(cidB) {
+		t.Error("content still pinned after all owners removed it")
+	}
+	if _, found := q.Latest(cidB); found {
+		t.Error("Latest found a job after all were removed")
+	}
+}
+
+func TestQueuePrune(t *testing.T) {
+	ipfs := newFakeIPFS()
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	q := newTestQueue(t, ipfs, ds)
+
+	var jobs []Job
+	for _, cid := range []string{cidA, cidB, cidC} {
+		job, err := q.Add(psa.Pin{CID: cid}, "", "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, job)
+	}
+	// cidA finished long ago, cidB recently, cidC is still queued
+	q.mu.Lock()
+	q.jobs[jobs[0].ID].Status = psa.Failed
+	q.jobs[jobs[0].ID].Updated = time.Now().Add(-2 * time.Hour)
+	q.jobs[jobs[1].ID].Status = psa.Pinned
+	q.jobs[jobs[2].ID].Updated = time.Now().Add(-2 * time.Hour)
+	q.mu.Unlock()
+
+	q.Retention = time.Hour
+	q.prune()
+	if _, found := q.Get(jobs[0].ID); found {
+		t.Error("old finished job was kept")
+	}
+	if _, found := q.Latest(cidA); found {
+		t.Error("Latest found the old finished job")
+	}
+	for _, job := range jobs[1:] {
+		if _, found := q.Get(job.ID); !found {
+			t.Errorf("job of %s was forgotten", job.Pin.CID)
+		}
+	}
+	if n := len(newTestQueue(t, ipfs, ds).List()); n != 2 {
+		t.Errorf("reloaded queue has %d jobs, want 2", n)
+	}
+}
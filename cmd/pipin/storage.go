@@ -0,0 +1,226 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/core/corerepo"
+)
+
+var (
+	errRepoFull      = errors.New("repo size limit reached")
+	errQuotaExceeded = errors.New("quota of the token exceeded")
+
+	errFreeSpaceUnsupported = errors.New("checking free space is not supported on this system")
+)
+
+// Storage guards disk usage of the IPFS repo: it refuses new pins once the
+// repo grows over a limit, and collects garbage after content is unpinned.
+type Storage struct {
+	path    string
+	maxSize uint64 // 0 means unlimited
+	store   *Store
+	gc      chan struct{}
+
+	// repoSize and collectGarbage operate on the node's repo.
+	repoSize       func(ctx context.Context) (uint64, error)
+	collectGarbage func(ctx context.Context) error
+
+	mu     sync.Mutex
+	lastGC *time.Time
+}
+
+func NewStorage(node *core.IpfsNode, path string, maxSize uint64, store *Store) *Storage {
+	return &Storage{
+		path:    path,
+		maxSize: maxSize,
+		store:   store,
+		gc:      make(chan struct{}, 1),
+		repoSize: func(ctx context.Context) (uint64, error) {
+			stat, err := corerepo.RepoSize(ctx, node)
+			if err != nil {
+				return 0, fmt.Errorf("checking repo size: %w", err)
+			}
+			return stat.RepoSize, nil
+		},
+		collectGarbage: func(ctx context.Context) error {
+			return corerepo.GarbageCollect(node, ctx)
+		},
+	}
+}
+
+// Admit checks whether new content can be pinned with the token. It returns
+// errRepoFull or errQuotaExceeded if it can't.
+//
+// For pins, this is only a check before the content is fetched, as its size
+// isn't known until then: the repo and quotas may be exceeded by content
+// already admitted, up to the size of one pin per worker and per token.
+// Uploads are also limited as they are received, see Headroom.
+func (s *Storage) Admit(ctx context.Context, token *Token) error {
+	if s.maxSize > 0 {
+		size, err := s.repoSize(ctx)
+		if err != nil {
+			return err
+		}
+		if size >= s.maxSize {
+			return fmt.Errorf("%w: %s used of %s", errRepoFull,
+				humanize.Bytes(size), humanize.Bytes(s.maxSize))
+		}
+	}
+	over, err := s.store.overQuota(token)
+	if err != nil {
+		return err
+	}
+	if over {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// Headroom returns how many more bytes can be stored with the token before
+// the repo limit or its quota is reached, or -1 if there is no limit.
+func (s *Storage) Headroom(ctx context.Context, token *Token) (int64, error) {
+	headroom := int64(-1)
+	if s.maxSize > 0 {
+		size, err := s.repoSize(ctx)
+		if err != nil {
+			return 0, err
+		}
+		headroom = 0
+		if size < s.maxSize {
+			headroom = int64(s.maxSize - size)
+		}
+	}
+	if token.Quota > 0 {
+		used, err := s.store.Usage(token.Name)
+		if err != nil {
+			return 0, err
+		}
+		left := token.Quota - used
+		if left < 0 {
+			left = 0
+		}
+		if headroom < 0 || left < headroom {
+			headroom = left
+		}
+	}
+	return headroom, nil
+}
+
+// ScheduleGC requests garbage collection of the repo. It doesn't wait for
+// the collection to happen.
+func (s *Storage) ScheduleGC() {
+	select {
+	case s.gc <- struct{}{}:
+	default:
+		// already scheduled
+	}
+}
+
+// Start runs garbage collection in background, whenever it was scheduled,
+// but no more often than every delay, so that many unpins in a row don't
+// cause many collections.
+func (s *Storage) Start(ctx context.Context, delay time.Duration) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.gc:
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			s.collect(ctx)
+		}
+	}()
+}
+
+func (s *Storage) collect(ctx context.Context) {
+	before, err := s.repoSize(ctx)
+	if err != nil {
+		log.Printf("error: %v", err)
+	}
+	log.Println("Collecting garbage...")
+	if err := s.collectGarbage(ctx); err != nil {
+		log.Printf("Could not collect garbage: %v", err)
+		return
+	}
+	after, err := s.repoSize(ctx)
+	if err != nil {
+		log.Printf("error: %v", err)
+	}
+	if after < before {
+		log.Printf("Collected garbage, freed %s", humanize.Bytes(before-after))
+	}
+
+	now := time.Now().UTC()
+	s.mu.Lock()
+	s.lastGC = &now
+	s.mu.Unlock()
+}
+
+// StorageStats describes disk usage of PiPin.
+type StorageStats struct {
+	RepoSize    uint64     `json:"repo_size"`
+	MaxSize     uint64     `json:"max_size,omitempty"` // missing if unlimited
+	PinnedBytes uint64     `json:"pinned_bytes"`       // cumulative size of pinned content, counting shared blocks many times
+	Pins        int        `json:"pins"`
+	FreeSpace   *uint64    `json:"free_space,omitempty"` // on the repo's filesystem; missing if unknown
+	LastGC      *time.Time `json:"last_gc,omitempty"`    // missing if not collected since start
+}
+
+// Stats returns current disk usage.
+func (s *Storage) Stats(ctx context.Context) (StorageStats, error) {
+	var stats StorageStats
+	var err error
+	stats.RepoSize, err = s.repoSize(ctx)
+	if err != nil {
+		return stats, err
+	}
+	stats.MaxSize = s.maxSize
+
+	records, err := s.store.All()
+	if err != nil {
+		return stats, err
+	}
+	for _, rec := range records {
+		stats.PinnedBytes += uint64(rec.Size)
+	}
+	stats.Pins = len(records)
+
+	free, err := freeSpace(s.path)
+	if err == nil {
+		stats.FreeSpace = &free
+	} else if err != errFreeSpaceUnsupported {
+		log.Printf("Could not check free space: %v", err)
+	}
+
+	s.mu.Lock()
+	stats.LastGC = s.lastGC
+	s.mu.Unlock()
+	return stats, nil
+}
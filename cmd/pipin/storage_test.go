@@ -0,0 +1,215 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+)
+
+// fakeRepo emulates size and garbage collection of a repo for Storage.
+type fakeRepo struct {
+	mu   sync.Mutex
+	size uint64
+	gcs  int
+}
+
+func newTestStorage(t *testing.T, repo *fakeRepo, maxSize uint64) *Storage {
+	store := NewStore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	s := &Storage{
+		path:    t.TempDir(),
+		maxSize: maxSize,
+		store:   store,
+		gc:      make(chan struct{}, 1),
+		repoSize: func(context.Context) (uint64, error) {
+			repo.mu.Lock()
+			defer repo.mu.Unlock()
+			return repo.size, nil
+		},
+		collectGarbage: func(context.Context) error {
+			repo.mu.Lock()
+			defer repo.mu.Unlock()
+			repo.gcs++
+			repo.size /= 2
+			return nil
+		},
+	}
+	return s
+}
+
+func (r *fakeRepo) collections() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.gcs
+}
+
+func TestAdmit(t *testing.T) {
+	repo := &fakeRepo{}
+	s := newTestStorage(t, repo, 1000)
+	ctx := context.Background()
+	for _, rec := range []PinRecord{
+		{Hash: cidA, Size: 300, Owners: []string{"alice", "bob"}},
+		{Hash: cidB, Size: 300, Owners: []string{"alice"}},
+	} {
+		if err := s.store.Put(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		repoSize uint64
+		token    Token
+		want     error
+	}{
+		{0, Token{Name: "alice"}, nil},
+		{999, Token{Name: "alice"}, nil},
+		{1000, Token{Name: "alice"}, errRepoFull},
+		{1500, Token{Name: "carol", Scopes: []string{ScopeAdmin}}, errRepoFull},
+		{0, Token{Name: "alice", Quota: 601}, nil},
+		{0, Token{Name: "alice", Quota: 600}, errQuotaExceeded},
+		{0, Token{Name: "bob", Quota: 600}, nil},
+		{0, Token{Name: "bob", Quota: 300}, errQuotaExceeded},
+		{0, Token{Name: "carol", Quota: 1}, nil},
+	}
+	for _, tt := range tests {
+		repo.size = tt.repoSize
+		err := s.Admit(ctx, &tt.token)
+		if !errors.Is(err, tt.want) || (tt.want == nil && err != nil) {
+			t.Errorf("Admit(%s with quota %d) with repo of %d bytes = %v, want %v",
+				tt.token.Name, tt.token.Quota, tt.repoSize, err, tt.want)
+		}
+	}
+
+	// Unlimited repo
+	s.maxSize = 0
+	repo.size = 1 << 40
+	if err := s.Admit(ctx, &Token{Name: "alice"}); err != nil {
+		t.Errorf("Admit with unlimited repo = %v, want nil", err)
+	}
+}
+
+func TestHeadroom(t *testing.T) {
+	repo := &fakeRepo{}
+	s := newTestStorage(t, repo, 1000)
+	ctx := context.Background()
+	err := s.store.Put(PinRecord{Hash: cidA, Size: 300, Owners: []string{"alice"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		maxSize  uint64
+		repoSize uint64
+		token    Token
+		want     int64
+	}{
+		{1000, 400, Token{Name: "alice"}, 600},
+		{1000, 1200, Token{Name: "alice"}, 0},
+		{1000, 400, Token{Name: "alice", Quota: 500}, 200},
+		{1000, 900, Token{Name: "alice", Quota: 500}, 100},
+		{1000, 400, Token{Name: "alice", Quota: 200}, 0},
+		{1000, 400, Token{Name: "bob", Quota: 200}, 200},
+		{0, 400, Token{Name: "alice"}, -1},
+		{0, 400, Token{Name: "alice", Quota: 500}, 200},
+	}
+	for _, tt := range tests {
+		s.maxSize = tt.maxSize
+		repo.size = tt.repoSize
+		got, err := s.Headroom(ctx, &tt.token)
+		if err != nil || got != tt.want {
+			t.Errorf("Headroom(%s with quota %d) with repo of %d/%d bytes = %d, %v; want %d",
+				tt.token.Name, tt.token.Quota, tt.repoSize, tt.maxSize, got, err, tt.want)
+		}
+	}
+}
+
+func TestScheduleGC(t *testing.T) {
+	repo := &fakeRepo{size: 1000}
+	s := newTestStorage(t, repo, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Start(ctx, 50*time.Millisecond)
+
+	// Many unpins in a row cause one collection, after the delay
+	for i := 0; i < 5; i++ {
+		s.ScheduleGC()
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := repo.collections(); n != 0 {
+		t.Errorf("%d collections before the delay, want 0", n)
+	}
+	waitFor(t, "collection", func() bool { return repo.collections() >= 1 })
+	time.Sleep(100 * time.Millisecond)
+	if n := repo.collections(); n != 1 {
+		t.Errorf("%d collections, want 1", n)
+	}
+
+	s.ScheduleGC()
+	waitFor(t, "second collection", func() bool { return repo.collections() == 2 })
+
+	// No collections after stopping
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	s.ScheduleGC()
+	time.Sleep(100 * time.Millisecond)
+	if n := repo.collections(); n != 2 {
+		t.Errorf("%d collections after stopping, want 2", n)
+	}
+}
+
+func TestStats(t *testing.T) {
+	repo := &fakeRepo{size: 800}
+	s := newTestStorage(t, repo, 1000)
+	ctx := context.Background()
+	for _, rec := range []PinRecord{
+		{Hash: cidA, Size: 300},
+		{Hash: cidB, Size: 200},
+	} {
+		if err := s.store.Put(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := s.Stats(ctx)
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	if stats.RepoSize != 800 || stats.MaxSize != 1000 || stats.PinnedBytes != 500 || stats.Pins != 2 {
+		t.Errorf("Stats = %+v, want repo of 800/1000 bytes with 2 pins of 500 bytes", stats)
+	}
+	if stats.LastGC != nil {
+		t.Errorf("LastGC = %v before any collection, want nil", stats.LastGC)
+	}
+	if (stats.FreeSpace != nil) != (runtime.GOOS == "linux" || runtime.GOOS == "darwin" || runtime.GOOS == "freebsd") {
+		t.Errorf("FreeSpace = %v on %s", stats.FreeSpace, runtime.GOOS)
+	}
+
+	s.collect(ctx)
+	stats, err = s.Stats(ctx)
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	if stats.RepoSize != 400 || stats.LastGC == nil || time.Since(*stats.LastGC) > time.Minute {
+		t.Errorf("Stats after collection = %+v, want repo of 400 bytes and LastGC now", stats)
+	}
+}
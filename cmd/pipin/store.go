@@ -0,0 +1,207 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// PinRecord is metadata which PiPin keeps about a pinned hash.
+type PinRecord struct {
+	Hash    string            `json:"hash"`
+	Name    string            `json:"name,omitempty"`
+	Size    int64             `json:"size"` // cumulative size of the DAG, in bytes
+	Created time.Time         `json:"created"`
+	Updated time.Time         `json:"updated"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	// Owners are names of tokens which pinned the hash; it stays pinned
+	// until all of them unpin it.
+	Owners []string `json:"owners,omitempty"`
+}
+
+// OwnedBy reports whether the token with the name is one of the owners.
+func (rec *PinRecord) OwnedBy(name string) bool {
+	for _, o := range rec.Owners {
+		if o == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Store keeps PinRecords in a datastore, under the /pipin/pins prefix.
+type Store struct {
+	ds datastore.Datastore
+	mu sync.Mutex
+}
+
+func NewStore(ds datastore.Datastore) *Store {
+	return &Store{
+		ds: namespace.Wrap(ds, datastore.NewKey("/pipin/pins")),
+	}
+}
+
+// Get returns the record for the hash, if there is one.
+func (s *Store) Get(hash string) (PinRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(hash)
+}
+
+func (s *Store) get(hash string) (PinRecord, bool, error) {
+	var rec PinRecord
+	buf, err := s.ds.Get(datastore.NewKey(hash))
+	if err == datastore.ErrNotFound {
+		return rec, false, nil
+	}
+	if err != nil {
+		return rec, false, fmt.Errorf("reading metadata of %s: %w", hash, err)
+	}
+	if err := json.Unmarshal(buf, &rec); err != nil {
+		return rec, false, fmt.Errorf("decoding metadata of %s: %w", hash, err)
+	}
+	return rec, true, nil
+}
+
+// Put saves the record, setting its Updated time, and keeping the Created
+// time and Owners of an already existing record.
+func (s *Store) Put(rec PinRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	old, found, err := s.get(rec.Hash)
+	if err != nil {
+		return err
+	}
+	rec.Created = now
+	if found {
+		rec.Created = old.Created
+		for _, o := range old.Owners {
+			if !rec.OwnedBy(o) {
+				rec.Owners = append(rec.Owners, o)
+			}
+		}
+	}
+	rec.Updated = now
+	return s.put(rec)
+}
+
+func (s *Store) put(rec PinRecord) error {
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err := s.ds.Put(datastore.NewKey(rec.Hash), buf); err != nil {
+		return fmt.Errorf("saving metadata of %s: %w", rec.Hash, err)
+	}
+	return nil
+}
+
+// Delete removes the record for the hash, if there is one.
+func (s *Store) Delete(hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.ds.Delete(datastore.NewKey(hash))
+	if err != nil && err != datastore.ErrNotFound {
+		return fmt.Errorf("deleting metadata of %s: %w", hash, err)
+	}
+	return nil
+}
+
+// Disown removes the token with the name from owners of the hash, and
+// returns the number of remaining owners.
+func (s *Store) Disown(hash, name string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, found, err := s.get(hash)
+	if err != nil || !found {
+		return 0, err
+	}
+	owners := []string{}
+	for _, o := range rec.Owners {
+		if o != name {
+			owners = append(owners, o)
+		}
+	}
+	if len(owners) == len(rec.Owners) {
+		return len(owners), nil
+	}
+	rec.Owners = owners
+	rec.Updated = time.Now().UTC()
+	return len(owners), s.put(rec)
+}
+
+// Usage returns the total size of content owned by the token with the name.
+func (s *Store) Usage(name string) (int64, error) {
+	all, err := s.All()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, rec := range all {
+		if rec.OwnedBy(name) {
+			total += rec.Size
+		}
+	}
+	return total, nil
+}
+
+// overQuota reports whether the token already uses all of its quota. As the
+// size of content is only known once it's pinned, the quota may be exceeded
+// by the last pin.
+func (s *Store) overQuota(token *Token) (bool, error) {
+	if token.Quota <= 0 {
+		return false, nil
+	}
+	used, err := s.Usage(token.Name)
+	if err != nil {
+		return false, err
+	}
+	return used >= token.Quota, nil
+}
+
+// All returns all records, by hash.
+func (s *Store) All() (map[string]PinRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.ds.Query(query.Query{})
+	if err != nil {
+		return nil, fmt.Errorf("listing metadata: %w", err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, fmt.Errorf("listing metadata: %w", err)
+	}
+	all := map[string]PinRecord{}
+	for _, e := range entries {
+		var rec PinRecord
+		if err := json.Unmarshal(e.Value, &rec); err != nil {
+			return nil, fmt.Errorf("decoding metadata %s: %w", e.Key, err)
+		}
+		all[rec.Hash] = rec
+	}
+	return all, nil
+}
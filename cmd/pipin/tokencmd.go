@@ -0,0 +1,91 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+const tokenUsage = `USAGE:
+  pipin token add [-tokens FILE] [-scopes LIST] [-quota SIZE] NAME
+  pipin token rm [-tokens FILE] NAME
+  pipin token ls [-tokens FILE]
+
+Manages HTTP auth tokens of PiPin. Changes take effect immediately, also in
+an already running server.
+`
+
+// tokenCommand runs the "pipin token" subcommand with the args.
+func tokenCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, tokenUsage)
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("pipin token "+args[0], flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, tokenUsage, "\nFLAGS:\n")
+		fs.PrintDefaults()
+	}
+	var (
+		tokensPath = fs.String("tokens", "./tokens.json", "Path of file with HTTP auth tokens")
+		scopes     = fs.String("scopes", ScopeList, "Comma-separated scopes of a new token: "+strings.Join(allScopes, ", "))
+		quota      = fs.String("quota", "", "Maximum size of content pinned with a new token, e.g. 10GB; unlimited if empty")
+	)
+	fs.Parse(args[1:])
+
+	tokens, err := LoadTokens(*tokensPath)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	switch {
+	case args[0] == "add" && fs.NArg() == 1:
+		var limit uint64
+		if *quota != "" {
+			limit, err = humanize.ParseBytes(*quota)
+			if err != nil {
+				log.Fatalf("Invalid -quota: %v", err)
+			}
+		}
+		secret, err := tokens.Mint(fs.Arg(0), strings.Split(*scopes, ","), int64(limit))
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		fmt.Println(secret)
+	case args[0] == "rm" && fs.NArg() == 1:
+		if err := tokens.Revoke(fs.Arg(0)); err != nil {
+			log.Fatal(err.Error())
+		}
+	case args[0] == "ls" && fs.NArg() == 0:
+		for _, t := range tokens.List() {
+			quota := "unlimited"
+			if t.Quota > 0 {
+				quota = humanize.Bytes(uint64(t.Quota))
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\n", t.Name, strings.Join(t.Scopes, ","), quota, t.Created.Format("2006-01-02"))
+		}
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,303 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Scopes which can be granted to a token.
+const (
+	ScopeList  = "list"  // list pins and check their status
+	ScopePin   = "pin"   // pin new content
+	ScopeUnpin = "unpin" // unpin content owned by the token
+	ScopeAdmin = "admin" // everything, including unpinning content of others
+)
+
+var allScopes = []string{ScopeList, ScopePin, ScopeUnpin, ScopeAdmin}
+
+// adminTokenName is the name of the static token given with the -token flag.
+// It is reserved, so that no token from the file shares its ownership of
+// content, even if minted while the server is not running.
+const adminTokenName = "admin"
+
+// Token is a named API access token. Only a hash of its secret is kept, so
+// that the tokens file doesn't need to be guarded as carefully.
+type Token struct {
+	Name    string
+	Hash    string // hex-encoded SHA-256 of the secret
+	Scopes  []string
+	Quota   int64 `json:",omitempty"` // in bytes of pinned content; 0 means unlimited
+	Created time.Time
+}
+
+// Can reports whether the token was granted the scope.
+func (t *Token) Can(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Admin reports whether the token can manage content of all other tokens.
+func (t *Token) Admin() bool {
+	return t.Can(ScopeAdmin)
+}
+
+// Tokens is a list of tokens stored in a JSON file. The file is reloaded
+// when it changes, so that tokens minted or revoked with the "token"
+// subcommand take effect without restarting the server.
+type Tokens struct {
+	path string
+	// static tokens are provided on command line, and never saved
+	static []Token
+
+	mu      sync.Mutex
+	modTime time.Time
+	tokens  []Token
+}
+
+// LoadTokens reads tokens from the file at path. A missing file is treated
+// as empty.
+func LoadTokens(path string) (*Tokens, error) {
+	ts := &Tokens{path: path}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if err := ts.reload(); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// reload reads the file again if it was modified since last read. It must be
+// called with ts.mu locked.
+func (ts *Tokens) reload() error {
+	fi, err := os.Stat(ts.path)
+	if os.IsNotExist(err) {
+		ts.tokens, ts.modTime = nil, time.Time{}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading tokens: %w", err)
+	}
+	if fi.ModTime().Equal(ts.modTime) {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(ts.path)
+	if err != nil {
+		return fmt.Errorf("reading tokens: %w", err)
+	}
+	var file struct{ Tokens []Token }
+	if err := json.Unmarshal(buf, &file); err != nil {
+		return fmt.Errorf("parsing %s: %w", ts.path, err)
+	}
+	ts.tokens = nil
+	for _, t := range file.Tokens {
+		if ts.isStatic(t.Name) {
+			// It would own content of the static token
+			log.Printf("Ignoring token %q from %s, the name is reserved", t.Name, ts.path)
+			continue
+		}
+		ts.tokens = append(ts.tokens, t)
+	}
+	ts.modTime = fi.ModTime()
+	return nil
+}
+
+// isStatic reports whether the name is of a static token, or reserved for
+// one.
+func (ts *Tokens) isStatic(name string) bool {
+	if name == adminTokenName {
+		return true
+	}
+	for _, t := range ts.static {
+		if t.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// save writes the tokens to the file. It must be called with ts.mu locked.
+func (ts *Tokens) save() error {
+	buf, err := json.MarshalIndent(struct{ Tokens []Token }{ts.tokens}, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so that a running server never sees
+	// a partially written file.
+	tmp, err := ioutil.TempFile(filepath.Dir(ts.path), ".tokens-")
+	if err != nil {
+		return fmt.Errorf("saving tokens: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(buf, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("saving tokens: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("saving tokens: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), ts.path); err != nil {
+		return fmt.Errorf("saving tokens: %w", err)
+	}
+	return nil
+}
+
+// AddStatic adds a token which is accepted, but not saved to the file. Its
+// name must be unique among all tokens.
+func (ts *Tokens) AddStatic(name, secret string, scopes ...string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for _, list := range [][]Token{ts.static, ts.tokens} {
+		for _, t := range list {
+			if t.Name == name {
+				return fmt.Errorf("token %q already exists", name)
+			}
+		}
+	}
+	ts.static = append(ts.static, Token{
+		Name:   name,
+		Hash:   hashSecret(secret),
+		Scopes: scopes,
+	})
+	return nil
+}
+
+// Len returns the number of accepted tokens.
+func (ts *Tokens) Len() int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return len(ts.static) + len(ts.tokens)
+}
+
+// List returns all tokens stored in the file.
+func (ts *Tokens) List() []Token {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return append([]Token(nil), ts.tokens...)
+}
+
+// Authenticate returns the token with the secret, if there is one.
+func (ts *Tokens) Authenticate(secret string) (*Token, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if err := ts.reload(); err != nil {
+		// keep using the tokens we already know
+		log.Printf("error: %v", err)
+	}
+
+	// Compare hashes in constant time, and don't stop at the first match,
+	// so that timing doesn't tell anything about the tokens.
+	hash := []byte(hashSecret(secret))
+	var found *Token
+	for _, list := range [][]Token{ts.static, ts.tokens} {
+		for i := range list {
+			if subtle.ConstantTimeCompare(hash, []byte(list[i].Hash)) == 1 {
+				t := list[i]
+				found = &t
+			}
+		}
+	}
+	return found, found != nil
+}
+
+// Mint creates a new token and saves it to the file, returning its secret.
+// The secret is not stored anywhere, so it can't be shown again later.
+func (ts *Tokens) Mint(name string, scopes []string, quota int64) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("token name must not be empty")
+	}
+	for _, s := range scopes {
+		if !validScope(s) {
+			return "", fmt.Errorf("invalid scope %q, must be one of %v", s, allScopes)
+		}
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if err := ts.reload(); err != nil {
+		return "", err
+	}
+	if ts.isStatic(name) {
+		return "", fmt.Errorf("token name %q is reserved", name)
+	}
+	for _, t := range ts.tokens {
+		if t.Name == name {
+			return "", fmt.Errorf("token %q already exists", name)
+		}
+	}
+
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(buf)
+	ts.tokens = append(ts.tokens, Token{
+		Name:    name,
+		Hash:    hashSecret(secret),
+		Scopes:  scopes,
+		Quota:   quota,
+		Created: time.Now().UTC(),
+	})
+	if err := ts.save(); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// Revoke deletes the named token from the file.
+func (ts *Tokens) Revoke(name string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if err := ts.reload(); err != nil {
+		return err
+	}
+	for i, t := range ts.tokens {
+		if t.Name == name {
+			ts.tokens = append(ts.tokens[:i], ts.tokens[i+1:]...)
+			return ts.save()
+		}
+	}
+	return fmt.Errorf("no token named %q", name)
+}
+
+func validScope(scope string) bool {
+	for _, s := range allScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,144 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	ts, err := LoadTokens(path)
+	if err != nil {
+		t.Fatalf("LoadTokens of missing file: %v", err)
+	}
+	secret, err := ts.Mint("alice", []string{ScopeList, ScopePin}, 1000)
+	if err != nil {
+		t.Fatalf("Mint: %v", err)
+	}
+
+	// Only a hash of the secret is saved
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(buf), secret) || !strings.Contains(string(buf), hashSecret(secret)) {
+		t.Errorf("tokens file doesn't contain just the hash of the secret:\n%s", buf)
+	}
+
+	// A running server picks up tokens minted by another process
+	server, err := LoadTokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.AddStatic(adminTokenName, "root-secret", ScopeAdmin); err != nil {
+		t.Fatalf("AddStatic: %v", err)
+	}
+	token, ok := server.Authenticate(secret)
+	if !ok || token.Name != "alice" || token.Quota != 1000 || !token.Can(ScopePin) || token.Can(ScopeUnpin) {
+		t.Errorf("Authenticate = %+v, %v; want alice with list and pin scopes", token, ok)
+	}
+	if token, ok := server.Authenticate("root-secret"); !ok || !token.Admin() {
+		t.Errorf("Authenticate(static) = %+v, %v; want admin", token, ok)
+	}
+	if _, ok := server.Authenticate("wrong"); ok {
+		t.Error("Authenticate accepted a wrong secret")
+	}
+
+	bobSecret, err := ts.Mint("bob", []string{ScopeList}, 0)
+	if err != nil {
+		t.Fatalf("Mint: %v", err)
+	}
+	if err := ts.Revoke("alice"); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	// Make sure the modification time differs on coarse filesystems
+	later := time.Now().Add(time.Second)
+	os.Chtimes(path, later, later)
+	if _, ok := server.Authenticate(secret); ok {
+		t.Error("revoked token is still accepted")
+	}
+	if _, ok := server.Authenticate(bobSecret); !ok {
+		t.Error("new token is not accepted")
+	}
+	if err := ts.Revoke("alice"); err == nil {
+		t.Error("second Revoke succeeded")
+	}
+}
+
+func TestTokenNames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	ts, err := LoadTokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.Mint("alice", []string{ScopeList}, 0); err != nil {
+		t.Fatalf("Mint: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		scopes []string
+	}{
+		{"", []string{ScopeList}},
+		{"alice", []string{ScopeList}},
+		{"carol", []string{"root"}},
+		// Reserved for the -token flag, even if it isn't given
+		{adminTokenName, []string{ScopeList}},
+	}
+	for _, tt := range tests {
+		if _, err := ts.Mint(tt.name, tt.scopes, 0); err == nil {
+			t.Errorf("Mint(%q, %v) succeeded, want error", tt.name, tt.scopes)
+		}
+	}
+
+	if err := ts.AddStatic("alice", "secret", ScopeAdmin); err == nil {
+		t.Error("AddStatic with name of a token from the file succeeded")
+	}
+	if err := ts.AddStatic("ci", "secret", ScopeList); err != nil {
+		t.Fatalf("AddStatic: %v", err)
+	}
+	if err := ts.AddStatic("ci", "other", ScopeList); err == nil {
+		t.Error("AddStatic with a duplicate name succeeded")
+	}
+	if _, err := ts.Mint("ci", []string{ScopeList}, 0); err == nil {
+		t.Error("Mint with name of a static token succeeded")
+	}
+
+	// A token named like the static admin, e.g. written by hand, is ignored
+	err = ioutil.WriteFile(path, []byte(`{"Tokens": [
+		{"Name": "admin", "Hash": "`+hashSecret("impostor")+`", "Scopes": ["list"]},
+		{"Name": "dave", "Hash": "`+hashSecret("dave")+`", "Scopes": ["list"]}
+	]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err = LoadTokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ts.Authenticate("impostor"); ok {
+		t.Error("token with a reserved name was accepted")
+	}
+	if token, ok := ts.Authenticate("dave"); !ok || token.Name != "dave" {
+		t.Errorf("Authenticate(dave) = %+v, %v", token, ok)
+	}
+}
@@ -19,17 +19,28 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
 
 	"github.com/ipfs/go-datastore"
-	"github.com/ipfs/go-datastore/sync"
+	dsync "github.com/ipfs/go-datastore/sync"
+	fslock "github.com/ipfs/go-fs-lock"
 	config "github.com/ipfs/go-ipfs-config"
 	files "github.com/ipfs/go-ipfs-files"
 	"github.com/ipfs/go-ipfs/core"
 	"github.com/ipfs/go-ipfs/core/bootstrap"
 	"github.com/ipfs/go-ipfs/core/coreapi"
+	"github.com/ipfs/go-ipfs/plugin/loader"
 	"github.com/ipfs/go-ipfs/repo"
+	"github.com/ipfs/go-ipfs/repo/fsrepo"
 	coreiface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
 	ipfspath "github.com/ipfs/interface-go-ipfs-core/path"
 	p2pcrypto "github.com/libp2p/go-libp2p-core/crypto"
 	peer "github.com/libp2p/go-libp2p-core/peer"
@@ -40,38 +51,161 @@ type Node struct {
 	API  coreiface.CoreAPI
 }
 
-func Start() (*Node, error) {
-	// We have to create a repo explicitly to be able to tweak config options
-	repo, err := defaultRepo(sync.MutexWrap(datastore.NewMapDatastore()))
-	if err != nil {
-		return nil, fmt.Errorf("starting ipfs: repo initialization: %w", err)
+// Options configure the node started by Start.
+type Options struct {
+	// RepoPath is the directory of the node's repository, created if it
+	// doesn't exist. If empty, DefaultRepoPath is used.
+	RepoPath string
+	// InMemory makes the node keep its blocks in memory only, with a new
+	// identity on each start.
+	InMemory bool
+}
+
+// DefaultRepoPath returns the directory of the repository shared by all
+// Catation apps of the current user.
+func DefaultRepoPath() (string, error) {
+	dir := os.Getenv("XDG_DATA_HOME")
+	if dir == "" && runtime.GOOS != "windows" && runtime.GOOS != "darwin" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".local", "share")
+	}
+	if dir == "" {
+		var err error
+		dir, err = os.UserConfigDir()
+		if err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(dir, "catation", "ipfs"), nil
+}
+
+// Start starts an IPFS node. Unless opts.InMemory is set, its blocks and
+// identity are kept in a repository on disk, so that they are reused by the
+// next start. If the repository is in use by another app, the node falls
+// back to keeping everything in memory.
+func Start(opts Options) (*Node, error) {
+	var r repo.Repo
+	if !opts.InMemory {
+		var err error
+		r, err = openRepo(opts.RepoPath)
+		if err != nil {
+			return nil, fmt.Errorf("starting ipfs: %w", err)
+		}
+	}
+	if r == nil {
+		// We have to create a repo explicitly to be able to tweak config options
+		mock, err := defaultRepo(dsync.MutexWrap(datastore.NewMapDatastore()))
+		if err != nil {
+			return nil, fmt.Errorf("starting ipfs: repo initialization: %w", err)
+		}
+		tweakConfig(&mock.C)
+		r = mock
 	}
-	// Source: https://github.com/ipfs/go-ipfs/blob/master/docs/experimental-features.md#autorelay
-	// via: https://discuss.ipfs.io/t/how-to-connect-to-a-node-behind-nat/5270
-	repo.C.Swarm.EnableRelayHop = false
-	repo.C.Swarm.EnableAutoRelay = true
 
 	node, err := core.NewNode(context.TODO(), &core.BuildCfg{
-		Repo:   repo,
+		Repo:   r,
 		Online: true,
 	})
 	if err != nil {
+		r.Close()
 		return nil, fmt.Errorf("starting ipfs: creating node: %w", err)
 	}
 
+	// Closing the node closes the repo too
 	err = node.Bootstrap(bootstrap.DefaultBootstrapConfig)
 	if err != nil {
+		node.Close()
 		return nil, fmt.Errorf("starting ipfs: bootstrapping: %w", err)
 	}
 
 	api, err := coreapi.NewCoreAPI(node)
 	if err != nil {
+		node.Close()
 		return nil, fmt.Errorf("starting ipfs: accessing API: %w", err)
 	}
 
 	return &Node{node: node, API: api}, nil
 }
 
+// openRepo opens the repository at path, initializing it first if needed.
+// It returns a nil Repo if the repository is locked by another process.
+func openRepo(path string) (repo.Repo, error) {
+	if path == "" {
+		var err error
+		path, err = DefaultRepoPath()
+		if err != nil {
+			return nil, fmt.Errorf("finding repo directory: %w", err)
+		}
+	}
+	if err := loadPlugins(path); err != nil {
+		return nil, err
+	}
+
+	if !fsrepo.IsInitialized(path) {
+		if err := os.MkdirAll(path, 0700); err != nil {
+			return nil, fmt.Errorf("creating repo: %w", err)
+		}
+		identity, err := config.CreateIdentity(ioutil.Discard, []options.KeyGenerateOption{options.Key.Type(options.Ed25519Key)})
+		if err != nil {
+			return nil, fmt.Errorf("creating repo: %w", err)
+		}
+		cfg, err := config.InitWithIdentity(identity)
+		if err != nil {
+			return nil, fmt.Errorf("creating repo: %w", err)
+		}
+		tweakConfig(cfg)
+		if err := fsrepo.Init(path, cfg); err != nil {
+			return nil, fmt.Errorf("creating repo: %w", err)
+		}
+		log.Printf("Created IPFS repository at %s, peer identity: %s", path, identity.PeerID)
+	}
+
+	// Checking the lock before opening would race with other apps
+	r, err := fsrepo.Open(path)
+	if errors.As(err, new(fslock.LockedError)) {
+		log.Printf("IPFS repository at %s is used by another app, keeping data in memory", path)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening repo: %w", err)
+	}
+	return r, nil
+}
+
+var (
+	pluginsOnce sync.Once
+	pluginsErr  error
+)
+
+// loadPlugins loads the datastore plugins needed by fsrepo, and any others
+// configured in the repo at path. This can be done only once per process.
+func loadPlugins(path string) error {
+	pluginsOnce.Do(func() {
+		plugins, err := loader.NewPluginLoader(path)
+		if err == nil {
+			err = plugins.Initialize()
+		}
+		if err == nil {
+			err = plugins.Inject()
+		}
+		if err != nil {
+			pluginsErr = fmt.Errorf("loading ipfs plugins: %w", err)
+		}
+	})
+	return pluginsErr
+}
+
+// tweakConfig adjusts the node's config for running behind NAT.
+func tweakConfig(cfg *config.Config) {
+	// Source: https://github.com/ipfs/go-ipfs/blob/master/docs/experimental-features.md#autorelay
+	// via: https://discuss.ipfs.io/t/how-to-connect-to-a-node-behind-nat/5270
+	cfg.Swarm.EnableRelayHop = false
+	cfg.Swarm.EnableAutoRelay = true
+}
+
 // FIXME: copied from: https://github.com/ipfs/go-ipfs/blob/5b28704e505eb9a65c1ef8d2336da95af8e828c8/core/node/builder.go#L125-L151
 func defaultRepo(dstore repo.Datastore) (*repo.Mock, error) {
 	c := config.Config{}
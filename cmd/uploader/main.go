@@ -16,9 +16,11 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 
+	"github.com/wpengine/hackathon-catation/cmd/uploader/ipfs"
 	"github.com/wpengine/hackathon-catation/cmd/uploader/pinata"
 	"github.com/wpengine/hackathon-catation/internal"
 )
@@ -28,10 +30,25 @@ func main() {
 
 	// TODO: check if this can help cleanup something: https://github.com/ipfs/go-ipfs/blob/master/docs/examples/go-ipfs-as-a-library/README.md
 
-	if len(os.Args) <= 1 || os.Args[1] == "--help" {
-		fmt.Printf("Usage: %s IMAGE_PATH...\n", os.Args[0])
+	var opts ipfs.Options
+	name := flag.String("name", "Images", "name of the album, shown as its title")
+	direct := flag.Bool("direct", false, "upload files straight to Pinata, without a local IPFS node")
+	flag.StringVar(&opts.RepoPath, "repo", "", "path of the IPFS repository (default: per-user data directory)")
+	flag.BoolVar(&opts.InMemory, "in-memory", false, "keep IPFS data in memory only")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] IMAGE_PATH...\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
 		os.Exit(2)
 	}
 
-	pinata.Upload(os.Args[1:])
+	if *direct {
+		pinata.UploadDirect(*name, flag.Args())
+		return
+	}
+	pinata.UploadWith(*name, flag.Args(), opts)
 }
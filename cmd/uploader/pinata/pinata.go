@@ -20,35 +20,34 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	files "github.com/ipfs/go-ipfs-files"
 	ipfspath "github.com/ipfs/interface-go-ipfs-core/path"
 	"github.com/wpengine/hackathon-catation/cmd/builder/build"
-	"github.com/wpengine/hackathon-catation/cmd/pinner/pinata"
 	"github.com/wpengine/hackathon-catation/cmd/shortener/bitly"
 	"github.com/wpengine/hackathon-catation/cmd/uploader/ipfs"
+	"github.com/wpengine/hackathon-catation/pup"
+	"github.com/wpengine/hackathon-catation/pup/pinata"
 )
 
-func Upload(images []string) string {
-	// Verify that required API keys are configured
-	pinner := pinata.API{
-		Key:    os.Getenv("PINATA_API_KEY"),
-		Secret: os.Getenv("PINATA_SECRET_API_KEY"),
-	}
-	if pinner.Key == "" || pinner.Secret == "" {
-		die("please set pinata API key env variables PINATA_API_KEY and PINATA_SECRET_API_KEY to proper values (see http://pinata.cloud)")
-	}
-	shortener := bitly.API{
-		Key: os.Getenv("BITLY_API_KEY"),
-	}
-	if shortener.Key == "" {
-		die("please set bitly API key env variable BITLY_API_KEY to proper value (see http://bitly.com)")
-	}
+// Upload adds the images and index.html of an album with the name to a
+// local IPFS node with default options, pins them in Pinata, and returns a
+// short link to the album.
+func Upload(name string, images []string) string {
+	return UploadWith(name, images, ipfs.Options{})
+}
+
+// UploadWith works like Upload, starting the local IPFS node with opts.
+func UploadWith(name string, images []string, opts ipfs.Options) string {
+	pinner := newPinata()
+	shortener := newShortener()
 
 	// Initialize IPFS
-	node, err := ipfs.Start()
+	node, err := ipfs.Start(opts)
 	if err != nil {
 		panic(err)
 	}
@@ -79,7 +78,7 @@ func Upload(images []string) string {
 			hashes[i] = ipfsPath.Root().String()
 			wgAdd.Done()
 
-			err = Pin(context.TODO(), node, &pinner, ipfsPath)
+			err = Pin(context.TODO(), node, pinner, ipfsPath)
 			if err != nil {
 				die(err)
 			}
@@ -92,7 +91,7 @@ func Upload(images []string) string {
 
 	wgAdd.Wait()
 
-	indexHTML, err := build.IndexHTML(hashes...)
+	indexHTML, err := build.IndexHTML(name, hashes...)
 	if err != nil {
 		die(err)
 	}
@@ -103,7 +102,7 @@ func Upload(images []string) string {
 	log.Println("index.html -->", pathIndex)
 
 	log.Printf("Pinning %s containing %q", pathIndex, "index.html")
-	err = Pin(context.TODO(), node, &pinner, pathIndex)
+	err = Pin(context.TODO(), node, pinner, pathIndex)
 	if err != nil {
 		die(err)
 	}
@@ -129,6 +128,109 @@ func Upload(images []string) string {
 	return link
 }
 
+// UploadDirect works like Upload, but sends the images and index.html
+// straight to Pinata, without starting a local IPFS node. This works also
+// when the computer isn't reachable from the internet.
+func UploadDirect(name string, images []string) string {
+	var uploader pup.Uploader = newPinata()
+	shortener := newShortener()
+
+	var (
+		hashes   = make([]string, len(images))
+		wg       sync.WaitGroup
+		progress int32
+	)
+	for i, fn := range images {
+		wg.Add(1)
+		go func(i int, fn string) {
+			defer wg.Done()
+			hash, err := UploadFile(context.TODO(), uploader, fn)
+			if err != nil {
+				die(err)
+			}
+			hashes[i] = hash
+			log.Printf("uploaded %d/%d: %s",
+				atomic.AddInt32(&progress, 1), len(images), fn)
+		}(i, fn)
+	}
+	wg.Wait()
+
+	indexHTML, err := build.IndexHTML(name, hashes...)
+	if err != nil {
+		die(err)
+	}
+	hash, err := uploader.Add(context.TODO(), "catation", files.NewMapDirectory(map[string]files.Node{
+		"index.html": files.NewBytesFile(indexHTML),
+	}))
+	if err != nil {
+		die(fmt.Errorf("uploading index.html (%d B): %w", len(indexHTML), err))
+	}
+	log.Printf("UPLOAD SUCCESSFUL! ---> /ipfs/%s", hash)
+
+	link, err := shortener.Shorten("http://ipfs.io/ipfs/" + hash)
+	if err != nil {
+		die(err)
+	}
+
+	fmt.Printf(`
+
+>>>>>
+>>>>>     %s
+>>>>>
+`, link)
+
+	return link
+}
+
+// UploadFile uploads a single file with the uploader, naming it after the
+// file's base name.
+func UploadFile(ctx context.Context, uploader pup.Uploader, fn string) (pup.Hash, error) {
+	fh, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+	stat, err := fh.Stat()
+	if err != nil {
+		return "", fmt.Errorf("uploading file %q: %w", fn, err)
+	}
+	hash, err := uploader.Add(ctx, filepath.Base(fn), files.NewReaderStatFile(fh, stat))
+	if err != nil {
+		return "", fmt.Errorf("uploading file %q: %w", fn, err)
+	}
+	return hash, nil
+}
+
+// newPinata returns a client of Pinata configured with API keys from
+// environment variables, after verifying that Pinata accepts them.
+func newPinata() *pinata.API {
+	key, secret := os.Getenv("PINATA_API_KEY"), os.Getenv("PINATA_SECRET_API_KEY")
+	if key == "" || secret == "" {
+		die("please set pinata API key env variables PINATA_API_KEY and PINATA_SECRET_API_KEY to proper values (see http://pinata.cloud)")
+	}
+	api := pinata.New(key, secret)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err := api.TestAuthentication(ctx)
+	if hint := pup.Hint(err); hint != "" {
+		die(err, "\nHINT: ", hint)
+	}
+	if err != nil {
+		die(err)
+	}
+	return api
+}
+
+func newShortener() bitly.API {
+	shortener := bitly.API{
+		Key: os.Getenv("BITLY_API_KEY"),
+	}
+	if shortener.Key == "" {
+		die("please set bitly API key env variable BITLY_API_KEY to proper value (see http://bitly.com)")
+	}
+	return shortener
+}
+
 func die(msg ...interface{}) {
 	fmt.Fprintln(os.Stderr, "error:", fmt.Sprint(msg...))
 	os.Exit(1)
@@ -158,9 +260,12 @@ func AddIndexHTML(ctx context.Context, node *ipfs.Node, contents []byte) (ipfspa
 	return path, nil
 }
 
+// Pin pins the path in the pup, providing it from the node until the pup
+// reports it as pinned. Pups which can't report pinning progress are
+// assumed to be done when Pin returns.
+//
 // TODO: use interface instead of concrete *ipfs.Node
-// TODO: use interface instead of concrete *pinata.API
-func Pin(ctx context.Context, node *ipfs.Node, pinner *pinata.API, path ipfspath.Resolved) error {
+func Pin(ctx context.Context, node *ipfs.Node, pinner pup.Pup, path ipfspath.Resolved) error {
 	subctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
@@ -183,28 +288,21 @@ func Pin(ctx context.Context, node *ipfs.Node, pinner *pinata.API, path ipfspath
 		}
 	}()
 
-	hash := path.Root() // FIXME: is this correct?
-
-	_, err := pinner.Pin(hash.String())
+	hash := path.Root().String()
+	err := pinner.Pin(ctx, hash)
 	if err != nil {
 		return fmt.Errorf("pinning %q: %w", path, err)
 	}
 
-	for {
-		// context timeout?
-		select {
-		case <-ctx.Done():
-			return fmt.Errorf("pinning %q: %w", path, ctx.Err())
-		default:
-		}
-		// keep checking if the file got successfully pinned
-		pinned, err := pinner.IsPinned(hash.String())
-		if err != nil {
-			// FIXME: sometimes getting weird timeouts from pinata - rate limiting kicking in? so can't just return the error
-			log.Printf("(retrying after error: %s)", err)
-		}
-		if pinned {
-			return nil
-		}
+	sc, ok := pinner.(pup.StatusChecker)
+	if !ok {
+		return nil
+	}
+	// keep checking if the file got successfully pinned; WaitPinned backs
+	// off, so that we don't hit rate limits
+	_, err = pup.WaitPinned(ctx, sc, hash, nil)
+	if err != nil {
+		return fmt.Errorf("pinning %q: %w", path, err)
 	}
+	return nil
 }
@@ -5,16 +5,26 @@ go 1.14
 require (
 	gioui.org v0.0.0-20200726090339-83673ecb203f
 	github.com/davidlazar/go-crypto v0.0.0-20190912175916-7055855a373f // indirect
+	github.com/dustin/go-humanize v1.0.0
 	github.com/gorilla/mux v1.8.0
 	github.com/icza/gowut v1.4.0
+	github.com/ipfs/go-block-format v0.0.2
+	github.com/ipfs/go-cid v0.0.7
 	github.com/ipfs/go-datastore v0.4.5
+	github.com/ipfs/go-fs-lock v0.0.6
 	github.com/ipfs/go-ipfs v0.7.0
 	github.com/ipfs/go-ipfs-config v0.9.0
 	github.com/ipfs/go-ipfs-files v0.0.8
+	github.com/ipfs/go-ipld-cbor v0.0.4
+	github.com/ipfs/go-ipld-format v0.2.0
+	github.com/ipfs/go-merkledag v0.3.2
 	github.com/ipfs/interface-go-ipfs-core v0.4.0
 	github.com/libp2p/go-libp2p-core v0.6.1
 	github.com/libp2p/go-sockaddr v0.1.0 // indirect
+	github.com/multiformats/go-multiaddr v0.3.1
+	github.com/multiformats/go-varint v0.0.6
 	github.com/peterbourgon/ff/v3 v3.0.0
+	github.com/prometheus/client_golang v1.7.1
 	golang.org/x/image v0.0.0-20200618115811-c13761719519
 	golang.org/x/sys v0.0.0-20200728102440-3e129f6d46b1 // indirect
 )
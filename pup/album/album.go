@@ -0,0 +1,220 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package album describes photo albums uploaded by Catation. An album is a
+// root directory containing an index.html, which shows images pinned
+// separately under their own hashes.
+package album
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"time"
+
+	files "github.com/ipfs/go-ipfs-files"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	icorepath "github.com/ipfs/interface-go-ipfs-core/path"
+
+	"github.com/wpengine/hackathon-catation/pup"
+)
+
+// ErrNotAlbum is returned when resolving a hash which is not an album.
+var ErrNotAlbum = errors.New("not an album")
+
+type Album struct {
+	Root    pup.Hash
+	Title   string
+	Members []pup.Hash // hashes of images, in order of appearance
+	Created time.Time  // zero if unknown, e.g. in albums from older Catation versions
+}
+
+// Hashes returns hashes of the album's members followed by its root.
+func (a *Album) Hashes() []pup.Hash {
+	return append(append([]pup.Hash(nil), a.Members...), a.Root)
+}
+
+// Has reports whether hash is the album's root or one of its members.
+func (a *Album) Has(hash pup.Hash) bool {
+	for _, h := range a.Hashes() {
+		if h == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// metadata is attached to pins of album's hashes in services which support
+// it, so that albums can be found without resolving them via IPFS.
+func (a *Album) metadata(name string) pup.Metadata {
+	md := pup.Metadata{
+		Name:      name,
+		KeyValues: map[string]string{"album": a.Root},
+	}
+	if !a.Created.IsZero() {
+		md.KeyValues["created"] = a.Created.UTC().Format(time.RFC3339)
+	}
+	return md
+}
+
+const indexTemplate = `
+<html>
+    <head>
+        <meta name="generator" content="Catation" />
+        {{if not .Created.IsZero}}<meta name="created" content="{{.Created.UTC.Format "2006-01-02T15:04:05Z07:00"}}" />{{end}}
+        <title>{{.Title}}</title>
+    </head>
+    <body>
+        <h1>{{.Title}}</h1>
+        {{range .Members}}<img src="/ipfs/{{.}}" style="max-width:100%; max-height:100vh; margin:auto" />
+        {{end}}
+    </body>
+</html>
+`
+
+// IndexHTML renders the index.html of an album.
+func IndexHTML(title string, created time.Time, members ...pup.Hash) ([]byte, error) {
+	t, err := template.New("index.html").Parse(indexTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("internal error: cannot parse default index.html template: %w", err)
+	}
+
+	var buf bytes.Buffer
+	err = t.Execute(&buf, Album{Title: title, Members: members, Created: created})
+	if err != nil {
+		return nil, fmt.Errorf("building index.html: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+var (
+	titleRe   = regexp.MustCompile(`<title>([^<]*)</title>`)
+	createdRe = regexp.MustCompile(`<meta name="created" content="([^"]*)"`)
+	memberRe  = regexp.MustCompile(`<img src="/ipfs/([^"/]+)"`)
+)
+
+// Parse extracts an album with the root hash from its index.html, as
+// rendered by IndexHTML or older versions of Catation. Images shown more
+// than once are listed as members once.
+func Parse(root pup.Hash, indexHTML []byte) (*Album, error) {
+	a := &Album{Root: root}
+	seen := map[pup.Hash]bool{}
+	for _, m := range memberRe.FindAllSubmatch(indexHTML, -1) {
+		h := string(m[1])
+		if !seen[h] {
+			seen[h] = true
+			a.Members = append(a.Members, h)
+		}
+	}
+	if len(a.Members) == 0 && !bytes.Contains(indexHTML, []byte(`<meta name="generator" content="Catation"`)) {
+		return nil, fmt.Errorf("album: parsing %s: %w", root, ErrNotAlbum)
+	}
+	if m := titleRe.FindSubmatch(indexHTML); m != nil {
+		a.Title = html.UnescapeString(string(m[1]))
+	}
+	if m := createdRe.FindSubmatch(indexHTML); m != nil {
+		created, err := time.Parse(time.RFC3339, string(m[1]))
+		if err != nil {
+			return nil, fmt.Errorf("album: parsing %s: bad creation date: %w", root, err)
+		}
+		a.Created = created
+	}
+	return a, nil
+}
+
+// maxIndexSize limits how much of index.html is read when resolving an
+// album, in case a huge file happens to be named like that.
+const maxIndexSize = 1 << 20
+
+// Resolve fetches index.html of the root directory via IPFS and parses it.
+// If root is not a directory with an index.html, ErrNotAlbum is returned.
+func Resolve(ctx context.Context, api iface.CoreAPI, root pup.Hash) (*Album, error) {
+	nd, err := api.Unixfs().Get(ctx, icorepath.New(root))
+	if err != nil {
+		return nil, fmt.Errorf("album: resolving %s: %w", root, err)
+	}
+	defer nd.Close()
+	dir, ok := nd.(files.Directory)
+	if !ok {
+		return nil, fmt.Errorf("album: resolving %s: %w", root, ErrNotAlbum)
+	}
+
+	entries := dir.Entries()
+	for entries.Next() {
+		if entries.Name() != "index.html" {
+			continue
+		}
+		f, ok := entries.Node().(files.File)
+		if !ok {
+			break
+		}
+		buf, err := ioutil.ReadAll(io.LimitReader(f, maxIndexSize))
+		if err != nil {
+			return nil, fmt.Errorf("album: resolving %s: reading index.html: %w", root, err)
+		}
+		return Parse(root, buf)
+	}
+	if err := entries.Err(); err != nil {
+		return nil, fmt.Errorf("album: resolving %s: %w", root, err)
+	}
+	return nil, fmt.Errorf("album: resolving %s: %w", root, ErrNotAlbum)
+}
+
+// Pin pins all members of the album and then its root in the pup. Pups
+// which support metadata get the album's title as the root's name, and the
+// root hash and creation date as key-values of all the pins.
+func Pin(ctx context.Context, p pup.Pup, a *Album) error {
+	op, named := p.(pup.OptionsPinner)
+	for _, h := range a.Hashes() {
+		var err error
+		if named {
+			name := ""
+			if h == a.Root {
+				name = a.Title
+			}
+			err = op.PinWithOptions(ctx, h, pup.PinOptions{Metadata: a.metadata(name)})
+		} else {
+			err = p.Pin(ctx, h)
+		}
+		if err != nil {
+			return fmt.Errorf("album: pinning %q: %w", a.Title, err)
+		}
+	}
+	return nil
+}
+
+// Unpin unpins the album's root and then its members from the pup, except
+// for hashes in keep, e.g. images shared with other albums. Hashes which
+// are already not pinned are skipped.
+func Unpin(ctx context.Context, p pup.Pup, a *Album, keep map[pup.Hash]bool) error {
+	hashes := a.Hashes()
+	for i := len(hashes) - 1; i >= 0; i-- {
+		h := hashes[i]
+		if keep[h] {
+			continue
+		}
+		err := p.Unpin(ctx, h)
+		if err != nil && !errors.Is(err, pup.ErrNotFound) {
+			return fmt.Errorf("album: unpinning %q: %w", a.Title, err)
+		}
+	}
+	return nil
+}
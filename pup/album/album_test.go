@@ -0,0 +1,147 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package album
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wpengine/hackathon-catation/pup"
+)
+
+func TestIndexHTML(t *testing.T) {
+	created := time.Date(2020, 10, 5, 12, 30, 0, 0, time.FixedZone("CEST", 2*60*60))
+	tests := []struct {
+		title   string
+		created time.Time
+		members []pup.Hash
+	}{
+		{"Holidays", created, []pup.Hash{"QmA", "QmB", "QmC"}},
+		{"", time.Time{}, nil},
+		{`Cats & "dogs" <script>alert('x')</script>`, created, []pup.Hash{"QmA"}},
+		{"Żółć 🐈", time.Time{}, []pup.Hash{"QmA", "QmB"}},
+	}
+	for _, tt := range tests {
+		buf, err := IndexHTML(tt.title, tt.created, tt.members...)
+		if err != nil {
+			t.Fatalf("IndexHTML(%q): %v", tt.title, err)
+		}
+		if bytes.Contains(buf, []byte("<script>")) {
+			t.Errorf("IndexHTML(%q) doesn't escape the title:\n%s", tt.title, buf)
+		}
+		got, err := Parse("QmRoot", buf)
+		if err != nil {
+			t.Fatalf("Parse of IndexHTML(%q): %v", tt.title, err)
+		}
+		want := &Album{Root: "QmRoot", Title: tt.title, Members: tt.members, Created: tt.created}
+		if !got.Created.Equal(want.Created) {
+			t.Errorf("Parse of IndexHTML(%q) has Created %v, want %v", tt.title, got.Created, want.Created)
+		}
+		got.Created = want.Created
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Parse of IndexHTML(%q) = %+v, want %+v", tt.title, got, want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		html    string
+		want    *Album
+		wantErr error // nil if any error is expected with want == nil
+	}{
+		{
+			name: "older version",
+			html: `<html><head><title>Images</title></head><body>
+				<img src="/ipfs/QmA" style="max-width:100%"/>
+				<img src="/ipfs/QmB" style="max-width:100%"/>
+				</body></html>`,
+			want: &Album{Title: "Images", Members: []pup.Hash{"QmA", "QmB"}},
+		},
+		{
+			name: "duplicate images",
+			html: `<meta name="generator" content="Catation" />
+				<img src="/ipfs/QmA" /><img src="/ipfs/QmB" /><img src="/ipfs/QmA" />`,
+			want: &Album{Members: []pup.Hash{"QmA", "QmB"}},
+		},
+		{
+			name: "empty album",
+			html: `<meta name="generator" content="Catation" /><title>Nothing &amp; more</title>`,
+			want: &Album{Title: "Nothing & more"},
+		},
+		{
+			name:    "images outside IPFS",
+			html:    `<img src="https://example.com/cat.jpg" /><img src="/ipfs/QmA/cat.jpg" />`,
+			wantErr: ErrNotAlbum,
+		},
+		{
+			name:    "empty file",
+			html:    "",
+			wantErr: ErrNotAlbum,
+		},
+		{
+			name:    "plain text",
+			html:    "not html <title>at all",
+			wantErr: ErrNotAlbum,
+		},
+		{
+			name: "bad creation date",
+			html: `<meta name="generator" content="Catation" />
+				<meta name="created" content="yesterday" />`,
+		},
+		{
+			name: "unterminated tags",
+			html: `<meta name="generator" content="Catation" /><title>Cats<img src="/ipfs/QmA`,
+			want: &Album{},
+		},
+	}
+	for _, tt := range tests {
+		got, err := Parse("QmRoot", []byte(tt.html))
+		if tt.want == nil {
+			if err == nil || (tt.wantErr != nil && !errors.Is(err, tt.wantErr)) {
+				t.Errorf("%s: Parse = %+v, %v; want error %v", tt.name, got, err, tt.wantErr)
+			}
+			continue
+		}
+		tt.want.Root = "QmRoot"
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Parse = %+v, %v; want %+v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestIndexHTMLDuplicates(t *testing.T) {
+	buf, err := IndexHTML("Twice", time.Time{}, "QmA", "QmA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both are shown, but pinned once
+	if n := strings.Count(string(buf), `src="/ipfs/QmA"`); n != 2 {
+		t.Errorf("IndexHTML shows QmA %d times, want 2:\n%s", n, buf)
+	}
+	a, err := Parse("QmRoot", buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []pup.Hash{"QmA", "QmRoot"}; !reflect.DeepEqual(a.Hashes(), want) {
+		t.Errorf("Hashes = %v, want %v", a.Hashes(), want)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package car
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	icorepath "github.com/ipfs/interface-go-ipfs-core/path"
+
+	"github.com/wpengine/hackathon-catation/pup"
+)
+
+// exportTimeout limits how long an Archive may spend retrieving and storing
+// a DAG.
+const exportTimeout = 24 * time.Hour
+
+// Store keeps CAR files of archived DAGs, e.g. in a bucket or a directory.
+// Methods must return errors matching pup.ErrNotFound for unknown hashes.
+type Store interface {
+	// List returns hashes of all stored DAGs, with sizes of their CAR
+	// files.
+	List(ctx context.Context) ([]pup.NamedHash, error)
+	// Has reports whether the DAG of hash is stored.
+	Has(ctx context.Context, hash pup.Hash) (bool, error)
+	// Put stores a CAR file with the DAG of hash, read from r, which has
+	// size bytes. The name is optional.
+	Put(ctx context.Context, hash pup.Hash, name string, r io.Reader, size int64) error
+	// Open returns the stored CAR file with the DAG of hash.
+	Open(ctx context.Context, hash pup.Hash) (io.ReadCloser, error)
+	Delete(ctx context.Context, hash pup.Hash) error
+}
+
+// Archive is a pup.Pup which, instead of pinning hashes, exports their DAGs
+// from an IPFS node into CAR files kept in a Store. The DAGs can be later
+// restored into the node, from which they can be pinned elsewhere.
+type Archive struct {
+	api   iface.CoreAPI
+	store Store
+	jobs  pup.Jobs
+}
+
+// NewArchive returns an Archive exporting DAGs from the node behind api,
+// usually one embedded in the app, into store.
+func NewArchive(api iface.CoreAPI, store Store) *Archive {
+	return &Archive{api: api, store: store}
+}
+
+func (a *Archive) Fetch(ctx context.Context, filter []pup.Hash) ([]pup.NamedHash, error) {
+	m := map[string]bool{}
+	for _, h := range filter {
+		m[h] = true
+	}
+	stored, err := a.store.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("car: fetching: %w", err)
+	}
+	list := []pup.NamedHash{}
+	for _, h := range stored {
+		if len(m) == 0 || m[h.Hash] {
+			list = append(list, h)
+		}
+	}
+	return list, nil
+}
+
+func (a *Archive) Pin(ctx context.Context, hash pup.Hash) error {
+	return a.PinWithOptions(ctx, hash, pup.PinOptions{})
+}
+
+// PinWithOptions starts exporting the DAG of hash in background, as the
+// node may first have to retrieve it. The name is kept with the CAR file, if
+// the Store supports it; other options are ignored. Use Status to check
+// when it's done.
+func (a *Archive) PinWithOptions(ctx context.Context, hash pup.Hash, opts pup.PinOptions) error {
+	root, err := cid.Decode(hash)
+	if err != nil {
+		return fmt.Errorf("car: archiving %q: %w", hash, err)
+	}
+
+	a.jobs.Start(hash, exportTimeout, func(ctx context.Context) error {
+		err := a.archive(ctx, root, opts.Name)
+		if err != nil && ctx.Err() != context.Canceled {
+			log.Printf("car: archiving %s failed: %v", hash, err)
+		}
+		return err
+	})
+	return nil
+}
+
+// archive exports the DAG into a temporary file, so that its size is known
+// before storing it.
+func (a *Archive) archive(ctx context.Context, root cid.Cid, name string) error {
+	f, err := ioutil.TempFile("", "catation-*.car")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := Export(ctx, a.api.Dag(), root, f); err != nil {
+		return err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return a.store.Put(ctx, root.String(), name, f, size)
+}
+
+func (a *Archive) Unpin(ctx context.Context, hash pup.Hash) error {
+	pending := a.jobs.Cancel(hash)
+	err := a.store.Delete(ctx, hash)
+	if errors.Is(err, pup.ErrNotFound) && pending {
+		// Cancelled before it got stored
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("car: removing %q: %w", hash, err)
+	}
+	return nil
+}
+
+// Status reports DAGs started by Pin as in progress until they are stored,
+// and failed exports as described in pup.Jobs.
+func (a *Archive) Status(ctx context.Context, hash pup.Hash) (pup.PinStatus, error) {
+	pinning, failed := a.jobs.Check(hash)
+	if pinning {
+		return pup.StatusPinning, nil
+	}
+	if failed {
+		return pup.StatusFailed, nil
+	}
+
+	ok, err := a.store.Has(ctx, hash)
+	if err != nil {
+		return "", fmt.Errorf("car: checking status of %q: %w", hash, err)
+	}
+	if ok {
+		return pup.StatusPinned, nil
+	}
+	return pup.StatusUnpinned, nil
+}
+
+// Restore imports the archived DAG of hash back into the node and pins it
+// there, so that it can be retrieved from the node, e.g. when pinning it in
+// another service.
+func (a *Archive) Restore(ctx context.Context, hash pup.Hash) error {
+	r, err := a.store.Open(ctx, hash)
+	if err != nil {
+		return fmt.Errorf("car: restoring %q: %w", hash, err)
+	}
+	defer r.Close()
+	roots, err := Import(ctx, r, a.api.Dag())
+	if err != nil {
+		return fmt.Errorf("car: restoring %q: %w", hash, err)
+	}
+	for _, root := range roots {
+		if err := a.api.Pin().Add(ctx, icorepath.IpfsPath(root)); err != nil {
+			return fmt.Errorf("car: restoring %q: pinning %s: %w", hash, root, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package car
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	dstest "github.com/ipfs/go-merkledag/test"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+
+	"github.com/wpengine/hackathon-catation/pup"
+)
+
+// fakeAPI implements the parts of the CoreAPI used by Archive to export
+// DAGs.
+type fakeAPI struct {
+	iface.CoreAPI
+	dag ipld.DAGService
+}
+
+func (f fakeAPI) Dag() iface.APIDagService { return fakeDag{f.dag} }
+
+type fakeDag struct {
+	ipld.DAGService
+}
+
+func (d fakeDag) Pinning() ipld.NodeAdder { return d.DAGService }
+
+// waitStatus waits until the hash is no longer reported as pinning, and
+// returns its status.
+func waitStatus(t *testing.T, a *Archive, hash pup.Hash) pup.PinStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		status, err := a.Status(context.Background(), hash)
+		if err != nil {
+			t.Fatalf("Status(%s): %v", hash, err)
+		}
+		if status != pup.StatusPinning {
+			return status
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("%s still pinning", hash)
+	return ""
+}
+
+func TestArchiveJobs(t *testing.T) {
+	ctx := context.Background()
+	dag := dstest.Mock()
+	root, _ := testDAG(t, dag)
+	a := NewArchive(fakeAPI{dag: dag}, &Dir{Path: t.TempDir()})
+
+	if err := a.Pin(ctx, root.String()); err != nil {
+		t.Fatalf("Pin: %v", err)
+	}
+	if status := waitStatus(t, a, root.String()); status != pup.StatusPinned {
+		t.Errorf("Status after archiving = %q, want %q", status, pup.StatusPinned)
+	}
+
+	// Failures are reported once; afterwards the store tells
+	missing := merkledag.NewRawNode([]byte("missing")).Cid().String()
+	if err := a.Pin(ctx, missing); err != nil {
+		t.Fatalf("Pin: %v", err)
+	}
+	if status := waitStatus(t, a, missing); status != pup.StatusFailed {
+		t.Errorf("Status after failure = %q, want %q", status, pup.StatusFailed)
+	}
+	if status, err := a.Status(ctx, missing); err != nil || status != pup.StatusUnpinned {
+		t.Errorf("Status after reported failure = %q, %v; want %q", status, err, pup.StatusUnpinned)
+	}
+
+	if err := a.Unpin(ctx, root.String()); err != nil {
+		t.Errorf("Unpin: %v", err)
+	}
+	if status, err := a.Status(ctx, root.String()); err != nil || status != pup.StatusUnpinned {
+		t.Errorf("Status after Unpin = %q, %v; want %q", status, err, pup.StatusUnpinned)
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package car exports DAGs from an IPFS node into CAR (Content
+// Addressable aRchive) files and imports them back, and implements pups
+// archiving DAGs as CAR files in a Store, such as a local directory,
+// independently of any pinning service.
+//
+// Files are written in the CARv1 format, as used by `ipfs dag export`.
+//
+// See: https://ipld.io/specs/transport/car/carv1/
+package car
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	ipld "github.com/ipfs/go-ipld-format"
+	_ "github.com/ipfs/go-merkledag" // registers decoders of dag-pb, raw and dag-cbor blocks
+	"github.com/multiformats/go-varint"
+)
+
+// header is the first section of a CAR file.
+type header struct {
+	Roots   []cid.Cid `refmt:"roots"`
+	Version uint64    `refmt:"version"`
+}
+
+func init() {
+	cbor.RegisterCborType(header{})
+}
+
+// maxSection limits the size of a section read from a CAR file. Blocks are
+// at most a few megabytes, so anything larger is a corrupted file.
+const maxSection = 8 << 20
+
+// importBatch is how many blocks are added to the node at once.
+const importBatch = 64
+
+// Export writes the DAG rooted at root to w as a CAR file, retrieving its
+// blocks via ng. Blocks shared by several parents are written only once.
+func Export(ctx context.Context, ng ipld.NodeGetter, root cid.Cid, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	hdr, err := cbor.DumpObject(&header{Roots: []cid.Cid{root}, Version: 1})
+	if err != nil {
+		return fmt.Errorf("car: encoding header: %w", err)
+	}
+	if err := writeSection(bw, hdr); err != nil {
+		return fmt.Errorf("car: writing header: %w", err)
+	}
+
+	seen := cid.NewSet()
+	stack := []cid.Cid{root}
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if !seen.Visit(c) {
+			continue
+		}
+		nd, err := ng.Get(ctx, c)
+		if err != nil {
+			return fmt.Errorf("car: exporting %s: %w", c, err)
+		}
+		if err := writeSection(bw, c.Bytes(), nd.RawData()); err != nil {
+			return fmt.Errorf("car: writing %s: %w", c, err)
+		}
+		// Push links in reverse, so that they are written in order
+		links := nd.Links()
+		for i := len(links) - 1; i >= 0; i-- {
+			stack = append(stack, links[i].Cid)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("car: writing: %w", err)
+	}
+	return nil
+}
+
+// writeSection writes a section made of parts, prefixed with its length.
+func writeSection(w io.Writer, parts ...[]byte) error {
+	n := 0
+	for _, p := range parts {
+		n += len(p)
+	}
+	if _, err := w.Write(varint.ToUvarint(uint64(n))); err != nil {
+		return err
+	}
+	for _, p := range parts {
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Import reads a CAR file from r and adds all its blocks via na, verifying
+// that their contents match their CIDs. It returns roots listed in the
+// file's header.
+func Import(ctx context.Context, r io.Reader, na ipld.NodeAdder) ([]cid.Cid, error) {
+	br := bufio.NewReader(r)
+	buf, err := readSection(br)
+	if err == io.EOF {
+		return nil, errors.New("car: empty file")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("car: reading header: %w", err)
+	}
+	var hdr header
+	if err := cbor.DecodeInto(buf, &hdr); err != nil {
+		return nil, fmt.Errorf("car: decoding header: %w", err)
+	}
+	if hdr.Version != 1 {
+		return nil, fmt.Errorf("car: unsupported version %d", hdr.Version)
+	}
+
+	var batch []ipld.Node
+	for {
+		buf, err := readSection(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("car: reading block: %w", err)
+		}
+		nd, err := decodeBlock(buf)
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, nd)
+		if len(batch) >= importBatch {
+			if err := na.AddMany(ctx, batch); err != nil {
+				return nil, fmt.Errorf("car: adding blocks: %w", err)
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := na.AddMany(ctx, batch); err != nil {
+		return nil, fmt.Errorf("car: adding blocks: %w", err)
+	}
+	return hdr.Roots, nil
+}
+
+// readSection reads a length-prefixed section. It returns io.EOF only if
+// there are no more sections.
+func readSection(br *bufio.Reader) ([]byte, error) {
+	n, err := varint.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 || n > maxSection {
+		return nil, fmt.Errorf("bad section length %d", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+// decodeBlock decodes a section consisting of a CID and block data.
+func decodeBlock(section []byte) (ipld.Node, error) {
+	n, c, err := cid.CidFromBytes(section)
+	if err != nil {
+		return nil, fmt.Errorf("car: decoding CID: %w", err)
+	}
+	data := section[n:]
+	sum, err := c.Prefix().Sum(data)
+	if err != nil {
+		return nil, fmt.Errorf("car: verifying %s: %w", c, err)
+	}
+	if !sum.Equals(c) {
+		return nil, fmt.Errorf("car: block %s doesn't match its contents", c)
+	}
+	blk, err := blocks.NewBlockWithCid(data, c)
+	if err != nil {
+		return nil, fmt.Errorf("car: decoding %s: %w", c, err)
+	}
+	nd, err := ipld.Decode(blk)
+	if err != nil {
+		return nil, fmt.Errorf("car: decoding %s: %w", c, err)
+	}
+	return nd, nil
+}
@@ -0,0 +1,159 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package car
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	dstest "github.com/ipfs/go-merkledag/test"
+	"github.com/multiformats/go-varint"
+)
+
+// testDAG adds a DAG whose root links to two nodes sharing a raw leaf, and
+// returns the root and all nodes.
+func testDAG(t *testing.T, dag ipld.DAGService) (cid.Cid, []ipld.Node) {
+	leaf := merkledag.NewRawNode([]byte("shared leaf data"))
+	a := merkledag.NodeWithData([]byte("a"))
+	b := merkledag.NodeWithData([]byte("b"))
+	root := merkledag.NodeWithData([]byte("root"))
+	for _, l := range []struct{ from, to ipld.Node }{{a, leaf}, {b, leaf}, {root, a}, {root, b}} {
+		if err := l.from.(*merkledag.ProtoNode).AddNodeLink("link", l.to); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nodes := []ipld.Node{root, a, b, leaf}
+	if err := dag.AddMany(context.Background(), nodes); err != nil {
+		t.Fatal(err)
+	}
+	return root.Cid(), nodes
+}
+
+// sections returns the sections of a CAR file.
+func sections(t *testing.T, buf []byte) [][]byte {
+	var list [][]byte
+	br := bufio.NewReader(bytes.NewReader(buf))
+	for {
+		s, err := readSection(br)
+		if err == io.EOF {
+			return list
+		}
+		if err != nil {
+			t.Fatalf("reading section %d: %v", len(list), err)
+		}
+		list = append(list, s)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	src := dstest.Mock()
+	root, nodes := testDAG(t, src)
+
+	var buf bytes.Buffer
+	if err := Export(ctx, src, root, &buf); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	// The header and each block once, in depth-first order
+	s := sections(t, buf.Bytes())
+	if len(s) != 1+len(nodes) {
+		t.Fatalf("exported %d sections, want %d", len(s), 1+len(nodes))
+	}
+	for i, c := range []cid.Cid{root, nodes[1].Cid(), nodes[3].Cid(), nodes[2].Cid()} {
+		if !bytes.HasPrefix(s[i+1], c.Bytes()) {
+			t.Errorf("section %d isn't %s", i+1, c)
+		}
+	}
+
+	dst := dstest.Mock()
+	roots, err := Import(ctx, bytes.NewReader(buf.Bytes()), dst)
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	if len(roots) != 1 || !roots[0].Equals(root) {
+		t.Errorf("Import = %v, want [%s]", roots, root)
+	}
+	for _, nd := range nodes {
+		got, err := dst.Get(ctx, nd.Cid())
+		if err != nil {
+			t.Errorf("imported DAG lacks %s: %v", nd.Cid(), err)
+			continue
+		}
+		if !bytes.Equal(got.RawData(), nd.RawData()) {
+			t.Errorf("imported %s differs", nd.Cid())
+		}
+	}
+}
+
+func TestExportMissingBlock(t *testing.T) {
+	ctx := context.Background()
+	dag := dstest.Mock()
+	root, nodes := testDAG(t, dag)
+	if err := dag.Remove(ctx, nodes[3].Cid()); err != nil {
+		t.Fatal(err)
+	}
+	err := Export(ctx, dag, root, ioutil.Discard)
+	if !errors.Is(err, ipld.ErrNotFound) {
+		t.Errorf("Export with missing block = %v, want ErrNotFound", err)
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	ctx := context.Background()
+	src := dstest.Mock()
+	root, _ := testDAG(t, src)
+	var buf bytes.Buffer
+	if err := Export(ctx, src, root, &buf); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	car := buf.Bytes()
+
+	corrupted := bytes.Replace(car, []byte("shared leaf data"), []byte("shared leaf DATA"), 1)
+	oversize := append(append([]byte(nil), car...), varint.ToUvarint(maxSection+1)...)
+	hdr := sections(t, car)[0]
+	headerLen := len(varint.ToUvarint(uint64(len(hdr)))) + len(hdr)
+	badCID := append(append([]byte(nil), car[:headerLen]...), 3, 0xff, 0xff, 0xff)
+
+	tests := []struct {
+		name string
+		car  []byte
+		want string
+	}{
+		{"empty", nil, "empty file"},
+		{"corrupted block", corrupted, "doesn't match its contents"},
+		{"oversize section", oversize, "bad section length"},
+		{"empty section", append(append([]byte(nil), car...), 0), "bad section length"},
+		{"truncated", car[:len(car)-5], "unexpected EOF"},
+		{"bad CID", badCID, "decoding CID"},
+		{"bad header", []byte{3, 1, 2, 3}, "decoding header"},
+	}
+	for _, tt := range tests {
+		dst := dstest.Mock()
+		_, err := Import(ctx, bytes.NewReader(tt.car), dst)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Import of %s file = %v, want error with %q", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package car
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/wpengine/hackathon-catation/pup"
+)
+
+// Dir is a Store keeping CAR files in a local directory, e.g. on an external
+// drive, as <hash>.car files, each with a <hash>.json sidecar describing it.
+// The directory must exist; it is not created, so that nothing gets written
+// in place of an unmounted drive.
+type Dir struct {
+	// Name of the directory, shown in Herder.
+	Name string `json:",omitempty"`
+	Path string
+}
+
+// sidecar describes a CAR file in a Dir.
+type sidecar struct {
+	Hash     string    `json:"hash"`
+	Name     string    `json:"name,omitempty"`
+	Size     int64     `json:"size"`
+	PinnedAt time.Time `json:"pinned_at"`
+}
+
+// file returns the path of the hash's file with the extension, or an error
+// if the hash can't be a file name.
+func (d *Dir) file(hash pup.Hash, ext string) (string, error) {
+	if hash == "" || strings.ContainsAny(hash, `/\`) || strings.HasPrefix(hash, ".") {
+		return "", fmt.Errorf("car: bad hash %q: %w", hash, pup.ErrNotFound)
+	}
+	return filepath.Join(d.Path, hash+ext), nil
+}
+
+// List scans the directory for CAR files. Names and sizes are read from
+// their sidecars, if present.
+func (d *Dir) List(ctx context.Context) ([]pup.NamedHash, error) {
+	infos, err := ioutil.ReadDir(d.Path)
+	if err != nil {
+		return nil, fmt.Errorf("car: listing %s: %w", d.Path, err)
+	}
+	list := []pup.NamedHash{}
+	for _, fi := range infos {
+		name := fi.Name()
+		if !fi.Mode().IsRegular() || !strings.HasSuffix(name, ".car") || strings.HasPrefix(name, ".") {
+			continue
+		}
+		h := pup.NamedHash{Hash: strings.TrimSuffix(name, ".car"), Size: fi.Size()}
+		if sc, err := d.readSidecar(h.Hash); err == nil {
+			h.Name = sc.Name
+		}
+		list = append(list, h)
+	}
+	return list, nil
+}
+
+func (d *Dir) readSidecar(hash pup.Hash) (*sidecar, error) {
+	path, err := d.file(hash, ".json")
+	if err != nil {
+		return nil, err
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sc sidecar
+	if err := json.Unmarshal(buf, &sc); err != nil {
+		return nil, fmt.Errorf("car: decoding %s: %w", path, err)
+	}
+	return &sc, nil
+}
+
+func (d *Dir) Has(ctx context.Context, hash pup.Hash) (bool, error) {
+	path, err := d.file(hash, ".car")
+	if err != nil {
+		return false, nil
+	}
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("car: checking %s: %w", path, err)
+	}
+	// Like List, ignore anything but regular files
+	return fi.Mode().IsRegular(), nil
+}
+
+// Put writes the CAR file and its sidecar. Both are first written under
+// temporary names, so that an interrupted Put doesn't leave a truncated
+// file looking like a complete one.
+func (d *Dir) Put(ctx context.Context, hash pup.Hash, name string, r io.Reader, size int64) error {
+	path, err := d.file(hash, ".car")
+	if err != nil {
+		return err
+	}
+	n, err := writeFile(path, r)
+	if err != nil {
+		return fmt.Errorf("car: writing %s: %w", path, err)
+	}
+	if n != size {
+		os.Remove(path)
+		return fmt.Errorf("car: writing %s: got %d bytes, expected %d", path, n, size)
+	}
+
+	sc, err := json.MarshalIndent(sidecar{
+		Hash:     hash,
+		Name:     name,
+		Size:     size,
+		PinnedAt: time.Now().UTC(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	scPath, _ := d.file(hash, ".json")
+	if _, err := writeFile(scPath, strings.NewReader(string(sc)+"\n")); err != nil {
+		return fmt.Errorf("car: writing %s: %w", scPath, err)
+	}
+	return nil
+}
+
+// writeFile atomically replaces the file at path with contents of r, and
+// returns the number of bytes written.
+func writeFile(path string, r io.Reader) (int64, error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".catation-*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	n, err := io.Copy(f, r)
+	if err == nil {
+		// Make sure the data reaches the drive before it gets unplugged
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, os.Rename(f.Name(), path)
+}
+
+func (d *Dir) Open(ctx context.Context, hash pup.Hash) (io.ReadCloser, error) {
+	path, err := d.file(hash, ".car")
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("car: opening %s: %w", path, pup.ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("car: opening %s: %w", path, err)
+	}
+	return f, nil
+}
+
+// Delete removes the CAR file and its sidecar.
+func (d *Dir) Delete(ctx context.Context, hash pup.Hash) error {
+	path, err := d.file(hash, ".car")
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("car: removing %s: %w", path, pup.ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("car: removing %s: %w", path, err)
+	}
+	scPath, _ := d.file(hash, ".json")
+	if err := os.Remove(scPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("car: removing %s: %w", scPath, err)
+	}
+	return nil
+}
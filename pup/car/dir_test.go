@@ -0,0 +1,153 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package car
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wpengine/hackathon-catation/pup"
+)
+
+func TestDir(t *testing.T) {
+	ctx := context.Background()
+	d := &Dir{Path: t.TempDir()}
+
+	if err := d.Put(ctx, "QmA", "cat.jpg", strings.NewReader("car of A"), 8); err != nil {
+		t.Fatalf("Put(QmA): %v", err)
+	}
+	if err := d.Put(ctx, "QmB", "", strings.NewReader("car of B, longer"), 16); err != nil {
+		t.Fatalf("Put(QmB): %v", err)
+	}
+	// Leftovers of interrupted writes and unrelated files
+	for _, name := range []string{".catation-123.tmp", ".catation-456.car", "notes.txt", "QmC.car.tmp"} {
+		if err := ioutil.WriteFile(filepath.Join(d.Path, name), []byte("junk"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(d.Path, "QmD.car"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := d.List(ctx)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	want := []pup.NamedHash{{Hash: "QmA", Name: "cat.jpg", Size: 8}, {Hash: "QmB", Size: 16}}
+	if !reflect.DeepEqual(list, want) {
+		t.Errorf("List = %v, want %v", list, want)
+	}
+
+	// Sidecars describe the files
+	buf, err := ioutil.ReadFile(filepath.Join(d.Path, "QmA.json"))
+	if err != nil {
+		t.Fatalf("reading sidecar: %v", err)
+	}
+	var sc map[string]interface{}
+	if err := json.Unmarshal(buf, &sc); err != nil {
+		t.Fatalf("decoding sidecar: %v", err)
+	}
+	pinnedAt, _ := time.Parse(time.RFC3339, sc["pinned_at"].(string))
+	if sc["hash"] != "QmA" || sc["name"] != "cat.jpg" || sc["size"] != 8.0 || time.Since(pinnedAt) > time.Minute {
+		t.Errorf("sidecar of QmA = %s", buf)
+	}
+	buf, err = ioutil.ReadFile(filepath.Join(d.Path, "QmB.json"))
+	if err != nil {
+		t.Fatalf("reading sidecar: %v", err)
+	}
+	if strings.Contains(string(buf), `"name"`) {
+		t.Errorf("sidecar of QmB without a name = %s", buf)
+	}
+
+	for _, tt := range []struct {
+		hash pup.Hash
+		want bool
+	}{{"QmA", true}, {"QmC", false}, {"QmD", false}, {"", false}, {"../QmA", false}, {".catation-123", false}} {
+		if ok, err := d.Has(ctx, tt.hash); err != nil || ok != tt.want {
+			t.Errorf("Has(%q) = %v, %v; want %v", tt.hash, ok, err, tt.want)
+		}
+	}
+
+	r, err := d.Open(ctx, "QmB")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(data) != "car of B, longer" {
+		t.Errorf("Open(QmB) read %q, %v", data, err)
+	}
+	for _, h := range []pup.Hash{"QmC", "../QmA", ""} {
+		if _, err := d.Open(ctx, h); !errors.Is(err, pup.ErrNotFound) {
+			t.Errorf("Open(%q) = %v, want ErrNotFound", h, err)
+		}
+	}
+
+	if err := d.Delete(ctx, "QmA"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	for _, name := range []string{"QmA.car", "QmA.json"} {
+		if _, err := os.Stat(filepath.Join(d.Path, name)); !os.IsNotExist(err) {
+			t.Errorf("%s left after Delete: %v", name, err)
+		}
+	}
+	if err := d.Delete(ctx, "QmA"); !errors.Is(err, pup.ErrNotFound) {
+		t.Errorf("Delete of missing file = %v, want ErrNotFound", err)
+	}
+}
+
+func TestDirPutErrors(t *testing.T) {
+	ctx := context.Background()
+	d := &Dir{Path: t.TempDir()}
+
+	// Short files are not kept
+	if err := d.Put(ctx, "QmA", "", strings.NewReader("short"), 100); err == nil {
+		t.Error("Put of short file succeeded")
+	}
+	if ok, _ := d.Has(ctx, "QmA"); ok {
+		t.Error("short file kept")
+	}
+	if err := d.Put(ctx, "../QmA", "", strings.NewReader("car"), 3); err == nil {
+		t.Error("Put outside the directory succeeded")
+	}
+	infos, err := ioutil.ReadDir(d.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range infos {
+		t.Errorf("%s left after failed Puts", fi.Name())
+	}
+
+	// Missing directories, e.g. of unmounted drives, are not created
+	missing := &Dir{Path: filepath.Join(d.Path, "drive")}
+	if err := missing.Put(ctx, "QmA", "", strings.NewReader("car"), 3); err == nil {
+		t.Error("Put into missing directory succeeded")
+	}
+	if _, err := missing.List(ctx); err == nil {
+		t.Error("List of missing directory succeeded")
+	}
+	if _, err := os.Stat(missing.Path); !os.IsNotExist(err) {
+		t.Errorf("missing directory got created: %v", err)
+	}
+}
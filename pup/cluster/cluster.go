@@ -0,0 +1,366 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package cluster implements a pup.Pup keeping pins in an ipfs-cluster,
+// controlled via the REST API of one of its peers. The whole cluster is
+// treated as a single pinning service.
+//
+// See: https://cluster.ipfs.io/documentation/reference/api/
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/wpengine/hackathon-catation/pup"
+)
+
+type Client struct {
+	// Name of the cluster, shown in Herder.
+	Name string `json:",omitempty"`
+	// URL of the REST API of a cluster peer, e.g. http://127.0.0.1:9094.
+	URL string
+	// Username and Password are used for HTTP basic authentication, if the
+	// API is configured to require it.
+	Username string `json:",omitempty"`
+	Password string `json:",omitempty"`
+
+	// ReplicationMin and ReplicationMax are replication factors of new pins,
+	// i.e. how many peers should keep them; -1 means all peers, and 0 means
+	// the cluster's defaults.
+	ReplicationMin int `json:",omitempty"`
+	ReplicationMax int `json:",omitempty"`
+
+	// HTTPClient optionally overrides the client used for requests to the
+	// REST API.
+	HTTPClient *http.Client `json:"-"`
+}
+
+// defaultHTTPClient is shared by all Client values without an explicit
+// HTTPClient. For each status request, the peer queries all other peers of
+// the cluster, so at most 4 requests are sent at a time.
+var defaultHTTPClient = pup.NewHTTPClient(4)
+
+// New returns a client of the REST API at url.
+func New(url string) *Client {
+	return &Client{URL: url}
+}
+
+func (c *Client) endpoint(path string) string {
+	base := c.URL
+	if base == "" {
+		base = "http://127.0.0.1:9094"
+	}
+	return strings.TrimSuffix(base, "/") + path
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return defaultHTTPClient
+}
+
+// send sends a request to the REST API, and returns the response if
+// successful. The caller must close its body.
+func (c *Client) send(ctx context.Context, method, path string, query url.Values) (*http.Response, error) {
+	u := c.endpoint(path)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.Username != "" || c.Password != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// checkResponse maps an unsuccessful REST API response to pup errors. The
+// API reports errors as JSON with a code and a message.
+func checkResponse(resp *http.Response) error {
+	err := pup.CheckResponse(resp)
+	var httpErr *pup.HTTPError
+	if !errors.As(err, &httpErr) {
+		return err
+	}
+	var body struct {
+		Code    int
+		Message string
+	}
+	if json.Unmarshal([]byte(httpErr.Message), &body) == nil && body.Message != "" {
+		httpErr.Message = body.Message
+	}
+	if strings.Contains(httpErr.Message, "not found") ||
+		strings.Contains(httpErr.Message, "not part of the global state") {
+		httpErr.Err = pup.ErrNotFound
+	}
+	return err
+}
+
+// cid is a CID in REST API responses. Older cluster versions encode it as
+// {"/": "Qm..."}, newer ones as a plain string.
+type cid string
+
+func (c *cid) UnmarshalJSON(b []byte) error {
+	var s string
+	if json.Unmarshal(b, &s) == nil {
+		*c = cid(s)
+		return nil
+	}
+	var link struct {
+		Link string `json:"/"`
+	}
+	if err := json.Unmarshal(b, &link); err != nil {
+		return fmt.Errorf("decoding CID: %w", err)
+	}
+	*c = cid(link.Link)
+	return nil
+}
+
+// allocation is a pin in the shared state of the cluster.
+type allocation struct {
+	Cid  cid    `json:"cid"`
+	Name string `json:"name"`
+}
+
+// Fetch lists hashes pinned in the cluster's shared state, regardless of
+// whether the peers already retrieved them.
+func (c *Client) Fetch(ctx context.Context, filter []pup.Hash) ([]pup.NamedHash, error) {
+	m := map[string]bool{}
+	for _, h := range filter {
+		m[h] = true
+	}
+
+	resp, err := c.send(ctx, http.MethodGet, "/allocations", url.Values{"filter": {"pin"}})
+	if err != nil {
+		return nil, fmt.Errorf("cluster: fetching: %w", err)
+	}
+	defer resp.Body.Close()
+
+	list := []pup.NamedHash{}
+	err = decodeList(resp.Body, func(dec *json.Decoder) error {
+		var a allocation
+		if err := dec.Decode(&a); err != nil {
+			return err
+		}
+		if len(m) == 0 || m[string(a.Cid)] {
+			list = append(list, pup.NamedHash{Hash: string(a.Cid), Name: a.Name})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cluster: fetching: decoding response: %w", err)
+	}
+	return list, nil
+}
+
+// decodeList calls each to decode every item of a list in r. Older cluster
+// versions send lists as a JSON array, newer ones as a stream of JSON
+// objects.
+func decodeList(r io.Reader, each func(dec *json.Decoder) error) error {
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if tok != json.Delim('[') {
+		// A stream of objects; start over, with the consumed brace.
+		dec = json.NewDecoder(io.MultiReader(strings.NewReader("{"), dec.Buffered(), r))
+		if tok != json.Delim('{') {
+			return fmt.Errorf("unexpected %v", tok)
+		}
+	}
+	for dec.More() {
+		if err := each(dec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) Pin(ctx context.Context, hash pup.Hash) error {
+	return c.PinWithOptions(ctx, hash, pup.PinOptions{})
+}
+
+// PinWithOptions pins the hash in the cluster with the configured
+// replication factors. The name and key-values are stored as the pin's name
+// and metadata. Pinning an already pinned hash updates its options.
+func (c *Client) PinWithOptions(ctx context.Context, hash pup.Hash, opts pup.PinOptions) error {
+	query := url.Values{}
+	if opts.Name != "" {
+		query.Set("name", opts.Name)
+	}
+	for k, v := range opts.KeyValues {
+		query.Set("meta-"+k, v)
+	}
+	if len(opts.Origins) > 0 {
+		query.Set("origins", strings.Join(opts.Origins, ","))
+	}
+	if c.ReplicationMin != 0 {
+		query.Set("replication-min", strconv.Itoa(c.ReplicationMin))
+	}
+	if c.ReplicationMax != 0 {
+		query.Set("replication-max", strconv.Itoa(c.ReplicationMax))
+	}
+
+	resp, err := c.send(ctx, http.MethodPost, "/pins/"+url.PathEscape(hash), query)
+	if err != nil {
+		return fmt.Errorf("cluster: pinning %q: %w", hash, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Unpin removes the hash from the cluster's shared state, so that all peers
+// unpin it.
+func (c *Client) Unpin(ctx context.Context, hash pup.Hash) error {
+	resp, err := c.send(ctx, http.MethodDelete, "/pins/"+url.PathEscape(hash), nil)
+	if err != nil {
+		return fmt.Errorf("cluster: unpinning %q: %w", hash, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// PeerStatus describes progress of pinning a hash in one cluster peer.
+type PeerStatus struct {
+	Peer   string // peer ID
+	Name   string // peer name, if known
+	Status pup.PinStatus
+	// Allocated is false for peers which are not supposed to keep the hash,
+	// due to its replication factors.
+	Allocated bool
+	Error     string // reason of failure, if any
+}
+
+// globalPinInfo is the status of a hash in all cluster peers.
+type globalPinInfo struct {
+	Cid     cid `json:"cid"`
+	PeerMap map[string]struct {
+		PeerName string `json:"peername"`
+		Status   string `json:"status"`
+		Error    string `json:"error"`
+	} `json:"peer_map"`
+}
+
+// Peers reports the status of the hash in every cluster peer, sorted by
+// peer name.
+func (c *Client) Peers(ctx context.Context, hash pup.Hash) ([]PeerStatus, error) {
+	resp, err := c.send(ctx, http.MethodGet, "/pins/"+url.PathEscape(hash), nil)
+	if errors.Is(err, pup.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cluster: checking status of %q: %w", hash, err)
+	}
+	defer resp.Body.Close()
+
+	var info globalPinInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("cluster: checking status of %q: decoding response: %w", hash, err)
+	}
+	peers := []PeerStatus{}
+	for id, p := range info.PeerMap {
+		status, allocated := peerStatus(p.Status)
+		peers = append(peers, PeerStatus{
+			Peer:      id,
+			Name:      p.PeerName,
+			Status:    status,
+			Allocated: allocated,
+			Error:     p.Error,
+		})
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].Name != peers[j].Name {
+			return peers[i].Name < peers[j].Name
+		}
+		return peers[i].Peer < peers[j].Peer
+	})
+	return peers, nil
+}
+
+// peerStatus maps a tracker status of a cluster peer to pup.PinStatus, and
+// reports whether the hash is allocated to the peer.
+func peerStatus(s string) (pup.PinStatus, bool) {
+	switch s {
+	case "pinned":
+		return pup.StatusPinned, true
+	case "pinning":
+		return pup.StatusPinning, true
+	case "pin_queued":
+		return pup.StatusQueued, true
+	case "pin_error", "cluster_error":
+		return pup.StatusFailed, true
+	case "remote", "sharded":
+		// Kept by other peers
+		return pup.StatusUnpinned, false
+	default:
+		// unpinned, unpin_queued, unpinning, unpin_error, undefined, ...
+		return pup.StatusUnpinned, true
+	}
+}
+
+// Status summarizes the status of the hash in the cluster's peers. It is
+// in progress while any peer is still retrieving the hash, and pinned once
+// at least one peer has it, even if other peers failed; use Peers for
+// details.
+func (c *Client) Status(ctx context.Context, hash pup.Hash) (pup.PinStatus, error) {
+	peers, err := c.Peers(ctx, hash)
+	if err != nil {
+		return "", err
+	}
+	return summarize(peers), nil
+}
+
+func summarize(peers []PeerStatus) pup.PinStatus {
+	count := map[pup.PinStatus]int{}
+	for _, p := range peers {
+		if p.Allocated {
+			count[p.Status]++
+		}
+	}
+	switch {
+	case count[pup.StatusPinning] > 0:
+		return pup.StatusPinning
+	case count[pup.StatusQueued] > 0:
+		return pup.StatusQueued
+	case count[pup.StatusPinned] > 0:
+		return pup.StatusPinned
+	case count[pup.StatusFailed] > 0:
+		return pup.StatusFailed
+	}
+	return pup.StatusUnpinned
+}
@@ -0,0 +1,391 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/wpengine/hackathon-catation/pup"
+	"github.com/wpengine/hackathon-catation/pup/puptest"
+)
+
+// fakeCluster emulates the subset of ipfs-cluster REST API used by Client,
+// with three peers. New pins are allocated to the first ReplicationMax
+// peers (all if -1 or unset), and advance by one tracker status each time
+// their status is checked.
+type fakeCluster struct {
+	t *testing.T
+	// streaming selects the format of newer cluster versions: lists as
+	// streams of objects, and CIDs as plain strings.
+	streaming bool
+
+	mu    sync.Mutex
+	pins  []*fakePin // in order of pinning
+	fail  string     // peer which fails to pin, if any
+	peers []string
+}
+
+type fakePin struct {
+	Hash           string
+	Name           string
+	Metadata       map[string]string
+	Origins        string
+	ReplicationMin string
+	ReplicationMax string
+	allocations    []string
+	checks         int
+}
+
+func newFakeCluster(t *testing.T) (*fakeCluster, *Client) {
+	f := &fakeCluster{t: t, peers: []string{"peer-a", "peer-b", "peer-c"}}
+	c := New("")
+	c.URL, c.HTTPClient = puptest.Serve(t, f)
+	c.Username, c.Password = "user", "pass"
+	return f, c
+}
+
+func (f *fakeCluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"code":401,"message":"Unauthorized"}`)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/allocations" && r.Method == http.MethodGet:
+		f.allocations(w, r)
+	case strings.HasPrefix(r.URL.Path, "/pins/"):
+		hash := strings.TrimPrefix(r.URL.Path, "/pins/")
+		switch r.Method {
+		case http.MethodPost:
+			f.pin(w, r, hash)
+		case http.MethodDelete:
+			f.unpin(w, hash)
+		case http.MethodGet:
+			f.status(w, hash)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"code":404,"message":"Not Found"}`)
+	}
+}
+
+func (f *fakeCluster) cid(hash string) interface{} {
+	if f.streaming {
+		return hash
+	}
+	return map[string]string{"/": hash}
+}
+
+func (f *fakeCluster) allocations(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("filter") != "pin" {
+		f.t.Errorf("allocations: unexpected filter %q", r.URL.Query().Get("filter"))
+	}
+	var list []interface{}
+	for _, p := range f.pins {
+		list = append(list, map[string]interface{}{
+			"cid":                    f.cid(p.Hash),
+			"name":                   p.Name,
+			"allocations":            p.allocations,
+			"replication_factor_min": -1,
+			"replication_factor_max": -1,
+		})
+	}
+	enc := json.NewEncoder(w)
+	if !f.streaming {
+		if list == nil {
+			list = []interface{}{}
+		}
+		enc.Encode(list)
+		return
+	}
+	for _, item := range list {
+		enc.Encode(item)
+	}
+}
+
+func (f *fakeCluster) find(hash string) int {
+	for i, p := range f.pins {
+		if p.Hash == hash {
+			return i
+		}
+	}
+	return -1
+}
+
+func (f *fakeCluster) pin(w http.ResponseWriter, r *http.Request, hash string) {
+	q := r.URL.Query()
+	p := &fakePin{
+		Hash:           hash,
+		Name:           q.Get("name"),
+		Metadata:       map[string]string{},
+		Origins:        q.Get("origins"),
+		ReplicationMin: q.Get("replication-min"),
+		ReplicationMax: q.Get("replication-max"),
+	}
+	for k := range q {
+		if strings.HasPrefix(k, "meta-") {
+			p.Metadata[strings.TrimPrefix(k, "meta-")] = q.Get(k)
+		}
+	}
+	n := len(f.peers)
+	if p.ReplicationMax != "" && p.ReplicationMax != "-1" {
+		fmt.Sscan(p.ReplicationMax, &n)
+	}
+	p.allocations = f.peers[:n]
+
+	// Re-pinning updates the pin
+	if i := f.find(hash); i >= 0 {
+		f.pins[i] = p
+	} else {
+		f.pins = append(f.pins, p)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"cid": f.cid(hash), "name": p.Name})
+}
+
+func (f *fakeCluster) unpin(w http.ResponseWriter, hash string) {
+	i := f.find(hash)
+	if i < 0 {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"code":404,"message":"uncommitted to state: cid is not part of the global state"}`)
+		return
+	}
+	f.pins = append(f.pins[:i], f.pins[i+1:]...)
+	json.NewEncoder(w).Encode(map[string]interface{}{"cid": f.cid(hash)})
+}
+
+func (f *fakeCluster) status(w http.ResponseWriter, hash string) {
+	var p *fakePin
+	if i := f.find(hash); i >= 0 {
+		p = f.pins[i]
+	}
+	progress := []string{"pin_queued", "pinning", "pinned"}
+	peerMap := map[string]interface{}{}
+	for _, peer := range f.peers {
+		status, msg := "unpinned", ""
+		if p != nil {
+			status = "remote"
+			for _, a := range p.allocations {
+				if a != peer {
+					continue
+				}
+				status = progress[min(p.checks, len(progress)-1)]
+				if peer == f.fail && status == "pinned" {
+					status, msg = "pin_error", "context deadline exceeded"
+				}
+			}
+		}
+		peerMap["id-"+peer] = map[string]interface{}{
+			"cid":      f.cid(hash),
+			"peer":     "id-" + peer,
+			"peername": peer,
+			"status":   status,
+			"error":    msg,
+		}
+	}
+	if p != nil {
+		p.checks++
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"cid": f.cid(hash), "peer_map": peerMap})
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func TestPinFetchUnpin(t *testing.T) {
+	for _, streaming := range []bool{false, true} {
+		t.Run(fmt.Sprintf("streaming=%v", streaming), func(t *testing.T) {
+			f, c := newFakeCluster(t)
+			f.streaming = streaming
+			ctx := context.Background()
+
+			got, err := c.Fetch(ctx, nil)
+			if err != nil || len(got) != 0 {
+				t.Fatalf("Fetch of empty cluster = %v, %v; want empty list", got, err)
+			}
+
+			if err := c.Pin(ctx, "QmA"); err != nil {
+				t.Fatalf("Pin: %v", err)
+			}
+			err = c.PinWithOptions(ctx, "QmB", pup.PinOptions{Metadata: pup.Metadata{Name: "cat.jpg"}})
+			if err != nil {
+				t.Fatalf("PinWithOptions: %v", err)
+			}
+			if err := c.Pin(ctx, "QmC"); err != nil {
+				t.Fatalf("Pin: %v", err)
+			}
+
+			got, err = c.Fetch(ctx, nil)
+			if err != nil {
+				t.Fatalf("Fetch: %v", err)
+			}
+			want := []pup.NamedHash{{Hash: "QmA"}, {Hash: "QmB", Name: "cat.jpg"}, {Hash: "QmC"}}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Fetch = %v, want %v", got, want)
+			}
+
+			got, err = c.Fetch(ctx, []pup.Hash{"QmB", "QmX"})
+			if err != nil {
+				t.Fatalf("Fetch with filter: %v", err)
+			}
+			if !reflect.DeepEqual(got, want[1:2]) {
+				t.Errorf("Fetch with filter = %v, want %v", got, want[1:2])
+			}
+
+			if err := c.Unpin(ctx, "QmA"); err != nil {
+				t.Fatalf("Unpin: %v", err)
+			}
+			got, err = c.Fetch(ctx, nil)
+			if err != nil {
+				t.Fatalf("Fetch after Unpin: %v", err)
+			}
+			if !reflect.DeepEqual(got, want[1:]) {
+				t.Errorf("Fetch after Unpin = %v, want %v", got, want[1:])
+			}
+			if err := c.Unpin(ctx, "QmA"); !errors.Is(err, pup.ErrNotFound) {
+				t.Errorf("Unpin of missing pin = %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestPinOptions(t *testing.T) {
+	f, c := newFakeCluster(t)
+	ctx := context.Background()
+
+	c.ReplicationMin, c.ReplicationMax = 1, 2
+	err := c.PinWithOptions(ctx, "QmA", pup.PinOptions{
+		Metadata: pup.Metadata{Name: "album", KeyValues: map[string]string{"album": "QmA"}},
+		Origins:  []string{"/ip4/1.2.3.4/tcp/4001/p2p/QmPeer", "/ip4/5.6.7.8/tcp/4001/p2p/QmPeer"},
+	})
+	if err != nil {
+		t.Fatalf("PinWithOptions: %v", err)
+	}
+	want := fakePin{
+		Hash:           "QmA",
+		Name:           "album",
+		Metadata:       map[string]string{"album": "QmA"},
+		Origins:        "/ip4/1.2.3.4/tcp/4001/p2p/QmPeer,/ip4/5.6.7.8/tcp/4001/p2p/QmPeer",
+		ReplicationMin: "1",
+		ReplicationMax: "2",
+		allocations:    []string{"peer-a", "peer-b"},
+	}
+	if got := *f.pins[0]; !reflect.DeepEqual(got, want) {
+		t.Errorf("pin = %+v, want %+v", got, want)
+	}
+
+	// Re-pinning updates the name
+	err = c.PinWithOptions(ctx, "QmA", pup.PinOptions{Metadata: pup.Metadata{Name: "renamed"}})
+	if err != nil {
+		t.Fatalf("PinWithOptions again: %v", err)
+	}
+	if len(f.pins) != 1 || f.pins[0].Name != "renamed" {
+		t.Errorf("pins after re-pinning = %+v, want one named renamed", f.pins)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	for _, streaming := range []bool{false, true} {
+		t.Run(fmt.Sprintf("streaming=%v", streaming), func(t *testing.T) {
+			f, c := newFakeCluster(t)
+			f.streaming = streaming
+			ctx := context.Background()
+
+			c.ReplicationMax = 2
+			if err := c.Pin(ctx, "QmA"); err != nil {
+				t.Fatalf("Pin: %v", err)
+			}
+			for _, want := range []pup.PinStatus{pup.StatusQueued, pup.StatusPinning, pup.StatusPinned} {
+				got, err := c.Status(ctx, "QmA")
+				if err != nil {
+					t.Fatalf("Status: %v", err)
+				}
+				if got != want {
+					t.Errorf("Status = %q, want %q", got, want)
+				}
+			}
+
+			got, err := c.Status(ctx, "QmMissing")
+			if err != nil || got != pup.StatusUnpinned {
+				t.Errorf("Status of missing pin = %q, %v; want %q", got, err, pup.StatusUnpinned)
+			}
+		})
+	}
+}
+
+func TestPeers(t *testing.T) {
+	f, c := newFakeCluster(t)
+	ctx := context.Background()
+
+	f.fail = "peer-b"
+	c.ReplicationMax = 2
+	if err := c.Pin(ctx, "QmA"); err != nil {
+		t.Fatalf("Pin: %v", err)
+	}
+	f.pins[0].checks = 2
+
+	peers, err := c.Peers(ctx, "QmA")
+	if err != nil {
+		t.Fatalf("Peers: %v", err)
+	}
+	want := []PeerStatus{
+		{Peer: "id-peer-a", Name: "peer-a", Status: pup.StatusPinned, Allocated: true},
+		{Peer: "id-peer-b", Name: "peer-b", Status: pup.StatusFailed, Allocated: true, Error: "context deadline exceeded"},
+		{Peer: "id-peer-c", Name: "peer-c", Status: pup.StatusUnpinned, Allocated: false},
+	}
+	if !reflect.DeepEqual(peers, want) {
+		t.Errorf("Peers = %+v, want %+v", peers, want)
+	}
+	// One replica is enough to consider the hash pinned
+	if got := summarize(peers); got != pup.StatusPinned {
+		t.Errorf("summarize = %q, want %q", got, pup.StatusPinned)
+	}
+	if got := summarize(want[1:]); got != pup.StatusFailed {
+		t.Errorf("summarize without pinned peers = %q, want %q", got, pup.StatusFailed)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	_, c := newFakeCluster(t)
+	ctx := context.Background()
+
+	c.Password = "wrong"
+	_, err := c.Fetch(ctx, nil)
+	if !errors.Is(err, pup.ErrUnauthorized) {
+		t.Errorf("Fetch with bad password = %v, want ErrUnauthorized", err)
+	}
+	var httpErr *pup.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.Message != "Unauthorized" {
+		t.Errorf("Fetch with bad password = %v, want message Unauthorized", err)
+	}
+}
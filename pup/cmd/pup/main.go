@@ -28,9 +28,11 @@ import (
 
 	"github.com/wpengine/hackathon-catation/internal"
 	"github.com/wpengine/hackathon-catation/pup"
+	"github.com/wpengine/hackathon-catation/pup/cluster"
 	"github.com/wpengine/hackathon-catation/pup/eternum"
 	"github.com/wpengine/hackathon-catation/pup/pinata"
 	"github.com/wpengine/hackathon-catation/pup/pipin"
+	"github.com/wpengine/hackathon-catation/pup/psa"
 )
 
 /*
@@ -42,8 +44,9 @@ func main() {
 
 	var (
 		pipinFlags = flag.NewFlagSet("pup pipin", flag.ExitOnError)
-		pipinHost  = pipinFlags.String("host", "pipin.velvetcache.org", "PiPin hostname")
+		pipinURL   = pipinFlags.String("url", "https://pipin.velvetcache.org", "PiPin base URL (http, https or unix://)")
 		pipinToken = pipinFlags.String("token", "", "PiPin authentication token")
+		pipinFP    = pipinFlags.String("fingerprint", "", "SHA-256 fingerprint of PiPin's TLS certificate, for a self-signed one")
 
 		pinataFlags  = flag.NewFlagSet("pup pinata", flag.ExitOnError)
 		pinataKey    = pinataFlags.String("api-key", "", "Pinata service API key")
@@ -51,6 +54,15 @@ func main() {
 
 		eternumFlags = flag.NewFlagSet("pup eternum", flag.ExitOnError)
 		eternumKey   = eternumFlags.String("api-key", "", "Eternum API key")
+
+		clusterFlags    = flag.NewFlagSet("pup cluster", flag.ExitOnError)
+		clusterURL      = clusterFlags.String("url", "http://127.0.0.1:9094", "ipfs-cluster REST API URL")
+		clusterUser     = clusterFlags.String("username", "", "ipfs-cluster REST API username, if required")
+		clusterPassword = clusterFlags.String("password", "", "ipfs-cluster REST API password, if required")
+
+		psaFlags = flag.NewFlagSet("pup psa", flag.ExitOnError)
+		psaURL   = psaFlags.String("url", "", "Pinning Service API endpoint URL")
+		psaToken = psaFlags.String("token", "", "Pinning Service API access token")
 	)
 
 	//////////////////////////////////////////////////////////
@@ -95,7 +107,7 @@ func main() {
 		Name:       "ls",
 		ShortUsage: "pup pipin ls",
 		Exec: func(ctx context.Context, args []string) error {
-			return ls(ctx, pipin.New(true, *pipinHost, *pipinToken))
+			return ls(ctx, &pipin.Client{BaseURL: *pipinURL, Token: *pipinToken, Fingerprint: *pipinFP})
 		},
 	}
 
@@ -103,7 +115,7 @@ func main() {
 		Name:       "add",
 		ShortUsage: "pup pipin add <hash>",
 		Exec: func(ctx context.Context, args []string) error {
-			return add(ctx, pipin.New(true, *pipinHost, *pipinToken), args)
+			return add(ctx, &pipin.Client{BaseURL: *pipinURL, Token: *pipinToken, Fingerprint: *pipinFP}, args)
 		},
 	}
 
@@ -111,7 +123,7 @@ func main() {
 		Name:       "rm",
 		ShortUsage: "pup pipin rm <hash>",
 		Exec: func(ctx context.Context, args []string) error {
-			return rm(ctx, pipin.New(true, *pipinHost, *pipinToken), args)
+			return rm(ctx, &pipin.Client{BaseURL: *pipinURL, Token: *pipinToken, Fingerprint: *pipinFP}, args)
 		},
 	}
 
@@ -158,14 +170,101 @@ func main() {
 		Subcommands: []*ffcli.Command{eternumList, eternumAdd, eternumRm},
 	}
 
+	/////////////////////////////////////////////////////////
+	// ipfs-cluster
+
+	newCluster := func() *cluster.Client {
+		c := cluster.New(*clusterURL)
+		c.Username, c.Password = *clusterUser, *clusterPassword
+		return c
+	}
+
+	clusterList := &ffcli.Command{
+		Name:       "ls",
+		ShortUsage: "pup cluster ls",
+		Exec: func(ctx context.Context, args []string) error {
+			return ls(ctx, newCluster())
+		},
+	}
+
+	clusterAdd := &ffcli.Command{
+		Name:       "add",
+		ShortUsage: "pup cluster add <hash>",
+		Exec: func(ctx context.Context, args []string) error {
+			return add(ctx, newCluster(), args)
+		},
+	}
+
+	clusterRm := &ffcli.Command{
+		Name:       "rm",
+		ShortUsage: "pup cluster rm <hash>",
+		Exec: func(ctx context.Context, args []string) error {
+			return rm(ctx, newCluster(), args)
+		},
+	}
+
+	clusterStatus := &ffcli.Command{
+		Name:       "status",
+		ShortUsage: "pup cluster status <hash>",
+		Exec: func(ctx context.Context, args []string) error {
+			return peers(ctx, newCluster(), args)
+		},
+	}
+
+	clusterRoot := &ffcli.Command{
+		Name:        "cluster",
+		ShortUsage:  "pup cluster [flags] <command>",
+		FlagSet:     clusterFlags,
+		Options:     []ff.Option{ff.WithEnvVarPrefix("CLUSTER")},
+		Subcommands: []*ffcli.Command{clusterList, clusterAdd, clusterRm, clusterStatus},
+	}
+
+	/////////////////////////////////////////////////////////
+	// Pinning Service API
+
+	psaList := &ffcli.Command{
+		Name:       "ls",
+		ShortUsage: "pup psa ls",
+		Exec: func(ctx context.Context, args []string) error {
+			return ls(ctx, psa.New(*psaURL, *psaToken))
+		},
+	}
+
+	psaAdd := &ffcli.Command{
+		Name:       "add",
+		ShortUsage: "pup psa add <hash>",
+		Exec: func(ctx context.Context, args []string) error {
+			return add(ctx, psa.New(*psaURL, *psaToken), args)
+		},
+	}
+
+	psaRm := &ffcli.Command{
+		Name:       "rm",
+		ShortUsage: "pup psa rm <hash>",
+		Exec: func(ctx context.Context, args []string) error {
+			return rm(ctx, psa.New(*psaURL, *psaToken), args)
+		},
+	}
+
+	psaRoot := &ffcli.Command{
+		Name:        "psa",
+		ShortUsage:  "pup psa [flags] <command>",
+		FlagSet:     psaFlags,
+		Options:     []ff.Option{ff.WithEnvVarPrefix("PSA")},
+		Subcommands: []*ffcli.Command{psaList, psaAdd, psaRm},
+	}
+
 	/////////////////////////////////////////////////////////
 
 	root := &ffcli.Command{
 		ShortUsage:  "pup [flags] <command>",
-		Subcommands: []*ffcli.Command{pipinRoot, pinataRoot, eternumRoot},
+		Subcommands: []*ffcli.Command{pipinRoot, pinataRoot, eternumRoot, clusterRoot, psaRoot},
 	}
 
 	if err := root.ParseAndRun(context.Background(), os.Args[1:]); err != nil {
+		if hint := pup.Hint(err); hint != "" {
+			log.Fatalf("%s\nHINT: %s", err, hint)
+		}
 		log.Fatal(err)
 	}
 }
@@ -187,7 +286,8 @@ func add(ctx context.Context, client pup.Pup, args []string) error {
 	if len(args) != 1 {
 		return errors.New("add requires one hash argument")
 	}
-	if err := client.Pin(ctx, pup.Hash(args[0])); err != nil {
+	err := client.Pin(ctx, pup.Hash(args[0]))
+	if err != nil {
 		return err
 	}
 	fmt.Printf("Pinned hash: %q\n", args[0])
@@ -198,9 +298,31 @@ func rm(ctx context.Context, client pup.Pup, args []string) error {
 	if len(args) != 1 {
 		return errors.New("rm requires one hash argument")
 	}
-	if err := client.Unpin(ctx, pup.Hash(args[0])); err != nil {
+	err := client.Unpin(ctx, pup.Hash(args[0]))
+	if err != nil {
 		return err
 	}
 	fmt.Printf("Unpinned hash: %q\n", args[0])
 	return nil
 }
+
+func peers(ctx context.Context, client *cluster.Client, args []string) error {
+	if len(args) != 1 {
+		return errors.New("status requires one hash argument")
+	}
+	list, err := client.Peers(ctx, pup.Hash(args[0]))
+	if err != nil {
+		return err
+	}
+	for _, p := range list {
+		if !p.Allocated {
+			continue
+		}
+		line := fmt.Sprintf("%-20s %-10s %s", p.Name, p.Status, p.Peer)
+		if p.Error != "" {
+			line += ": " + p.Error
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
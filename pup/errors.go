@@ -0,0 +1,253 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package pup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Errors which Pup implementations map service responses into. They can be
+// detected with errors.Is.
+var (
+	ErrUnauthorized  = errors.New("unauthorized")
+	ErrNotFound      = errors.New("not found")
+	ErrRateLimited   = errors.New("rate limited")
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	ErrTransient     = errors.New("transient failure")
+)
+
+// RateLimitError is returned when a service asks us to slow down. It matches
+// ErrRateLimited with errors.Is, and also ErrTransient if Transient is set.
+type RateLimitError struct {
+	// RetryAfter is how long the service asked us to wait before the next
+	// request; zero if unknown.
+	RetryAfter time.Duration
+	// Transient is set if the service reported a temporary failure, e.g.
+	// HTTP 503, rather than throttling us. Such errors also match
+	// ErrTransient.
+	Transient bool
+}
+
+func (e *RateLimitError) Error() string {
+	msg := ErrRateLimited.Error()
+	if e.Transient {
+		msg = ErrTransient.Error()
+	}
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("%s (retry after %s)", msg, e.RetryAfter)
+	}
+	return msg
+}
+
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited || (e.Transient && target == ErrTransient)
+}
+
+// HTTPError describes an unsuccessful HTTP response from a pinning service.
+type HTTPError struct {
+	StatusCode int
+	// Message is an error message extracted from the response body, if any.
+	Message string
+	// Err is one of the Err* values or a *RateLimitError, or nil if the
+	// response could not be classified.
+	Err error
+}
+
+func (e *HTTPError) Error() string {
+	msg := fmt.Sprintf("HTTP %d", e.StatusCode)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+func (e *HTTPError) Unwrap() error { return e.Err }
+
+// maxErrorBody limits how much of an error response body is read.
+const maxErrorBody = 4096
+
+// CheckResponse returns nil if resp has a 2xx status code. Otherwise, it
+// reads and closes resp.Body, and returns an *HTTPError classified based on
+// the status code.
+func CheckResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+
+	e := &HTTPError{
+		StatusCode: resp.StatusCode,
+		Message:    errorMessage(body),
+	}
+	switch resp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		e.Err = ErrUnauthorized
+	case http.StatusNotFound:
+		e.Err = ErrNotFound
+	case http.StatusTooManyRequests:
+		e.Err = &RateLimitError{RetryAfter: ParseRetryAfter(resp.Header.Get("Retry-After"))}
+	case http.StatusPaymentRequired, http.StatusRequestEntityTooLarge, http.StatusInsufficientStorage:
+		e.Err = ErrQuotaExceeded
+	case http.StatusRequestTimeout, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		e.Err = ErrTransient
+	default:
+		if resp.StatusCode >= 500 {
+			e.Err = ErrTransient
+		}
+	}
+	if e.Err == ErrTransient && resp.Header.Get("Retry-After") != "" {
+		e.Err = &RateLimitError{
+			RetryAfter: ParseRetryAfter(resp.Header.Get("Retry-After")),
+			Transient:  true,
+		}
+	}
+	return e
+}
+
+// errorMessage tries to extract a human-readable message from an error
+// response body. It understands a few JSON shapes used by pinning services,
+// falling back to the raw body text.
+func errorMessage(body []byte) string {
+	var v struct {
+		Error  json.RawMessage
+		Detail string
+		// Temporal wraps messages in an envelope
+		Response json.RawMessage
+		// Eternum-style validation errors
+		NonFieldErrors []string `json:"non_field_errors"`
+	}
+	if json.Unmarshal(body, &v) == nil {
+		var s string
+		var obj struct{ Reason, Details string }
+		switch {
+		case json.Unmarshal(v.Error, &s) == nil && s != "":
+			return s
+		case json.Unmarshal(v.Error, &obj) == nil && obj.Reason != "":
+			if obj.Details != "" {
+				return obj.Reason + ": " + obj.Details
+			}
+			return obj.Reason
+		case v.Detail != "":
+			return v.Detail
+		case json.Unmarshal(v.Response, &s) == nil && s != "":
+			return s
+		case len(v.NonFieldErrors) > 0:
+			return strings.Join(v.NonFieldErrors, "; ")
+		}
+	}
+	return strings.TrimSpace(string(body))
+}
+
+// ParseRetryAfter parses the value of a Retry-After HTTP header, which can be
+// either a number of seconds or an HTTP date. It returns zero if the value is
+// empty or invalid.
+func ParseRetryAfter(v string) time.Duration {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// IsRetryable reports whether the operation which returned err may succeed if
+// retried later.
+func IsRetryable(err error) bool {
+	if errors.Is(err, ErrTransient) || errors.Is(err, ErrRateLimited) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// RetryAfter returns the delay requested by the service in a *RateLimitError
+// wrapped in err, or zero if there is none.
+func RetryAfter(err error) time.Duration {
+	var rl *RateLimitError
+	if errors.As(err, &rl) {
+		return rl.RetryAfter
+	}
+	return 0
+}
+
+// Hint returns a short, human-readable explanation of err suitable for
+// showing to users, or an empty string if err is not a known pup error.
+func Hint(err error) string {
+	switch {
+	case errors.Is(err, ErrUnauthorized):
+		return "the service rejected the credentials; check the API keys/token"
+	case errors.Is(err, ErrNotFound):
+		return "the service does not know this hash"
+	case errors.Is(err, ErrRateLimited):
+		if d := RetryAfter(err); d > 0 {
+			return fmt.Sprintf("the service is rate limiting requests; try again in %s", d)
+		}
+		return "the service is rate limiting requests; try again later"
+	case errors.Is(err, ErrQuotaExceeded):
+		return "the account's quota or plan limit was exceeded"
+	case IsRetryable(err):
+		return "temporary problem with the service; try again later"
+	}
+	return ""
+}
+
+// Retry calls fn until it succeeds, returns an error that is not retryable,
+// or the number of attempts is exhausted. Between attempts, it waits for the
+// delay requested by the service, or an exponentially growing interval.
+//
+// Requests made with a Transport are already retried, so Retry is only
+// useful for operations which don't use one.
+func Retry(ctx context.Context, attempts int, fn func() error) error {
+	for i := 1; ; i++ {
+		err := fn()
+		if err == nil || i >= attempts || !IsRetryable(err) {
+			return err
+		}
+		wait := RetryAfter(err)
+		if wait == 0 {
+			wait = Backoff(i-1, time.Second, 30*time.Second)
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
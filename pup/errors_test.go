@@ -0,0 +1,138 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package pup
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func response(status int, retryAfter, body string) *http.Response {
+	resp := &http.Response{
+		StatusCode: status,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}
+	if retryAfter != "" {
+		resp.Header.Set("Retry-After", retryAfter)
+	}
+	return resp
+}
+
+func TestCheckResponse(t *testing.T) {
+	tests := []struct {
+		status     int
+		retryAfter string
+		body       string
+		is         []error // errors the result must match
+		isNot      []error
+		retryIn    time.Duration
+		message    string
+	}{
+		{status: 200},
+		{status: 204},
+		{
+			status: 401, body: `{"error":"Invalid API key"}`,
+			is: []error{ErrUnauthorized}, isNot: []error{ErrTransient},
+			message: "Invalid API key",
+		},
+		{status: 403, is: []error{ErrUnauthorized}},
+		{
+			status: 404, body: `{"detail":"Not found."}`,
+			is: []error{ErrNotFound}, message: "Not found.",
+		},
+		{
+			status: 429, body: "slow down",
+			is: []error{ErrRateLimited}, isNot: []error{ErrTransient},
+			message: "slow down",
+		},
+		{
+			status: 429, retryAfter: "7",
+			is: []error{ErrRateLimited}, isNot: []error{ErrTransient},
+			retryIn: 7 * time.Second,
+		},
+		{status: 402, is: []error{ErrQuotaExceeded}},
+		{status: 413, is: []error{ErrQuotaExceeded}},
+		{
+			status: 503, body: `{"error":{"reason":"MAINTENANCE","details":"back soon"}}`,
+			is: []error{ErrTransient}, isNot: []error{ErrRateLimited},
+			message: "MAINTENANCE: back soon",
+		},
+		{
+			status: 503, retryAfter: "3",
+			is: []error{ErrTransient, ErrRateLimited}, retryIn: 3 * time.Second,
+		},
+		{status: 500, is: []error{ErrTransient}},
+		{
+			status: 400, body: `{"non_field_errors":["a","b"]}`,
+			isNot: []error{ErrTransient, ErrRateLimited, ErrNotFound}, message: "a; b",
+		},
+		{status: 400, body: `{"response":"Temporal message"}`, message: "Temporal message"},
+		{status: 400, body: "  plain text\n", message: "plain text"},
+	}
+	for _, tt := range tests {
+		err := CheckResponse(response(tt.status, tt.retryAfter, tt.body))
+		if tt.status < 300 {
+			if err != nil {
+				t.Errorf("CheckResponse(%d) = %v, want nil", tt.status, err)
+			}
+			continue
+		}
+		var httpErr *HTTPError
+		if !errors.As(err, &httpErr) {
+			t.Errorf("CheckResponse(%d) = %v, want HTTPError", tt.status, err)
+			continue
+		}
+		if httpErr.StatusCode != tt.status {
+			t.Errorf("CheckResponse(%d).StatusCode = %d", tt.status, httpErr.StatusCode)
+		}
+		if httpErr.Message != tt.message {
+			t.Errorf("CheckResponse(%d, %q).Message = %q, want %q", tt.status, tt.body, httpErr.Message, tt.message)
+		}
+		for _, target := range tt.is {
+			if !errors.Is(err, target) {
+				t.Errorf("CheckResponse(%d, Retry-After %q) = %v, doesn't match %v", tt.status, tt.retryAfter, err, target)
+			}
+		}
+		for _, target := range tt.isNot {
+			if errors.Is(err, target) {
+				t.Errorf("CheckResponse(%d, Retry-After %q) = %v, unexpectedly matches %v", tt.status, tt.retryAfter, err, target)
+			}
+		}
+		if got := RetryAfter(err); got != tt.retryIn {
+			t.Errorf("RetryAfter(CheckResponse(%d, Retry-After %q)) = %s, want %s", tt.status, tt.retryAfter, got, tt.retryIn)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if got := ParseRetryAfter("120"); got != 2*time.Minute {
+		t.Errorf("ParseRetryAfter(120) = %s, want 2m", got)
+	}
+	for _, v := range []string{"", "-1", "soon"} {
+		if got := ParseRetryAfter(v); got != 0 {
+			t.Errorf("ParseRetryAfter(%q) = %s, want 0", v, got)
+		}
+	}
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if got := ParseRetryAfter(date); got < 59*time.Minute || got > time.Hour {
+		t.Errorf("ParseRetryAfter(%q) = %s, want about 1h", date, got)
+	}
+}
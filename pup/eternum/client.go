@@ -19,47 +19,50 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"sort"
+	"strings"
 
 	"github.com/wpengine/hackathon-catation/pup"
 )
 
+// Client of the Eternum pinning service. Note that it doesn't implement
+// pup.Uploader, as Eternum can only pin content by hash.
 type Client struct {
 	Key string
+
+	// BaseURL is the address of the API; https://www.eternum.io if empty.
+	BaseURL string `json:",omitempty"`
+	// HTTPClient optionally overrides the client used for requests to Eternum.
+	HTTPClient *http.Client `json:"-"`
 }
 
+var defaultHTTPClient = pup.NewHTTPClient(4)
+
 func New(key string) *Client {
 	return &Client{Key: key}
 }
 
-func (c *Client) Fetch(ctx context.Context, filter []pup.Hash) ([]pup.NamedHash, error) {
-	req, err := http.NewRequestWithContext(
-		ctx,
-		http.MethodGet,
-		"https://www.eternum.io/api/pin/",
-		nil,
-	)
-	req.Header.Set("content-type", "application/json")
-	req.Header.Set("authorization", fmt.Sprintf("Token %s", c.Key))
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
+func (c *Client) endpoint(path string) string {
+	base := c.BaseURL
+	if base == "" {
+		base = "https://www.eternum.io"
 	}
+	return strings.TrimSuffix(base, "/") + path
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unable to fetch pins: %d", resp.StatusCode)
-	}
-	defer resp.Body.Close()
-
-	var body listresponse
-
-	err = json.NewDecoder(resp.Body).Decode(&body)
-	if err != nil {
-		return nil, err
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
 	}
+	return defaultHTTPClient
+}
 
+// Fetch lists pins, following links to next pages of the list until all are
+// retrieved.
+func (c *Client) Fetch(ctx context.Context, filter []pup.Hash) ([]pup.NamedHash, error) {
 	var m map[string]bool = nil
 
 	if len(filter) > 0 {
@@ -70,26 +73,59 @@ func (c *Client) Fetch(ctx context.Context, filter []pup.Hash) ([]pup.NamedHash,
 	}
 
 	list := []pup.NamedHash{}
-	for _, obj := range body.Results {
-		if m == nil {
-			list = append(list, pup.NamedHash{
-				Hash: obj.Hash,
-				Name: obj.Name,
-				Size: obj.Size,
-			})
-			continue
+	seen := map[string]bool{}
+	for next := c.endpoint("/api/pin/"); next != "" && !seen[next]; {
+		seen[next] = true
+		page, err := c.fetchPage(ctx, next)
+		if err != nil {
+			return nil, err
 		}
-		if _, ok := m[obj.Hash]; ok {
+		for _, obj := range page.Results {
+			if m != nil && !m[obj.Hash] {
+				continue
+			}
 			list = append(list, pup.NamedHash{
 				Hash: obj.Hash,
 				Name: obj.Name,
 				Size: obj.Size,
 			})
 		}
+		next = page.Next
 	}
 	return list, nil
 }
 
+func (c *Client) fetchPage(ctx context.Context, url string) (*listresponse, error) {
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodGet,
+		url,
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set("authorization", fmt.Sprintf("Token %s", c.Key))
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return nil, fmt.Errorf("unable to fetch pins: %w", err)
+	}
+
+	var body listresponse
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch pins: decoding response: %w", err)
+	}
+	return &body, nil
+}
+
 type pin struct {
 	Hash   string `json:"hash"`
 	Active bool   `json:"active"`
@@ -97,14 +133,26 @@ type pin struct {
 	Size   int64  `json:"size"`
 }
 
+// listresponse is a page of the list of pins.
 type listresponse struct {
-	Results []pin `json:"results"`
+	Next    string `json:"next"` // URL of the next page, if any
+	Results []pin  `json:"results"`
 }
 
 func (c *Client) Pin(ctx context.Context, hash pup.Hash) error {
-	var buf bytes.Buffer
+	return c.PinWithOptions(ctx, hash, pup.PinOptions{})
+}
 
-	err := json.NewEncoder(&buf).Encode(map[string]string{"hash": hash})
+// PinWithOptions pins the hash with the name from opts. If the hash is
+// already pinned, it gets renamed instead. Other options are not supported
+// by Eternum, and are ignored.
+func (c *Client) PinWithOptions(ctx context.Context, hash pup.Hash, opts pup.PinOptions) error {
+	body := map[string]string{"hash": hash}
+	if opts.Name != "" {
+		body["name"] = opts.Name
+	}
+	var buf bytes.Buffer
+	err := json.NewEncoder(&buf).Encode(body)
 	if err != nil {
 		return err
 	}
@@ -112,67 +160,181 @@ func (c *Client) Pin(ctx context.Context, hash pup.Hash) error {
 	req, err := http.NewRequestWithContext(
 		ctx,
 		http.MethodPost,
-		"https://www.eternum.io/api/pin/",
+		c.endpoint("/api/pin/"),
 		&buf,
 	)
+	if err != nil {
+		return err
+	}
 	req.Header.Set("content-type", "application/json")
 	req.Header.Set("authorization", fmt.Sprintf("Token %s", c.Key))
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.httpClient().Do(req)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusCreated {
+	err = checkResponse(resp)
+	var httpErr *pup.HTTPError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusBadRequest &&
+		strings.Contains(httpErr.Message, "already pinned") {
+		// yuck
+		if opts.Name != "" {
+			return c.Rename(ctx, hash, opts.Name)
+		}
 		return nil
 	}
+	if err != nil {
+		return fmt.Errorf("unable to pin hash: %w", err)
+	}
+	return nil
+}
 
-	if resp.StatusCode == http.StatusBadRequest {
-		defer resp.Body.Close()
+// Rename changes the name of an already pinned hash.
+func (c *Client) Rename(ctx context.Context, hash pup.Hash, name string) error {
+	var buf bytes.Buffer
+	err := json.NewEncoder(&buf).Encode(map[string]string{"name": name})
+	if err != nil {
+		return err
+	}
 
-		errJSON := struct {
-			NonFieldErrors []string `json:"non_field_errors"`
-		}{}
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPatch,
+		c.endpoint(fmt.Sprintf("/api/pin/%s/", hash)),
+		&buf,
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set("authorization", fmt.Sprintf("Token %s", c.Key))
 
-		err = json.NewDecoder(resp.Body).Decode(&errJSON)
-		if err != nil {
-			return err
-		}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
 
-		// yuck
-		if errJSON.NonFieldErrors[0] == "You have already pinned an object with that hash." {
-			return nil
-		}
+	if err := checkResponse(resp); err != nil {
+		return fmt.Errorf("unable to rename pin: %w", err)
 	}
+	return nil
+}
 
-	return fmt.Errorf("unable to pin hash: %d", resp.StatusCode)
+// UpdateMetadata renames the pin. Eternum doesn't support key-values, so
+// they are ignored.
+func (c *Client) UpdateMetadata(ctx context.Context, hash pup.Hash, md pup.Metadata) error {
+	return c.Rename(ctx, hash, md.Name)
 }
 
 func (c *Client) Unpin(ctx context.Context, hash pup.Hash) error {
-	var buf bytes.Buffer
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodDelete,
+		c.endpoint(fmt.Sprintf("/api/pin/%s/", hash)),
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set("authorization", fmt.Sprintf("Token %s", c.Key))
 
-	err := json.NewEncoder(&buf).Encode(map[string]string{"hash": hash})
+	resp, err := c.httpClient().Do(req)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
+
+	err = checkResponse(resp)
+	if errors.Is(err, pup.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to unpin hash: %w", err)
+	}
+	return nil
+}
 
+// Status checks the "active" flag of the pin, which Eternum sets once the
+// content got retrieved.
+func (c *Client) Status(ctx context.Context, hash pup.Hash) (pup.PinStatus, error) {
 	req, err := http.NewRequestWithContext(
 		ctx,
-		http.MethodDelete,
-		fmt.Sprintf("https://www.eternum.io/api/pin/%s/", hash),
+		http.MethodGet,
+		c.endpoint(fmt.Sprintf("/api/pin/%s/", hash)),
 		nil,
 	)
+	if err != nil {
+		return "", err
+	}
 	req.Header.Set("content-type", "application/json")
 	req.Header.Set("authorization", fmt.Sprintf("Token %s", c.Key))
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.httpClient().Do(req)
 	if err != nil {
-		return err
+		return "", err
 	}
+	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNotFound {
-		return nil
+	err = checkResponse(resp)
+	if errors.Is(err, pup.ErrNotFound) {
+		return pup.StatusUnpinned, nil
 	}
+	if err != nil {
+		return "", fmt.Errorf("unable to check pin status: %w", err)
+	}
+
+	var obj pin
+	err = json.NewDecoder(resp.Body).Decode(&obj)
+	if err != nil {
+		return "", err
+	}
+	if obj.Active {
+		return pup.StatusPinned, nil
+	}
+	return pup.StatusPinning, nil
+}
+
+// checkResponse maps an unsuccessful Eternum response to pup errors. Eternum
+// reports running out of credit as a plain validation error, so we have to
+// peek at the message.
+func checkResponse(resp *http.Response) error {
+	err := pup.CheckResponse(resp)
+	var httpErr *pup.HTTPError
+	if errors.As(err, &httpErr) && httpErr.Err == nil {
+		httpErr.Message = fieldErrors(httpErr.Message)
+		msg := strings.ToLower(httpErr.Message)
+		if strings.Contains(msg, "credit") || strings.Contains(msg, "balance") {
+			httpErr.Err = pup.ErrQuotaExceeded
+		}
+	}
+	return err
+}
 
-	return fmt.Errorf("unable to unpin hash: %d", resp.StatusCode)
+// fieldErrors formats validation errors of individual fields, reported by
+// Eternum as a JSON object with a list of messages per field. Other
+// messages are returned unchanged.
+func fieldErrors(msg string) string {
+	var fields map[string][]string
+	if json.Unmarshal([]byte(msg), &fields) != nil || len(fields) == 0 {
+		return msg
+	}
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		if len(fields[name]) > 0 {
+			parts = append(parts, name+": "+strings.Join(fields[name], " "))
+		}
+	}
+	if len(parts) == 0 {
+		return msg
+	}
+	return strings.Join(parts, "; ")
 }
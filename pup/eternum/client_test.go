@@ -0,0 +1,327 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package eternum
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/wpengine/hackathon-catation/pup"
+	"github.com/wpengine/hackathon-catation/pup/puptest"
+)
+
+// fakeEternum emulates the subset of Eternum API used by Client, keeping
+// pins in memory. New pins become active when listed for the first time.
+type fakeEternum struct {
+	t   *testing.T
+	url string
+
+	mu       sync.Mutex
+	pins     []pin // in order of pinning
+	pageSize int
+	credit   int // max number of pins; 0 means unlimited
+	// badRequest, if non-empty, is sent as the body of a 400 response to
+	// every POST.
+	badRequest string
+}
+
+func newFakeEternum(t *testing.T) (*fakeEternum, *Client) {
+	f := &fakeEternum{t: t, pageSize: 2}
+	c := New("key")
+	c.BaseURL, c.HTTPClient = puptest.Serve(t, f)
+	f.url = c.BaseURL
+	return f, c
+}
+
+func (f *fakeEternum) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("authorization") != "Token key" {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"detail":"Invalid token."}`)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/pin/")
+	switch {
+	case path == "" && r.Method == http.MethodGet:
+		f.list(w, r)
+	case path == "" && r.Method == http.MethodPost:
+		f.pin(w, r)
+	case strings.HasSuffix(path, "/"):
+		f.detail(w, r, strings.TrimSuffix(path, "/"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeEternum) list(w http.ResponseWriter, r *http.Request) {
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	end := offset + f.pageSize
+	if end > len(f.pins) {
+		end = len(f.pins)
+	}
+	var resp listresponse
+	resp.Results = append([]pin{}, f.pins[offset:end]...)
+	if end < len(f.pins) {
+		resp.Next = fmt.Sprintf("%s/api/pin/?limit=%d&offset=%d", f.url, f.pageSize, end)
+	}
+	for i := offset; i < end; i++ {
+		f.pins[i].Active = true
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (f *fakeEternum) pin(w http.ResponseWriter, r *http.Request) {
+	if f.badRequest != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, f.badRequest)
+		return
+	}
+	var body struct{ Hash, Name string }
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Hash == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"hash":["This field is required."]}`)
+		return
+	}
+	if f.find(body.Hash) >= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"non_field_errors":["This hash is already pinned."]}`)
+		return
+	}
+	if f.credit > 0 && len(f.pins) >= f.credit {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"non_field_errors":["Your balance is insufficient."]}`)
+		return
+	}
+	p := pin{Hash: body.Hash, Name: body.Name, Size: 100}
+	f.pins = append(f.pins, p)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(p)
+}
+
+func (f *fakeEternum) detail(w http.ResponseWriter, r *http.Request, hash string) {
+	i := f.find(hash)
+	if i < 0 {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"detail":"Not found."}`)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(f.pins[i])
+	case http.MethodPatch:
+		var body struct{ Name *string }
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if body.Name != nil {
+			f.pins[i].Name = *body.Name
+		}
+		json.NewEncoder(w).Encode(f.pins[i])
+	case http.MethodDelete:
+		f.pins = append(f.pins[:i], f.pins[i+1:]...)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeEternum) find(hash string) int {
+	for i, p := range f.pins {
+		if p.Hash == hash {
+			return i
+		}
+	}
+	return -1
+}
+
+func (f *fakeEternum) names() map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m := map[string]string{}
+	for _, p := range f.pins {
+		m[p.Hash] = p.Name
+	}
+	return m
+}
+
+func TestFetchPages(t *testing.T) {
+	f, c := newFakeEternum(t)
+	ctx := context.Background()
+
+	var want []pup.NamedHash
+	for i := 0; i < 5; i++ {
+		h := fmt.Sprintf("Qm%d", i)
+		name := fmt.Sprintf("file%d.jpg", i)
+		if err := c.PinWithOptions(ctx, h, pup.PinOptions{Metadata: pup.Metadata{Name: name}}); err != nil {
+			t.Fatalf("PinWithOptions(%s): %v", h, err)
+		}
+		want = append(want, pup.NamedHash{Hash: h, Name: name, Size: 100})
+	}
+
+	got, err := c.Fetch(ctx, nil)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Fetch = %v, want %v", got, want)
+	}
+
+	got, err = c.Fetch(ctx, []pup.Hash{"Qm1", "Qm4", "Qm9"})
+	if err != nil {
+		t.Fatalf("Fetch with filter: %v", err)
+	}
+	if !reflect.DeepEqual(got, []pup.NamedHash{want[1], want[4]}) {
+		t.Errorf("Fetch with filter = %v, want %v", got, []pup.NamedHash{want[1], want[4]})
+	}
+
+	f.mu.Lock()
+	f.pins = nil
+	f.mu.Unlock()
+	got, err = c.Fetch(ctx, nil)
+	if err != nil || len(got) != 0 {
+		t.Errorf("Fetch of no pins = %v, %v; want empty list", got, err)
+	}
+}
+
+func TestPinRenameUnpin(t *testing.T) {
+	f, c := newFakeEternum(t)
+	ctx := context.Background()
+
+	if err := c.Pin(ctx, "QmA"); err != nil {
+		t.Fatalf("Pin: %v", err)
+	}
+	// Already pinned hashes are not an error
+	if err := c.Pin(ctx, "QmA"); err != nil {
+		t.Fatalf("Pin again: %v", err)
+	}
+	if got := f.names(); !reflect.DeepEqual(got, map[string]string{"QmA": ""}) {
+		t.Errorf("pins = %v, want QmA without a name", got)
+	}
+
+	// ...but get renamed if pinned with a name
+	err := c.PinWithOptions(ctx, "QmA", pup.PinOptions{Metadata: pup.Metadata{Name: "cat.jpg"}})
+	if err != nil {
+		t.Fatalf("PinWithOptions of pinned hash: %v", err)
+	}
+	if got := f.names()["QmA"]; got != "cat.jpg" {
+		t.Errorf("name after PinWithOptions = %q, want cat.jpg", got)
+	}
+
+	var _ pup.MetadataUpdater = c
+	err = c.UpdateMetadata(ctx, "QmA", pup.Metadata{Name: "dog.jpg", KeyValues: map[string]string{"ignored": "yes"}})
+	if err != nil {
+		t.Fatalf("UpdateMetadata: %v", err)
+	}
+	if got := f.names()["QmA"]; got != "dog.jpg" {
+		t.Errorf("name after UpdateMetadata = %q, want dog.jpg", got)
+	}
+
+	if err := c.Rename(ctx, "QmMissing", "x"); !errors.Is(err, pup.ErrNotFound) {
+		t.Errorf("Rename of missing pin = %v, want ErrNotFound", err)
+	}
+
+	if err := c.Unpin(ctx, "QmA"); err != nil {
+		t.Fatalf("Unpin: %v", err)
+	}
+	if got := f.names(); len(got) != 0 {
+		t.Errorf("pins after Unpin = %v, want none", got)
+	}
+	if err := c.Unpin(ctx, "QmA"); err != nil {
+		t.Errorf("Unpin of missing pin = %v, want nil", err)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	_, c := newFakeEternum(t)
+	ctx := context.Background()
+
+	if err := c.Pin(ctx, "QmA"); err != nil {
+		t.Fatalf("Pin: %v", err)
+	}
+	want := []pup.PinStatus{pup.StatusPinning, pup.StatusPinned}
+	for _, w := range want {
+		got, err := c.Status(ctx, "QmA")
+		if err != nil {
+			t.Fatalf("Status: %v", err)
+		}
+		if got != w {
+			t.Errorf("Status = %q, want %q", got, w)
+		}
+		// Listing activates the pin in the fake
+		if _, err := c.Fetch(ctx, nil); err != nil {
+			t.Fatalf("Fetch: %v", err)
+		}
+	}
+	got, err := c.Status(ctx, "QmMissing")
+	if err != nil || got != pup.StatusUnpinned {
+		t.Errorf("Status of missing pin = %q, %v; want %q", got, err, pup.StatusUnpinned)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	f, c := newFakeEternum(t)
+	ctx := context.Background()
+
+	f.credit = 1
+	if err := c.Pin(ctx, "QmA"); err != nil {
+		t.Fatalf("Pin: %v", err)
+	}
+	if err := c.Pin(ctx, "QmB"); !errors.Is(err, pup.ErrQuotaExceeded) {
+		t.Errorf("Pin over credit = %v, want ErrQuotaExceeded", err)
+	}
+
+	tests := []struct {
+		body string
+		want string
+	}{
+		{`{"non_field_errors":[]}`, `{"non_field_errors":[]}`},
+		{`{"hash":["This field is required."]}`, "hash: This field is required."},
+		{`{"hash":["Invalid."],"name":["Too long.","Really."]}`, "hash: Invalid.; name: Too long. Really."},
+		{`{"hash":[]}`, `{"hash":[]}`},
+		{`Bad Request`, "Bad Request"},
+	}
+	for _, tt := range tests {
+		f.mu.Lock()
+		f.badRequest = tt.body
+		f.mu.Unlock()
+		err := c.Pin(ctx, "QmC")
+		var httpErr *pup.HTTPError
+		if !errors.As(err, &httpErr) {
+			t.Errorf("Pin with response %q = %v, want HTTPError", tt.body, err)
+			continue
+		}
+		if httpErr.StatusCode != http.StatusBadRequest || httpErr.Message != tt.want {
+			t.Errorf("Pin with response %q = %d %q, want 400 %q", tt.body, httpErr.StatusCode, httpErr.Message, tt.want)
+		}
+	}
+
+	c.Key = "wrong"
+	if _, err := c.Fetch(ctx, nil); !errors.Is(err, pup.ErrUnauthorized) {
+		t.Errorf("Fetch with bad key = %v, want ErrUnauthorized", err)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package ipfsnode implements a pup.Pup keeping pins in an IPFS node: either
+// one embedded in the app, or a daemon controlled via its HTTP RPC API.
+package ipfsnode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	icorepath "github.com/ipfs/interface-go-ipfs-core/path"
+
+	"github.com/wpengine/hackathon-catation/pup"
+)
+
+// pinTimeout limits how long a node may spend retrieving content to pin.
+const pinTimeout = 24 * time.Hour
+
+type Node struct {
+	// Name of the node, shown in Herder.
+	Name string `json:",omitempty"`
+	// URL of the node's HTTP RPC API, without the /api/v0 suffix, e.g.
+	// http://127.0.0.1:5001. Ignored by nodes created with New.
+	URL string
+	// HTTPClient optionally overrides the client used for requests to the
+	// RPC API.
+	HTTPClient *http.Client `json:"-"`
+
+	api  iface.CoreAPI
+	jobs pup.Jobs
+}
+
+// New returns a Node keeping pins in the node behind api, usually one
+// embedded in the app.
+func New(api iface.CoreAPI) *Node {
+	return &Node{api: api}
+}
+
+// NewRemote returns a Node keeping pins in a daemon with the HTTP RPC API
+// at url.
+func NewRemote(url string) *Node {
+	return &Node{URL: url}
+}
+
+func (n *Node) Fetch(ctx context.Context, filter []pup.Hash) ([]pup.NamedHash, error) {
+	m := map[string]bool{}
+	for _, h := range filter {
+		m[h] = true
+	}
+
+	var hashes []pup.Hash
+	var err error
+	if n.api != nil {
+		hashes, err = n.lsAPI(ctx)
+	} else {
+		hashes, err = n.lsRPC(ctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ipfs: fetching: %w", err)
+	}
+
+	list := []pup.NamedHash{}
+	for _, h := range hashes {
+		if len(m) == 0 || m[h] {
+			list = append(list, pup.NamedHash{Hash: h})
+		}
+	}
+	return list, nil
+}
+
+func (n *Node) lsAPI(ctx context.Context) ([]pup.Hash, error) {
+	pins, err := n.api.Pin().Ls(ctx, options.Pin.Ls.Recursive())
+	if err != nil {
+		return nil, err
+	}
+	var hashes []pup.Hash
+	for p := range pins {
+		if err := p.Err(); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, p.Path().Cid().String())
+	}
+	return hashes, nil
+}
+
+// Pin starts pinning the hash in background, as the node first has to
+// retrieve all its content. Use Status to check when it's done.
+func (n *Node) Pin(ctx context.Context, hash pup.Hash) error {
+	n.jobs.Start(hash, pinTimeout, func(ctx context.Context) error {
+		var err error
+		if n.api != nil {
+			err = n.api.Pin().Add(ctx, icorepath.New(hash))
+		} else {
+			err = n.rpc(ctx, "pin/add", hash, nil, nil)
+		}
+		if err != nil && ctx.Err() != context.Canceled {
+			log.Printf("ipfs: pinning %s failed: %v", hash, err)
+		}
+		return err
+	})
+	return nil
+}
+
+func (n *Node) Unpin(ctx context.Context, hash pup.Hash) error {
+	pending := n.jobs.Cancel(hash)
+
+	var err error
+	if n.api != nil {
+		err = n.api.Pin().Rm(ctx, icorepath.New(hash))
+		if err != nil && strings.Contains(err.Error(), "not pinned") {
+			err = pup.ErrNotFound
+		}
+	} else {
+		err = n.rpc(ctx, "pin/rm", hash, nil, nil)
+	}
+	if errors.Is(err, pup.ErrNotFound) && pending {
+		// Cancelled before it got pinned
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("ipfs: unpinning %q: %w", hash, err)
+	}
+	return nil
+}
+
+// Status reports pins started by Pin as in progress until the node
+// retrieves all their content, and failed pins as described in pup.Jobs.
+func (n *Node) Status(ctx context.Context, hash pup.Hash) (pup.PinStatus, error) {
+	pinning, failed := n.jobs.Check(hash)
+	if pinning {
+		return pup.StatusPinning, nil
+	}
+	if failed {
+		return pup.StatusFailed, nil
+	}
+
+	var pinned bool
+	var err error
+	if n.api != nil {
+		_, pinned, err = n.api.Pin().IsPinned(ctx, icorepath.New(hash), options.Pin.IsPinned.Recursive())
+	} else {
+		pinned, err = n.isPinnedRPC(ctx, hash)
+	}
+	if err != nil {
+		return "", fmt.Errorf("ipfs: checking status of %q: %w", hash, err)
+	}
+	if pinned {
+		return pup.StatusPinned, nil
+	}
+	return pup.StatusUnpinned, nil
+}
@@ -0,0 +1,253 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ipfsnode
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wpengine/hackathon-catation/pup"
+	"github.com/wpengine/hackathon-catation/pup/puptest"
+)
+
+// fakeDaemon emulates the pin commands of the IPFS HTTP RPC API, keeping
+// pins in memory. Pinning hashes starting with QmFail fails, and pinning
+// waits until gate is closed, if it's non-nil.
+type fakeDaemon struct {
+	mu   sync.Mutex
+	pins map[string]bool
+	gate chan struct{}
+}
+
+func newFakeDaemon(t *testing.T) (*fakeDaemon, *Node) {
+	d := &fakeDaemon{pins: map[string]bool{}}
+	// Requests go via the default client, to test its error handling
+	url, _ := puptest.Serve(t, d)
+	return d, NewRemote(url + "/")
+}
+
+func (d *fakeDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	arg := r.URL.Query().Get("arg")
+	switch r.URL.Path {
+	case "/api/v0/pin/ls":
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if r.URL.Query().Get("type") != "recursive" {
+			failed(w, "only recursive pins are emulated")
+			return
+		}
+		keys := map[string]struct{ Type string }{}
+		for h := range d.pins {
+			if arg == "" || arg == h {
+				keys[h] = struct{ Type string }{"recursive"}
+			}
+		}
+		if arg != "" && len(keys) == 0 {
+			failed(w, fmt.Sprintf("path '%s' is not pinned", arg))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Keys": keys})
+	case "/api/v0/pin/add":
+		d.mu.Lock()
+		gate := d.gate
+		d.mu.Unlock()
+		if gate != nil {
+			select {
+			case <-gate:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if strings.HasPrefix(arg, "QmFail") {
+			failed(w, "merkledag: not found")
+			return
+		}
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.pins[arg] = true
+		json.NewEncoder(w).Encode(map[string][]string{"Pins": {arg}})
+	case "/api/v0/pin/rm":
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if !d.pins[arg] {
+			failed(w, "not pinned or pinned indirectly")
+			return
+		}
+		delete(d.pins, arg)
+		json.NewEncoder(w).Encode(map[string][]string{"Pins": {arg}})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "404 page not found")
+	}
+}
+
+// failed replies like the daemon does to failed commands.
+func failed(w http.ResponseWriter, msg string) {
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(map[string]interface{}{"Message": msg, "Code": 0, "Type": "error"})
+}
+
+// waitStatus waits until the hash is no longer reported as pinning, and
+// returns its status.
+func waitStatus(t *testing.T, n *Node, hash pup.Hash) pup.PinStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		status, err := n.Status(context.Background(), hash)
+		if err != nil {
+			t.Fatalf("Status(%s): %v", hash, err)
+		}
+		if status != pup.StatusPinning {
+			return status
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("%s still pinning", hash)
+	return ""
+}
+
+func TestRemotePinning(t *testing.T) {
+	d, n := newFakeDaemon(t)
+	ctx := context.Background()
+
+	d.gate = make(chan struct{})
+	if err := n.Pin(ctx, "QmA"); err != nil {
+		t.Fatalf("Pin: %v", err)
+	}
+	if status, err := n.Status(ctx, "QmA"); err != nil || status != pup.StatusPinning {
+		t.Errorf("Status while pinning = %q, %v; want %q", status, err, pup.StatusPinning)
+	}
+	close(d.gate)
+	if status := waitStatus(t, n, "QmA"); status != pup.StatusPinned {
+		t.Errorf("Status after pinning = %q, want %q", status, pup.StatusPinned)
+	}
+
+	// Failures are reported once; afterwards the daemon's pins tell
+	if err := n.Pin(ctx, "QmFail"); err != nil {
+		t.Fatalf("Pin: %v", err)
+	}
+	if status := waitStatus(t, n, "QmFail"); status != pup.StatusFailed {
+		t.Errorf("Status after failure = %q, want %q", status, pup.StatusFailed)
+	}
+	if status, err := n.Status(ctx, "QmFail"); err != nil || status != pup.StatusUnpinned {
+		t.Errorf("Status after reported failure = %q, %v; want %q", status, err, pup.StatusUnpinned)
+	}
+	d.mu.Lock()
+	d.pins["QmFail"] = true
+	d.mu.Unlock()
+	if status, err := n.Status(ctx, "QmFail"); err != nil || status != pup.StatusPinned {
+		t.Errorf("Status after pinning by other means = %q, %v; want %q", status, err, pup.StatusPinned)
+	}
+
+	list, err := n.Fetch(ctx, []pup.Hash{"QmA", "QmB"})
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if want := []pup.NamedHash{{Hash: "QmA"}}; !reflect.DeepEqual(list, want) {
+		t.Errorf("Fetch = %v, want %v", list, want)
+	}
+
+	if err := n.Unpin(ctx, "QmA"); err != nil {
+		t.Errorf("Unpin: %v", err)
+	}
+	if err := n.Unpin(ctx, "QmA"); !errors.Is(err, pup.ErrNotFound) {
+		t.Errorf("Unpin of missing pin = %v, want ErrNotFound", err)
+	}
+	if status, err := n.Status(ctx, "QmA"); err != nil || status != pup.StatusUnpinned {
+		t.Errorf("Status after Unpin = %q, %v; want %q", status, err, pup.StatusUnpinned)
+	}
+}
+
+func TestRemoteUnpinPending(t *testing.T) {
+	d, n := newFakeDaemon(t)
+	ctx := context.Background()
+
+	d.gate = make(chan struct{})
+	defer close(d.gate)
+	if err := n.Pin(ctx, "QmA"); err != nil {
+		t.Fatalf("Pin: %v", err)
+	}
+	// Cancelled before it got pinned
+	if err := n.Unpin(ctx, "QmA"); err != nil {
+		t.Errorf("Unpin while pinning: %v", err)
+	}
+	if status, err := n.Status(ctx, "QmA"); err != nil || status != pup.StatusUnpinned {
+		t.Errorf("Status after Unpin = %q, %v; want %q", status, err, pup.StatusUnpinned)
+	}
+}
+
+func TestCheckResponse(t *testing.T) {
+	tests := []struct {
+		status  int
+		body    string
+		wantErr error // matched by the error, if non-nil
+		wantMsg string
+		notErr  error // not matched by the error, if non-nil
+	}{
+		{http.StatusOK, `{"Keys":{}}`, nil, "", nil},
+		{http.StatusInternalServerError, `{"Message":"path 'QmA' is not pinned","Code":0,"Type":"error"}`,
+			pup.ErrNotFound, "path 'QmA' is not pinned", pup.ErrTransient},
+		{http.StatusInternalServerError, `{"Message":"not pinned or pinned indirectly","Code":0,"Type":"error"}`,
+			pup.ErrNotFound, "not pinned or pinned indirectly", pup.ErrTransient},
+		{http.StatusInternalServerError, `{"Message":"invalid path \"x\"","Code":0,"Type":"error"}`,
+			nil, `invalid path "x"`, pup.ErrTransient},
+		{http.StatusInternalServerError, `panic: something`, pup.ErrTransient, "panic: something", nil},
+		{http.StatusNotFound, `404 page not found`, pup.ErrNotFound, "404 page not found", nil},
+		{http.StatusForbidden, `403 - Forbidden`, pup.ErrUnauthorized, "403 - Forbidden", nil},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{
+			StatusCode: tt.status,
+			Status:     http.StatusText(tt.status),
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader(tt.body)),
+		}
+		err := checkResponse(resp)
+		if tt.status == http.StatusOK {
+			if err != nil {
+				t.Errorf("checkResponse(200) = %v, want nil", err)
+			}
+			continue
+		}
+		var httpErr *pup.HTTPError
+		if !errors.As(err, &httpErr) {
+			t.Errorf("checkResponse(%d %s) = %v, want HTTPError", tt.status, tt.body, err)
+			continue
+		}
+		if httpErr.Message != tt.wantMsg {
+			t.Errorf("checkResponse(%d %s) has message %q, want %q", tt.status, tt.body, httpErr.Message, tt.wantMsg)
+		}
+		if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+			t.Errorf("checkResponse(%d %s) = %v, want %v", tt.status, tt.body, err, tt.wantErr)
+		}
+		if tt.notErr != nil && errors.Is(err, tt.notErr) {
+			t.Errorf("checkResponse(%d %s) = %v, which shouldn't be %v", tt.status, tt.body, err, tt.notErr)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ipfsnode
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/wpengine/hackathon-catation/pup"
+)
+
+// defaultHTTPClient is shared by all Node values without an explicit
+// HTTPClient. Requests are not limited in number, as pin/add ones last until
+// the daemon retrieves the content.
+var defaultHTTPClient = pup.NewHTTPClient(0)
+
+func (n *Node) httpClient() *http.Client {
+	if n.HTTPClient != nil {
+		return n.HTTPClient
+	}
+	return defaultHTTPClient
+}
+
+// rpc calls a command of the HTTP RPC API with the optional argument, and
+// decodes the JSON response into out, if non-nil.
+//
+// See: https://docs.ipfs.io/reference/http/api/
+func (n *Node) rpc(ctx context.Context, command, arg string, query url.Values, out interface{}) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	if arg != "" {
+		query.Set("arg", arg)
+	}
+	base := n.URL
+	if base == "" {
+		base = "http://127.0.0.1:5001"
+	}
+	// The RPC API only accepts POST requests, to protect from CSRF.
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		strings.TrimSuffix(base, "/")+"/api/v0/"+command+"?"+query.Encode(),
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	resp, err := n.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decoding %s response: %w", command, err)
+	}
+	return nil
+}
+
+// checkResponse maps an unsuccessful RPC response to pup errors. The daemon
+// reports failed commands with HTTP 500 and a JSON message, which are not
+// transient failures.
+func checkResponse(resp *http.Response) error {
+	err := pup.CheckResponse(resp)
+	var httpErr *pup.HTTPError
+	if !errors.As(err, &httpErr) {
+		return err
+	}
+	var body struct{ Message, Type string }
+	if json.Unmarshal([]byte(httpErr.Message), &body) == nil && body.Type == "error" {
+		httpErr.Message = body.Message
+		if httpErr.Err == pup.ErrTransient {
+			httpErr.Err = nil
+		}
+	}
+	if strings.Contains(httpErr.Message, "not pinned") {
+		httpErr.Err = pup.ErrNotFound
+	}
+	return err
+}
+
+func (n *Node) lsRPC(ctx context.Context) ([]pup.Hash, error) {
+	var result struct {
+		Keys map[string]struct{ Type string }
+	}
+	err := n.rpc(ctx, "pin/ls", "", url.Values{"type": {"recursive"}}, &result)
+	if err != nil {
+		return nil, err
+	}
+	var hashes []pup.Hash
+	for h := range result.Keys {
+		hashes = append(hashes, h)
+	}
+	return hashes, nil
+}
+
+func (n *Node) isPinnedRPC(ctx context.Context, hash pup.Hash) (bool, error) {
+	err := n.rpc(ctx, "pin/ls", hash, url.Values{"type": {"recursive"}}, nil)
+	if errors.Is(err, pup.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,96 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package pup
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Jobs tracks pins done in background by pups which first have to retrieve
+// content, e.g. into an IPFS node. Once a job succeeds it is forgotten, as
+// the pup then reports the hash as pinned by itself; a failed job is kept
+// until Check reports it. The zero value is ready to use.
+type Jobs struct {
+	mu   sync.Mutex
+	jobs map[Hash]*job
+}
+
+type job struct {
+	cancel func()
+	err    error // nil while in progress or if succeeded
+	done   bool
+}
+
+// Start runs fn in background for the hash, with a context cancelled after
+// timeout or by Cancel. It does nothing if a job for the hash is already
+// running.
+func (js *Jobs) Start(hash Hash, timeout time.Duration, fn func(ctx context.Context) error) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if j := js.jobs[hash]; j != nil && !j.done {
+		return
+	}
+	if js.jobs == nil {
+		js.jobs = map[Hash]*job{}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	j := &job{cancel: cancel}
+	js.jobs[hash] = j
+	go func() {
+		defer cancel()
+		err := fn(ctx)
+		js.mu.Lock()
+		defer js.mu.Unlock()
+		j.err, j.done = err, true
+		if err == nil && js.jobs[hash] == j {
+			delete(js.jobs, hash)
+		}
+	}()
+}
+
+// Cancel cancels and forgets the hash's job, if any. It reports whether the
+// job was still running, in which case the pup may not know the hash yet.
+func (js *Jobs) Cancel(hash Hash) (pending bool) {
+	js.mu.Lock()
+	j := js.jobs[hash]
+	delete(js.jobs, hash)
+	pending = j != nil && !j.done
+	js.mu.Unlock()
+	if j != nil {
+		j.cancel()
+	}
+	return pending
+}
+
+// Check reports whether the hash's job is still running, or whether it
+// failed. A failure is reported once, and then the job is forgotten, so
+// that the status of the hash comes from the pup again, e.g. after it got
+// pinned by other means.
+func (js *Jobs) Check(hash Hash) (pinning, failed bool) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	j := js.jobs[hash]
+	if j == nil {
+		return false, false
+	}
+	if j.done {
+		delete(js.jobs, hash)
+	}
+	return !j.done, j.err != nil
+}
@@ -0,0 +1,122 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package pup
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// len returns the number of tracked jobs.
+func (js *Jobs) len() int {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	return len(js.jobs)
+}
+
+// waitJob waits until the hash's job is no longer running, and returns
+// whether it failed.
+func waitJob(t *testing.T, js *Jobs, hash Hash) bool {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		pinning, failed := js.Check(hash)
+		if !pinning {
+			return failed
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("job of %s still running", hash)
+	return false
+}
+
+func TestJobs(t *testing.T) {
+	var js Jobs
+	gate := make(chan struct{})
+	runs := make(chan Hash, 10)
+	job := func(hash Hash, err error) func(context.Context) error {
+		return func(ctx context.Context) error {
+			runs <- hash
+			select {
+			case <-gate:
+				return err
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	js.Start("QmA", time.Minute, job("QmA", nil))
+	js.Start("QmA", time.Minute, job("QmA", nil)) // already running
+	js.Start("QmFail", time.Minute, job("QmFail", errors.New("no providers")))
+	if pinning, failed := js.Check("QmA"); !pinning || failed {
+		t.Errorf("Check of running job = %v, %v; want pinning", pinning, failed)
+	}
+	close(gate)
+
+	if waitJob(t, &js, "QmA") {
+		t.Error("successful job reported as failed")
+	}
+	if !waitJob(t, &js, "QmFail") {
+		t.Error("failed job not reported")
+	}
+	// Reported once, then forgotten
+	if pinning, failed := js.Check("QmFail"); pinning || failed {
+		t.Errorf("Check of reported failure = %v, %v; want neither", pinning, failed)
+	}
+	if n := js.len(); n != 0 {
+		t.Errorf("%d jobs tracked after they finished, want 0", n)
+	}
+	if n := len(runs); n != 2 {
+		t.Errorf("jobs ran %d times, want 2", n)
+	}
+	if pinning, failed := js.Check("QmUnknown"); pinning || failed {
+		t.Errorf("Check of unknown hash = %v, %v; want neither", pinning, failed)
+	}
+}
+
+func TestJobsCancel(t *testing.T) {
+	var js Jobs
+	done := make(chan error, 1)
+	js.Start("QmA", time.Minute, func(ctx context.Context) error {
+		<-ctx.Done()
+		done <- ctx.Err()
+		return ctx.Err()
+	})
+	if !js.Cancel("QmA") {
+		t.Error("Cancel of running job didn't report it pending")
+	}
+	if err := <-done; err != context.Canceled {
+		t.Errorf("job ended with %v, want context.Canceled", err)
+	}
+	// The cancelled job is not reported as failed
+	if pinning, failed := js.Check("QmA"); pinning || failed {
+		t.Errorf("Check after Cancel = %v, %v; want neither", pinning, failed)
+	}
+	if js.Cancel("QmA") {
+		t.Error("Cancel of forgotten job reported it pending")
+	}
+
+	js.Start("QmB", time.Millisecond, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if !waitJob(t, &js, "QmB") {
+		t.Error("timed out job not reported as failed")
+	}
+}
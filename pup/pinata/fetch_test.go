@@ -0,0 +1,176 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package pinata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/wpengine/hackathon-catation/pup"
+	"github.com/wpengine/hackathon-catation/pup/puptest"
+)
+
+// pinListServer emulates Pinata's pinList endpoint, serving rows in pages
+// of at most pageSize, and records the queries it received.
+type pinListServer struct {
+	rows     []string // hashes of pinned rows
+	pageSize int
+
+	mu      sync.Mutex
+	queries []map[string]string
+}
+
+func (s *pinListServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/data/pinList" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	s.mu.Lock()
+	s.queries = append(s.queries, map[string]string{
+		"hashContains": q.Get("hashContains"),
+		"pageOffset":   q.Get("pageOffset"),
+	})
+	s.mu.Unlock()
+
+	var matching []string
+	for _, h := range s.rows {
+		if strings.Contains(h, q.Get("hashContains")) {
+			matching = append(matching, h)
+		}
+	}
+	offset, _ := strconv.Atoi(q.Get("pageOffset"))
+	limit, _ := strconv.Atoi(q.Get("pageLimit"))
+	if limit <= 0 || limit > s.pageSize {
+		limit = s.pageSize
+	}
+	type row struct {
+		Hash string `json:"ipfs_pin_hash"`
+	}
+	page := struct {
+		Count int   `json:"count"`
+		Rows  []row `json:"rows"`
+	}{Count: len(matching), Rows: []row{}}
+	for i := offset; i < len(matching) && i < offset+limit; i++ {
+		page.Rows = append(page.Rows, row{Hash: matching[i]})
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+func newPinListServer(t *testing.T, n, pageSize int) (*pinListServer, *API) {
+	s := &pinListServer{pageSize: pageSize}
+	for i := 0; i < n; i++ {
+		s.rows = append(s.rows, fmt.Sprintf("QmHash%03d", i))
+	}
+	api := New("key", "secret")
+	api.BaseURL, api.HTTPClient = puptest.Serve(t, s)
+	return s, api
+}
+
+func fetchedHashes(list []pup.NamedHash) []string {
+	hashes := []string{}
+	for _, h := range list {
+		hashes = append(hashes, h.Hash)
+	}
+	return hashes
+}
+
+func TestFetchPages(t *testing.T) {
+	s, api := newPinListServer(t, 5, 2)
+
+	list, err := api.Fetch(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if got := fetchedHashes(list); !reflect.DeepEqual(got, s.rows) {
+		t.Errorf("Fetch = %v, want %v", got, s.rows)
+	}
+	var offsets []string
+	for _, q := range s.queries {
+		offsets = append(offsets, q["pageOffset"])
+	}
+	if want := []string{"0", "2", "4"}; !reflect.DeepEqual(offsets, want) {
+		t.Errorf("requested offsets %v, want %v", offsets, want)
+	}
+}
+
+func TestFetchEmpty(t *testing.T) {
+	s, api := newPinListServer(t, 0, 2)
+
+	list, err := api.Fetch(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if len(list) != 0 {
+		t.Errorf("Fetch = %v, want empty list", list)
+	}
+	if len(s.queries) != 1 {
+		t.Errorf("made %d requests, want 1", len(s.queries))
+	}
+}
+
+func TestFetchSmallFilter(t *testing.T) {
+	s, api := newPinListServer(t, 5, 2)
+
+	filter := []pup.Hash{"QmHash003", "QmMissing", "QmHash001", "QmHash003"}
+	list, err := api.Fetch(context.Background(), filter)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if got, want := fetchedHashes(list), []string{"QmHash003", "QmHash001"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Fetch = %v, want %v", got, want)
+	}
+	// One query per distinct hash, none walking the full list
+	var contains []string
+	for _, q := range s.queries {
+		contains = append(contains, q["hashContains"])
+	}
+	if want := []string{"QmHash003", "QmMissing", "QmHash001"}; !reflect.DeepEqual(contains, want) {
+		t.Errorf("hashContains queries %v, want %v", contains, want)
+	}
+}
+
+func TestFetchLargeFilter(t *testing.T) {
+	s, api := newPinListServer(t, 30, 7)
+
+	var filter []pup.Hash
+	for i := 0; i < 30; i += 2 {
+		filter = append(filter, fmt.Sprintf("QmHash%03d", i))
+	}
+	list, err := api.Fetch(context.Background(), filter)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if got := fetchedHashes(list); !reflect.DeepEqual(got, filter) {
+		t.Errorf("Fetch = %v, want %v", got, filter)
+	}
+	// The whole list is walked instead of querying each hash
+	for _, q := range s.queries {
+		if q["hashContains"] != "" {
+			t.Errorf("unexpected hashContains query %q", q["hashContains"])
+		}
+	}
+	if len(s.queries) != 5 {
+		t.Errorf("made %d requests, want 5 pages", len(s.queries))
+	}
+}
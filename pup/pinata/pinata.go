@@ -13,68 +13,86 @@
 // You should have received a copy of the GNU General Public License
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
+// Package pinata implements a pup.Pup talking to the Pinata pinning service.
+//
+// See: https://pinata.cloud/documentation
 package pinata
 
 import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/wpengine/hackathon-catation/pup"
 )
 
-// FIXME: unify with cmd/pinner/pinata/
-// FIXME[LATER]: unify with cmd/uploader/pinata/ ?
-
 type API struct {
 	Key, Secret string
+
+	// BaseURL optionally overrides the address of Pinata API; mostly useful
+	// for testing.
+	BaseURL string `json:",omitempty"`
+	// HTTPClient optionally overrides the client used for requests to Pinata.
+	HTTPClient *http.Client `json:"-"`
 }
 
+// defaultHTTPClient is shared by all API values without an explicit
+// HTTPClient, so that together they keep below Pinata's rate limits.
+var defaultHTTPClient = pup.NewHTTPClient(4)
+
 func New(key, secret string) *API {
 	return &API{Key: key, Secret: secret}
 }
 
-func (api *API) Fetch(ctx context.Context, filter []pup.Hash) ([]pup.NamedHash, error) {
-	// TODO: use some metadata, otherwise this func is very ineffective and currently limited to 1000 pins (TODO: first, check if they didn't publish some newer API)
-
-	req, err := http.NewRequestWithContext(
-		ctx,
-		http.MethodGet,
-		"https://api.pinata.cloud/data/pinList?status=pinned",
-		nil,
-	)
-	if err != nil {
-		// Logic bug, should never happen
-		panic(fmt.Errorf("pinata: building fetch request: %w", err))
+func (api *API) endpoint(path string) string {
+	base := api.BaseURL
+	if base == "" {
+		base = "https://api.pinata.cloud"
 	}
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("pinata_api_key", api.Key)
-	req.Header.Add("pinata_secret_api_key", api.Secret)
+	return strings.TrimSuffix(base, "/") + path
+}
 
-	// execute the request
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("pinata: fetching: %w", err)
+func (api *API) httpClient() *http.Client {
+	if api.HTTPClient != nil {
+		return api.HTTPClient
 	}
-	defer resp.Body.Close()
+	return defaultHTTPClient
+}
 
-	// resp.Body = ioutil.NopCloser(io.TeeReader(resp.Body, os.Stderr))
-	// FIXME: if response is failed because e.g. missing API keys, return meaningful error instead of empty + nil
+// pageLimit is the maximum number of rows Pinata returns in a single pinList
+// response.
+const pageLimit = 1000
 
-	// parse response
-	var rows struct {
-		Rows []struct {
-			Hash     string `json:"ipfs_pin_hash"`
-			Size     int64
-			Metadata struct {
-				Name string
-			}
+// maxFilterQueries is the maximum number of hashes in a Fetch filter for which
+// we query Pinata with a separate hashContains request per hash. For longer
+// filters, it is cheaper to walk the full pin list and filter locally.
+const maxFilterQueries = 10
+
+func (api *API) Fetch(ctx context.Context, filter []pup.Hash) ([]pup.NamedHash, error) {
+	return api.FetchMatching(ctx, filter, nil)
+}
+
+// FetchMatching works like Fetch, but additionally returns only pins with
+// metadata containing all the keyvalues.
+func (api *API) FetchMatching(ctx context.Context, filter []pup.Hash, keyvalues map[string]string) ([]pup.NamedHash, error) {
+	base := url.Values{}
+	if len(keyvalues) > 0 {
+		query := map[string]interface{}{}
+		for k, v := range keyvalues {
+			query[k] = map[string]string{"value": v, "op": "eq"}
 		}
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&rows); err != nil {
-		return nil, fmt.Errorf("pinata: decoding fetched response: %w", err)
+		buf, err := json.Marshal(query)
+		if err != nil {
+			// Logic bug, should never happen
+			return nil, err
+		}
+		base.Set("metadata[keyvalues]", string(buf))
 	}
 
 	// Prepare filter
@@ -86,10 +104,16 @@ func (api *API) Fetch(ctx context.Context, filter []pup.Hash) ([]pup.NamedHash,
 		m = nil
 	}
 
-	// Convert to output format & filter hashes if needed
+	// Collect rows, either asking Pinata for each filtered hash separately,
+	// or walking the whole list of pins.
 	list := []pup.NamedHash{}
-	for _, row := range rows.Rows {
-		if m == nil || m[row.Hash] {
+	seen := map[string]bool{}
+	collect := func(rows []pinListRow) {
+		for _, row := range rows {
+			if seen[row.Hash] || (m != nil && !m[row.Hash]) {
+				continue
+			}
+			seen[row.Hash] = true
 			list = append(list, pup.NamedHash{
 				Hash: row.Hash,
 				Name: row.Metadata.Name,
@@ -97,41 +121,227 @@ func (api *API) Fetch(ctx context.Context, filter []pup.Hash) ([]pup.NamedHash,
 			})
 		}
 	}
+	if m != nil && len(m) <= maxFilterQueries {
+		queried := map[string]bool{}
+		for _, h := range filter {
+			if queried[h] {
+				continue
+			}
+			queried[h] = true
+			query := cloneValues(base)
+			query.Set("hashContains", h)
+			err := api.walkPinList(ctx, query, collect)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	}
+	err := api.walkPinList(ctx, base, collect)
+	if err != nil {
+		return nil, err
+	}
 	return list, nil
 }
 
+func cloneValues(v url.Values) url.Values {
+	clone := url.Values{}
+	for k, vs := range v {
+		clone[k] = append([]string(nil), vs...)
+	}
+	return clone
+}
+
+type pinListRow struct {
+	Hash     string `json:"ipfs_pin_hash"`
+	Size     int64
+	Metadata struct {
+		Name string
+	}
+}
+
+// walkPinList calls fn with consecutive pages of pinned rows matching query,
+// until all pages are exhausted.
+func (api *API) walkPinList(ctx context.Context, query url.Values, fn func([]pinListRow)) error {
+	query.Set("status", "pinned")
+	query.Set("pageLimit", strconv.Itoa(pageLimit))
+	for offset := 0; ; {
+		query.Set("pageOffset", strconv.Itoa(offset))
+		page, err := api.fetchPinList(ctx, query)
+		if err != nil {
+			return err
+		}
+		fn(page.Rows)
+		offset += len(page.Rows)
+		if len(page.Rows) == 0 || offset >= page.Count {
+			return nil
+		}
+	}
+}
+
+type pinListPage struct {
+	Count int
+	Rows  []pinListRow
+}
+
+func (api *API) fetchPinList(ctx context.Context, query url.Values) (*pinListPage, error) {
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodGet,
+		api.endpoint("/data/pinList")+"?"+query.Encode(),
+		nil,
+	)
+	if err != nil {
+		// Logic bug, should never happen
+		panic(fmt.Errorf("pinata: building fetch request: %w", err))
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("pinata_api_key", api.Key)
+	req.Header.Add("pinata_secret_api_key", api.Secret)
+
+	// execute the request
+	resp, err := api.httpClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("pinata: fetching: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return nil, fmt.Errorf("pinata: fetching: %w", err)
+	}
+
+	// parse response
+	var page pinListPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, fmt.Errorf("pinata: decoding fetched response: %w", err)
+	}
+	return &page, nil
+}
+
 func (api *API) Pin(ctx context.Context, hash pup.Hash) error {
-	payload, err := json.Marshal(map[string]string{
-		"hashToPin": hash,
-	})
+	return api.PinWithOptions(ctx, hash, pup.PinOptions{})
+}
+
+// pinataMetadata is the metadata of a pin, in the format used by Pinata.
+type pinataMetadata struct {
+	Name      string            `json:"name,omitempty"`
+	KeyValues map[string]string `json:"keyvalues,omitempty"`
+}
+
+type pinataOptions struct {
+	HostNodes []string `json:"hostNodes"`
+}
+
+// PinWithOptions pins the hash with pinataMetadata built from the name and
+// key-values of opts. Origins are passed to Pinata as host nodes, which it
+// connects to directly when looking for the content.
+func (api *API) PinWithOptions(ctx context.Context, hash pup.Hash, opts pup.PinOptions) error {
+	_, err := api.PinByHash(ctx, hash, opts)
+	return err
+}
+
+// PinResponse describes a pin job queued by Pinata.
+type PinResponse struct {
+	ID       string `json:"id"`
+	IPFSHash string `json:"ipfsHash"`
+	Status   string `json:"status"`
+	Name     string `json:"name"`
+}
+
+// PinByHash works like PinWithOptions, additionally returning the pin job
+// created by Pinata.
+func (api *API) PinByHash(ctx context.Context, hash pup.Hash, opts pup.PinOptions) (*PinResponse, error) {
+	body := struct {
+		HashToPin string          `json:"hashToPin"`
+		Metadata  *pinataMetadata `json:"pinataMetadata,omitempty"`
+		Options   *pinataOptions  `json:"pinataOptions,omitempty"`
+	}{HashToPin: hash}
+	if opts.Name != "" || len(opts.KeyValues) > 0 {
+		body.Metadata = &pinataMetadata{Name: opts.Name, KeyValues: opts.KeyValues}
+	}
+	if len(opts.Origins) > 0 {
+		body.Options = &pinataOptions{HostNodes: opts.Origins}
+	}
+	payload, err := json.Marshal(body)
 	if err != nil {
 		// Logic bug, should never happen
-		return err
+		return nil, err
 	}
 
 	req, err := http.NewRequestWithContext(
 		ctx,
 		http.MethodPost,
-		"https://api.pinata.cloud/pinning/pinByHash",
+		api.endpoint("/pinning/pinByHash"),
 		bytes.NewReader(payload),
 	)
 	if err != nil {
-		return fmt.Errorf("pinata: adding hash %q: %w", hash, err)
+		return nil, fmt.Errorf("pinata: adding hash %q: %w", hash, err)
 	}
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("pinata_api_key", api.Key)
 	req.Header.Add("pinata_secret_api_key", api.Secret)
 
 	// execute the request
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := api.httpClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("pinata: adding hash %q: %w", hash, err)
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return nil, fmt.Errorf("pinata: adding hash %q: %w", hash, err)
+	}
+
+	var r PinResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("pinata: adding hash %q: decoding response: %w", hash, err)
+	}
+	return &r, nil
+}
+
+// IsPinned reports whether the hash is already pinned by Pinata.
+func (api *API) IsPinned(ctx context.Context, hash pup.Hash) (bool, error) {
+	pinned, err := api.Fetch(ctx, []pup.Hash{hash})
+	if err != nil {
+		return false, err
+	}
+	return len(pinned) > 0, nil
+}
+
+// UpdateMetadata sets the name and key-values of an already pinned hash.
+// Pinata merges the key-values with existing ones, so keys missing from md
+// are kept.
+func (api *API) UpdateMetadata(ctx context.Context, hash pup.Hash, md pup.Metadata) error {
+	payload, err := json.Marshal(struct {
+		Hash string `json:"ipfsPinHash"`
+		pinataMetadata
+	}{hash, pinataMetadata{Name: md.Name, KeyValues: md.KeyValues}})
+	if err != nil {
+		// Logic bug, should never happen
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPut,
+		api.endpoint("/pinning/hashMetadata"),
+		bytes.NewReader(payload),
+	)
 	if err != nil {
-		return fmt.Errorf("pinata: adding hash %q: %w", hash, err)
+		return fmt.Errorf("pinata: updating metadata of %q: %w", hash, err)
 	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("pinata_api_key", api.Key)
+	req.Header.Add("pinata_secret_api_key", api.Secret)
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("pinata: pin call returned HTTP code %d", resp.StatusCode)
+	resp, err := api.httpClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("pinata: updating metadata of %q: %w", hash, err)
 	}
+	defer resp.Body.Close()
 
+	if err := checkResponse(resp); err != nil {
+		return fmt.Errorf("pinata: updating metadata of %q: %w", hash, err)
+	}
 	return nil
 }
 
@@ -139,7 +349,7 @@ func (api *API) Unpin(ctx context.Context, hash pup.Hash) error {
 	req, err := http.NewRequestWithContext(
 		ctx,
 		http.MethodDelete,
-		fmt.Sprintf("https://api.pinata.cloud/pinning/unpin/%s", hash),
+		api.endpoint("/pinning/unpin/"+hash),
 		nil,
 	)
 	if err != nil {
@@ -149,60 +359,142 @@ func (api *API) Unpin(ctx context.Context, hash pup.Hash) error {
 	req.Header.Add("pinata_api_key", api.Key)
 	req.Header.Add("pinata_secret_api_key", api.Secret)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := api.httpClient().Do(req)
 	if err != nil {
 		return fmt.Errorf("pinata: removing hash %q: %w", hash, err)
 	}
+	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("pinata: unpin call returned HTTP code %d", resp.StatusCode)
+	if err := checkResponse(resp); err != nil {
+		return fmt.Errorf("pinata: removing hash %q: %w", hash, err)
 	}
 
 	return nil
 }
 
-/*
-func (api *API) isPinned(ctx context.Context, hash string) (bool, error) {
-	// TODO: use some metadata, otherwise this is very ineffective and currently limited to 1000 pins
-
+// Status checks Pinata's queue of pin jobs for the hash, and if it's not
+// there, the list of pinned hashes.
+func (api *API) Status(ctx context.Context, hash pup.Hash) (pup.PinStatus, error) {
 	req, err := http.NewRequestWithContext(
 		ctx,
 		http.MethodGet,
-		"https://api.pinata.cloud/data/pinList?status=pinned",
+		api.endpoint("/pinning/pinJobs")+"?"+url.Values{"ipfs_pin_hash": {hash}}.Encode(),
 		nil,
 	)
 	if err != nil {
-		return false, fmt.Errorf("pinata: querying hash %q: %w", hash, err)
+		return "", fmt.Errorf("pinata: checking status of %q: %w", hash, err)
 	}
-	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("pinata_api_key", api.Key)
 	req.Header.Add("pinata_secret_api_key", api.Secret)
 
-	// execute the request
-	c := &http.Client{Timeout: 10 * time.Second}
-	resp, err := c.Do(req)
+	resp, err := api.httpClient().Do(req)
 	if err != nil {
-		return false, fmt.Errorf("pinata: querying hash %q: %w", hash, err)
+		return "", fmt.Errorf("pinata: checking status of %q: %w", hash, err)
 	}
 	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return "", fmt.Errorf("pinata: checking status of %q: %w", hash, err)
+	}
 
-	// FIXME: if response is failed because e.g. missing API keys, return meaningful error instead of empty + nil
-
-	// parse response
-	var r struct {
+	var jobs struct {
 		Rows []struct {
-			IPFSPinHash string `json:"ipfs_pin_hash"`
+			Hash   string `json:"ipfs_pin_hash"`
+			Status string
 		}
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
-		return false, fmt.Errorf("pinata: querying hash %q: decoding response: %w", hash, err)
+	if err := json.NewDecoder(resp.Body).Decode(&jobs); err != nil {
+		return "", fmt.Errorf("pinata: checking status of %q: decoding response: %w", hash, err)
 	}
+	for _, job := range jobs.Rows {
+		if job.Hash == hash {
+			return jobStatus(job.Status), nil
+		}
+	}
+
+	// Not in the queue - either already pinned, or unknown.
+	pinned, err := api.Fetch(ctx, []pup.Hash{hash})
+	if err != nil {
+		return "", err
+	}
+	if len(pinned) > 0 {
+		return pup.StatusPinned, nil
+	}
+	return pup.StatusUnpinned, nil
+}
+
+// jobStatus maps status of a Pinata pin job to pup.PinStatus.
+func jobStatus(s string) pup.PinStatus {
+	switch s {
+	case "prechecking":
+		return pup.StatusQueued
+	case "searching":
+		return pup.StatusSearching
+	case "retrieving":
+		return pup.StatusPinning
+	default:
+		// expired, over_free_limit, over_max_size, invalid_object, bad_host_node
+		return pup.StatusFailed
+	}
+}
 
-	for _, row := range r.Rows {
-		if row.IPFSPinHash == hash {
-			return true, nil
+// reasonErrors maps reason codes from Pinata's documented error responses,
+// {"error":{"reason":"...","details":"..."}}, to pup errors.
+var reasonErrors = map[string]error{
+	"INVALID_API_KEYS":      pup.ErrUnauthorized,
+	"INVALID_CREDENTIALS":   pup.ErrUnauthorized,
+	"KEY_REVOKED":           pup.ErrUnauthorized,
+	"NO_SCOPES_FOUND":       pup.ErrUnauthorized,
+	"PAYMENT_REQUIRED":      pup.ErrQuotaExceeded,
+	"OVER_FREE_LIMIT":       pup.ErrQuotaExceeded,
+	"OVER_MAX_SIZE":         pup.ErrQuotaExceeded,
+	"PIN_LIMIT_REACHED":     pup.ErrQuotaExceeded,
+	"STORAGE_LIMIT_REACHED": pup.ErrQuotaExceeded,
+	"NOT_FOUND":             pup.ErrNotFound,
+}
+
+// checkResponse maps an unsuccessful Pinata response to pup errors. Pinata
+// doesn't use dedicated HTTP codes for some conditions, so we also have to
+// look at the reason code or message.
+func checkResponse(resp *http.Response) error {
+	err := pup.CheckResponse(resp)
+	var httpErr *pup.HTTPError
+	if errors.As(err, &httpErr) && httpErr.Err == nil {
+		msg := strings.ToLower(httpErr.Message)
+		reason := strings.SplitN(httpErr.Message, ":", 2)[0]
+		switch {
+		case reasonErrors[reason] != nil:
+			httpErr.Err = reasonErrors[reason]
+		case strings.Contains(msg, "not pinned"), strings.Contains(msg, "not found"):
+			httpErr.Err = pup.ErrNotFound
+		case strings.Contains(msg, "api key"), strings.Contains(msg, "authentication"):
+			httpErr.Err = pup.ErrUnauthorized
 		}
 	}
-	return false, nil
+	return err
+}
+
+// TestAuthentication checks that Pinata accepts the API keys.
+func (api *API) TestAuthentication(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodGet,
+		api.endpoint("/data/testAuthentication"),
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("pinata: testing authentication: %w", err)
+	}
+	req.Header.Add("pinata_api_key", api.Key)
+	req.Header.Add("pinata_secret_api_key", api.Secret)
+
+	resp, err := api.httpClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("pinata: testing authentication: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return fmt.Errorf("pinata: testing authentication: %w", err)
+	}
+	return nil
 }
-*/
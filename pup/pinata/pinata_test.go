@@ -0,0 +1,464 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package pinata
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	files "github.com/ipfs/go-ipfs-files"
+
+	"github.com/wpengine/hackathon-catation/pup"
+	"github.com/wpengine/hackathon-catation/pup/puptest"
+)
+
+// fakePinata emulates the subset of Pinata API used by API, keeping pins in
+// memory. Pinned hashes show up in pinJobs as "retrieving" once, before
+// they appear in pinList.
+type fakePinata struct {
+	t *testing.T
+
+	mu       sync.Mutex
+	pins     []fakePin // in order of pinning
+	jobs     map[string]bool
+	uploads  map[string][]string // uploaded file paths, by name
+	pageSize int
+	limit    int // max number of pins; 0 means unlimited
+}
+
+type fakePin struct {
+	Hash      string
+	Name      string
+	KeyValues map[string]string
+	HostNodes []string
+}
+
+func newFakePinata(t *testing.T) (*fakePinata, *API) {
+	f := &fakePinata{
+		t:        t,
+		jobs:     map[string]bool{},
+		uploads:  map[string][]string{},
+		pageSize: pageLimit,
+	}
+	api := New("key", "secret")
+	api.BaseURL, api.HTTPClient = puptest.Serve(t, f)
+	return f, api
+}
+
+func (f *fakePinata) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("pinata_api_key") != "key" || r.Header.Get("pinata_secret_api_key") != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error":"Invalid API key provided"}`)
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/data/testAuthentication":
+		fmt.Fprint(w, `{"message":"Congratulations! You are communicating with the Pinata API!"}`)
+	case r.Method == "POST" && r.URL.Path == "/pinning/pinByHash":
+		f.pinByHash(w, r)
+	case r.Method == "GET" && r.URL.Path == "/data/pinList":
+		f.pinList(w, r)
+	case r.Method == "GET" && r.URL.Path == "/pinning/pinJobs":
+		f.pinJobs(w, r)
+	case r.Method == "PUT" && r.URL.Path == "/pinning/hashMetadata":
+		f.hashMetadata(w, r)
+	case r.Method == "POST" && r.URL.Path == "/pinning/pinFileToIPFS":
+		f.pinFile(w, r)
+	case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/pinning/unpin/"):
+		f.unpin(w, strings.TrimPrefix(r.URL.Path, "/pinning/unpin/"))
+	default:
+		f.t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakePinata) pinByHash(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		HashToPin      string
+		PinataMetadata struct {
+			Name      string
+			KeyValues map[string]string
+		}
+		PinataOptions struct {
+			HostNodes []string
+		}
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		f.t.Errorf("decoding pinByHash body: %v", err)
+	}
+	if f.limit > 0 && len(f.pins) >= f.limit {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":{"reason":"PIN_LIMIT_REACHED","details":"Pin limit reached for your plan"}}`)
+		return
+	}
+	f.pins = append(f.pins, fakePin{
+		Hash:      body.HashToPin,
+		Name:      body.PinataMetadata.Name,
+		KeyValues: body.PinataMetadata.KeyValues,
+		HostNodes: body.PinataOptions.HostNodes,
+	})
+	f.jobs[body.HashToPin] = true
+	json.NewEncoder(w).Encode(PinResponse{
+		ID:       "job-" + body.HashToPin,
+		IPFSHash: body.HashToPin,
+		Status:   "prechecking",
+		Name:     body.PinataMetadata.Name,
+	})
+}
+
+func (f *fakePinata) pinList(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("status") != "pinned" {
+		f.t.Errorf("pinList without status=pinned: %s", r.URL)
+	}
+	var keyvalues map[string]struct{ Value, Op string }
+	if kv := q.Get("metadata[keyvalues]"); kv != "" {
+		if err := json.Unmarshal([]byte(kv), &keyvalues); err != nil {
+			f.t.Errorf("decoding keyvalues query: %v", err)
+		}
+	}
+
+	var matching []fakePin
+pins:
+	for _, p := range f.pins {
+		if f.jobs[p.Hash] || !strings.Contains(p.Hash, q.Get("hashContains")) {
+			continue
+		}
+		for k, v := range keyvalues {
+			if v.Op != "eq" || p.KeyValues[k] != v.Value {
+				continue pins
+			}
+		}
+		matching = append(matching, p)
+	}
+
+	offset, _ := strconv.Atoi(q.Get("pageOffset"))
+	limit, _ := strconv.Atoi(q.Get("pageLimit"))
+	if limit > f.pageSize {
+		limit = f.pageSize
+	}
+	page := pinListPage{Count: len(matching)}
+	for i := offset; i < len(matching) && i < offset+limit; i++ {
+		row := pinListRow{Hash: matching[i].Hash, Size: int64(len(matching[i].Hash))}
+		row.Metadata.Name = matching[i].Name
+		page.Rows = append(page.Rows, row)
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+func (f *fakePinata) pinJobs(w http.ResponseWriter, r *http.Request) {
+	hash := r.URL.Query().Get("ipfs_pin_hash")
+	var jobs struct {
+		Rows []map[string]string `json:"rows"`
+	}
+	if f.jobs[hash] {
+		jobs.Rows = append(jobs.Rows, map[string]string{"ipfs_pin_hash": hash, "status": "retrieving"})
+		delete(f.jobs, hash)
+	}
+	json.NewEncoder(w).Encode(jobs)
+}
+
+func (f *fakePinata) hashMetadata(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		IpfsPinHash string
+		Name        string
+		KeyValues   map[string]string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		f.t.Errorf("decoding hashMetadata body: %v", err)
+	}
+	for i, p := range f.pins {
+		if p.Hash != body.IpfsPinHash {
+			continue
+		}
+		if body.Name != "" {
+			f.pins[i].Name = body.Name
+		}
+		if f.pins[i].KeyValues == nil {
+			f.pins[i].KeyValues = map[string]string{}
+		}
+		for k, v := range body.KeyValues {
+			f.pins[i].KeyValues[k] = v
+		}
+		fmt.Fprint(w, "OK")
+		return
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprint(w, `{"error":"Hash is not pinned"}`)
+}
+
+func (f *fakePinata) pinFile(w http.ResponseWriter, r *http.Request) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		f.t.Errorf("reading pinFileToIPFS body: %v", err)
+		return
+	}
+	var md pinataMetadata
+	var paths []string
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		buf, _ := ioutil.ReadAll(part)
+		if part.FormName() == "pinataMetadata" {
+			json.Unmarshal(buf, &md)
+			continue
+		}
+		// FileName strips directories, so check the raw header
+		_, params, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		paths = append(paths, params["filename"]+"="+string(buf))
+	}
+	sort.Strings(paths)
+	f.uploads[md.Name] = paths
+	hash := "QmUpload" + md.Name
+	f.pins = append(f.pins, fakePin{Hash: hash, Name: md.Name})
+	fmt.Fprintf(w, `{"IpfsHash":%q,"PinSize":1,"Timestamp":"2020-11-18T11:02:23Z"}`, hash)
+}
+
+func (f *fakePinata) unpin(w http.ResponseWriter, hash string) {
+	for i, p := range f.pins {
+		if p.Hash == hash {
+			f.pins = append(f.pins[:i], f.pins[i+1:]...)
+			fmt.Fprint(w, "OK")
+			return
+		}
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprint(w, `{"error":"The current user has not pinned the cid: `+hash+`"}`)
+}
+
+func hashes(list []pup.NamedHash) []string {
+	var hs []string
+	for _, h := range list {
+		hs = append(hs, h.Hash)
+	}
+	sort.Strings(hs)
+	return hs
+}
+
+func TestPinFetchUnpin(t *testing.T) {
+	f, api := newFakePinata(t)
+	ctx := context.Background()
+
+	for _, h := range []string{"QmA", "QmB", "QmC"} {
+		if err := api.Pin(ctx, h); err != nil {
+			t.Fatalf("Pin(%s): %v", h, err)
+		}
+	}
+	f.jobs = map[string]bool{}
+
+	all, err := api.Fetch(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := hashes(all), []string{"QmA", "QmB", "QmC"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Fetch(nil) = %v, want %v", got, want)
+	}
+
+	filtered, err := api.Fetch(ctx, []pup.Hash{"QmB", "QmX"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := hashes(filtered), []string{"QmB"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Fetch(QmB, QmX) = %v, want %v", got, want)
+	}
+
+	if err := api.Unpin(ctx, "QmB"); err != nil {
+		t.Fatal(err)
+	}
+	if pinned, err := api.IsPinned(ctx, "QmB"); err != nil || pinned {
+		t.Errorf("IsPinned(QmB) after Unpin = %v, %v; want false", pinned, err)
+	}
+	err = api.Unpin(ctx, "QmB")
+	if !errors.Is(err, pup.ErrNotFound) {
+		t.Errorf("second Unpin(QmB) = %v, want ErrNotFound", err)
+	}
+}
+
+func TestPinWithOptionsAndMetadata(t *testing.T) {
+	f, api := newFakePinata(t)
+	ctx := context.Background()
+
+	resp, err := api.PinByHash(ctx, "QmA", pup.PinOptions{
+		Metadata: pup.Metadata{Name: "cats", KeyValues: map[string]string{"album": "QmRoot"}},
+		Origins:  []string{"/ip4/10.0.0.1/tcp/4001/p2p/QmPeer"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.IPFSHash != "QmA" || resp.Name != "cats" {
+		t.Errorf("PinByHash response = %+v", resp)
+	}
+	if err := api.Pin(ctx, "QmB"); err != nil {
+		t.Fatal(err)
+	}
+	f.jobs = map[string]bool{}
+
+	want := fakePin{
+		Hash:      "QmA",
+		Name:      "cats",
+		KeyValues: map[string]string{"album": "QmRoot"},
+		HostNodes: []string{"/ip4/10.0.0.1/tcp/4001/p2p/QmPeer"},
+	}
+	if !reflect.DeepEqual(f.pins[0], want) {
+		t.Errorf("pinned %+v, want %+v", f.pins[0], want)
+	}
+
+	err = api.UpdateMetadata(ctx, "QmB", pup.Metadata{Name: "dogs", KeyValues: map[string]string{"album": "QmRoot"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := api.FetchMatching(ctx, nil, map[string]string{"album": "QmRoot"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := hashes(list), []string{"QmA", "QmB"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FetchMatching(album) = %v, want %v", got, want)
+	}
+	for _, h := range list {
+		if h.Hash == "QmB" && h.Name != "dogs" {
+			t.Errorf("name of QmB = %q, want %q", h.Name, "dogs")
+		}
+	}
+	list, err = api.FetchMatching(ctx, nil, map[string]string{"album": "QmOther"})
+	if err != nil || len(list) != 0 {
+		t.Errorf("FetchMatching(other album) = %v, %v; want none", list, err)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	_, api := newFakePinata(t)
+	ctx := context.Background()
+
+	if err := api.Pin(ctx, "QmA"); err != nil {
+		t.Fatal(err)
+	}
+	var seen []pup.PinStatus
+	status, err := pup.WaitPinned(ctx, api, "QmA", func(s pup.PinStatus) {
+		seen = append(seen, s)
+	})
+	if err != nil || status != pup.StatusPinned {
+		t.Fatalf("WaitPinned = %v, %v", status, err)
+	}
+	if want := []pup.PinStatus{pup.StatusPinning, pup.StatusPinned}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("seen statuses %v, want %v", seen, want)
+	}
+
+	status, err = api.Status(ctx, "QmUnknown")
+	if err != nil || status != pup.StatusUnpinned {
+		t.Errorf("Status(unknown) = %v, %v; want unpinned", status, err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	f, api := newFakePinata(t)
+	ctx := context.Background()
+
+	if err := api.TestAuthentication(ctx); err != nil {
+		t.Errorf("TestAuthentication: %v", err)
+	}
+
+	bad := *api
+	bad.Secret = "wrong"
+	if err := bad.TestAuthentication(ctx); !errors.Is(err, pup.ErrUnauthorized) {
+		t.Errorf("TestAuthentication with bad secret = %v, want ErrUnauthorized", err)
+	}
+	if _, err := bad.Fetch(ctx, nil); !errors.Is(err, pup.ErrUnauthorized) {
+		t.Errorf("Fetch with bad secret = %v, want ErrUnauthorized", err)
+	}
+
+	f.limit = 1
+	if err := api.Pin(ctx, "QmA"); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.Pin(ctx, "QmB"); !errors.Is(err, pup.ErrQuotaExceeded) {
+		t.Errorf("Pin over limit = %v, want ErrQuotaExceeded", err)
+	}
+
+	if err := api.UpdateMetadata(ctx, "QmX", pup.Metadata{Name: "x"}); !errors.Is(err, pup.ErrNotFound) {
+		t.Errorf("UpdateMetadata(unpinned) = %v, want ErrNotFound", err)
+	}
+}
+
+func TestAdd(t *testing.T) {
+	f, api := newFakePinata(t)
+	var _ pup.Uploader = api
+
+	hash, err := api.Add(context.Background(), "album", files.NewMapDirectory(map[string]files.Node{
+		"index.html": files.NewBytesFile([]byte("<html>")),
+		"images": files.NewMapDirectory(map[string]files.Node{
+			"cat.jpg": files.NewBytesFile([]byte("meow")),
+		}),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != "QmUploadalbum" {
+		t.Errorf("Add = %q, want %q", hash, "QmUploadalbum")
+	}
+	want := []string{"album/images/cat.jpg=meow", "album/index.html=<html>"}
+	if got := f.uploads["album"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("uploaded %q, want %q", got, want)
+	}
+}
+
+func TestCheckResponse(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		want   error
+	}{
+		{400, `{"error":{"reason":"PIN_LIMIT_REACHED","details":"Upgrade your plan"}}`, pup.ErrQuotaExceeded},
+		{400, `{"error":{"reason":"KEY_REVOKED","details":"Key has been revoked"}}`, pup.ErrUnauthorized},
+		{400, `{"error":"Current user has not pinned the provided hash"}`, pup.ErrNotFound},
+		{400, `{"error":"Invalid API key provided"}`, pup.ErrUnauthorized},
+		// Only reason codes are trusted to mean exceeded quotas
+		{400, `{"error":"pageLimit must be at most 1000"}`, nil},
+		{400, `{"error":{"reason":"INVALID_LIMIT","details":"limit"}}`, nil},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{
+			StatusCode: tt.status,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader(tt.body)),
+		}
+		err := checkResponse(resp)
+		var httpErr *pup.HTTPError
+		if !errors.As(err, &httpErr) {
+			t.Errorf("checkResponse(%s) = %v, want HTTPError", tt.body, err)
+			continue
+		}
+		if httpErr.Err != tt.want {
+			t.Errorf("checkResponse(%s) = %v, want %v", tt.body, httpErr.Err, tt.want)
+		}
+	}
+}
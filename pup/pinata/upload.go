@@ -0,0 +1,103 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package pinata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path"
+
+	files "github.com/ipfs/go-ipfs-files"
+
+	"github.com/wpengine/hackathon-catation/pup"
+)
+
+// Add uploads the file or directory to Pinata with pinFileToIPFS, and
+// returns its hash. The content is streamed, so it's not kept in memory.
+func (api *API) Add(ctx context.Context, name string, node files.Node) (pup.Hash, error) {
+	body, w := io.Pipe()
+	mw := multipart.NewWriter(w)
+	go func() {
+		w.CloseWithError(writeUpload(mw, name, node))
+	}()
+	defer body.Close()
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		api.endpoint("/pinning/pinFileToIPFS"),
+		body,
+	)
+	if err != nil {
+		return "", fmt.Errorf("pinata: uploading %q: %w", name, err)
+	}
+	req.Header.Add("Content-Type", mw.FormDataContentType())
+	req.Header.Add("pinata_api_key", api.Key)
+	req.Header.Add("pinata_secret_api_key", api.Secret)
+
+	resp, err := api.httpClient().Do(req)
+	if err != nil {
+		return "", fmt.Errorf("pinata: uploading %q: %w", name, err)
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return "", fmt.Errorf("pinata: uploading %q: %w", name, err)
+	}
+
+	var result struct {
+		IpfsHash string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("pinata: decoding upload response: %w", err)
+	}
+	return result.IpfsHash, nil
+}
+
+// writeUpload writes the multipart form expected by pinFileToIPFS. Pinata
+// recognizes a directory by all files having paths starting with the same
+// directory name.
+func writeUpload(mw *multipart.Writer, name string, node files.Node) error {
+	md, err := json.Marshal(map[string]string{"name": name})
+	if err != nil {
+		return err
+	}
+	if err := mw.WriteField("pinataMetadata", string(md)); err != nil {
+		return err
+	}
+
+	err = files.Walk(node, func(fpath string, nd files.Node) error {
+		f, ok := nd.(files.File)
+		if !ok {
+			// directories are implied by paths of files
+			return nil
+		}
+		part, err := mw.CreateFormFile("file", path.Join(name, fpath))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(part, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return mw.Close()
+}
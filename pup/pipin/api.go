@@ -16,71 +16,155 @@
 package pipin
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
+	"strings"
+
+	files "github.com/ipfs/go-ipfs-files"
 
 	"github.com/wpengine/hackathon-catation/pup"
 )
 
 type Client struct {
-	UseTLS bool
-	Host   string // TODO(akavel): replace this + above with BaseURL ?
-	Token  string
+	// BaseURL of the PiPin API, e.g. https://raspberrypi.local:9229, or
+	// https://example.com/pipin behind a reverse proxy, or
+	// unix:///run/pipin.sock for a Unix socket.
+	BaseURL string
+	Token   string
+	// Fingerprint is an optional SHA-256 fingerprint of PiPin's TLS
+	// certificate, as printed by PiPin on start. If set, only a certificate
+	// with this fingerprint is accepted, even if self-signed.
+	Fingerprint string
+	// Headers are optionally added to all requests, e.g. for authentication
+	// with a reverse proxy.
+	Headers map[string]string `json:",omitempty"`
+	// HTTPClient optionally overrides the client used for requests to PiPin.
+	// Fingerprint and Unix sockets are not supported if it's set.
+	HTTPClient *http.Client `json:"-"`
 }
 
-func New(useTLS bool, host, token string) *Client {
+// defaultHTTPClient is shared by all Client values without an explicit
+// HTTPClient. A Raspberry Pi doesn't like too many requests at once.
+var defaultHTTPClient = pup.NewHTTPClient(2)
+
+func New(baseURL, token string) *Client {
 	return &Client{
-		UseTLS: useTLS,
-		Host:   host,
-		Token:  token,
+		BaseURL: baseURL,
+		Token:   token,
 	}
 }
 
-func (c *Client) endpoint(path string, args ...interface{}) *url.URL {
-	scheme := "http"
-	if c.UseTLS {
-		scheme = "https"
+// UnmarshalJSON decodes the Client, also accepting the UseTLS and Host
+// fields used by older configs instead of BaseURL.
+func (c *Client) UnmarshalJSON(buf []byte) error {
+	type client Client // without the UnmarshalJSON method
+	var v struct {
+		client
+		UseTLS bool
+		Host   string
 	}
-
-	return &url.URL{
-		Scheme: scheme,
-		Host:   c.Host,
-		Path:   fmt.Sprintf(path, args...),
+	if err := json.Unmarshal(buf, &v); err != nil {
+		return err
 	}
+	*c = Client(v.client)
+	if c.BaseURL == "" && v.Host != "" {
+		scheme := "http"
+		if v.UseTLS {
+			scheme = "https"
+		}
+		c.BaseURL = scheme + "://" + v.Host
+	}
+	return nil
 }
 
-func (c *Client) Fetch(ctx context.Context, filter []pup.Hash) ([]pup.NamedHash, error) {
-	req, err := http.NewRequestWithContext(
-		ctx,
-		http.MethodGet,
-		c.endpoint("pins").String(),
-		nil,
-	)
+// newRequest creates an authenticated request to the API endpoint at the
+// path, formatted with args.
+func (c *Client) newRequest(ctx context.Context, method string, body io.Reader, path string, args ...interface{}) (*http.Request, error) {
+	u, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PiPin URL: %w", err)
+	}
+	path = fmt.Sprintf(path, args...)
+	switch u.Scheme {
+	case "http", "https":
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + path
+	case "unix":
+		// The socket is dialed by unixHTTPClient, so host doesn't matter
+		u = &url.URL{Scheme: "http", Host: "pipin", Path: "/" + path}
+	default:
+		return nil, fmt.Errorf("invalid PiPin URL %q: scheme must be http, https or unix", c.BaseURL)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
 	if err != nil {
 		return nil, err
 	}
+	for k, v := range c.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("authorization", fmt.Sprintf("Bearer %s", c.Token))
+	return req, nil
+}
 
-	req.Header.Add("authorization", fmt.Sprintf("Bearer %s", c.Token))
-	resp, err := http.DefaultClient.Do(req)
+// do sends the request with an HTTP client suitable for the configuration.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	client := defaultHTTPClient
+	var err error
+	switch {
+	case c.HTTPClient != nil:
+		client = c.HTTPClient
+	case strings.HasPrefix(c.BaseURL, "unix:"):
+		client, err = unixHTTPClient(c.BaseURL)
+	case c.Fingerprint != "":
+		client, err = pinnedHTTPClient(c.Fingerprint)
+	}
 	if err != nil {
 		return nil, err
 	}
+	return client.Do(req)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		// todo: better errors
-		return nil, fmt.Errorf("unable to list pins")
+func (c *Client) Fetch(ctx context.Context, filter []pup.Hash) ([]pup.NamedHash, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, nil, "pins")
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
 	}
 	defer resp.Body.Close()
 
-	hashes := []string{}
+	if err := pup.CheckResponse(resp); err != nil {
+		return nil, fmt.Errorf("unable to list pins: %w", err)
+	}
 
-	err = json.NewDecoder(resp.Body).Decode(&hashes)
+	// Older PiPin versions return a list of bare hashes, newer ones return
+	// objects with metadata.
+	raw := []json.RawMessage{}
+	err = json.NewDecoder(resp.Body).Decode(&raw)
 	if err != nil {
 		return nil, err
 	}
+	pins := make([]pup.NamedHash, 0, len(raw))
+	for _, r := range raw {
+		var pin struct {
+			Hash string `json:"hash"`
+			Name string `json:"name"`
+			Size int64  `json:"size"`
+		}
+		if err := json.Unmarshal(r, &pin.Hash); err != nil {
+			if err := json.Unmarshal(r, &pin); err != nil {
+				return nil, fmt.Errorf("decoding pins list: %w", err)
+			}
+		}
+		pins = append(pins, pup.NamedHash{Hash: pin.Hash, Name: pin.Name, Size: pin.Size})
+	}
 
 	var m map[string]bool = nil
 
@@ -92,13 +176,13 @@ func (c *Client) Fetch(ctx context.Context, filter []pup.Hash) ([]pup.NamedHash,
 	}
 
 	list := []pup.NamedHash{}
-	for _, hash := range hashes {
+	for _, pin := range pins {
 		if m == nil {
-			list = append(list, pup.NamedHash{Hash: hash})
+			list = append(list, pin)
 			continue
 		}
-		if _, ok := m[hash]; ok {
-			list = append(list, pup.NamedHash{Hash: hash})
+		if _, ok := m[pin.Hash]; ok {
+			list = append(list, pin)
 		}
 	}
 
@@ -106,51 +190,121 @@ func (c *Client) Fetch(ctx context.Context, filter []pup.Hash) ([]pup.NamedHash,
 }
 
 func (c *Client) Pin(ctx context.Context, hash pup.Hash) error {
-	req, err := http.NewRequestWithContext(
-		ctx,
-		http.MethodPost,
-		c.endpoint("pin/%s", hash).String(),
-		nil,
-	)
+	return c.PinWithOptions(ctx, hash, pup.PinOptions{})
+}
+
+// PinWithOptions pins the hash, recording the name and key-values as tags of
+// the pin in PiPin.
+func (c *Client) PinWithOptions(ctx context.Context, hash pup.Hash, opts pup.PinOptions) error {
+	body, err := json.Marshal(struct {
+		Name    string            `json:"name,omitempty"`
+		Tags    map[string]string `json:"tags,omitempty"`
+		Origins []string          `json:"origins,omitempty"`
+	}{opts.Name, opts.KeyValues, opts.Origins})
+	if err != nil {
+		return err
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, bytes.NewReader(body), "pin/%s", hash)
 	if err != nil {
 		return err
 	}
-	req.Header.Add("authorization", fmt.Sprintf("Bearer %s", c.Token))
+	req.Header.Set("content-type", "application/json")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		// todo: better errors
-		return fmt.Errorf("unable to pin hash")
+	if err := pup.CheckResponse(resp); err != nil {
+		return fmt.Errorf("unable to pin hash: %w", err)
 	}
 
 	return nil
 }
 
+// Add uploads the file or directory to PiPin, which adds and pins it, and
+// returns its hash.
+func (c *Client) Add(ctx context.Context, name string, node files.Node) (pup.Hash, error) {
+	mfr := files.NewMultiFileReader(files.NewMapDirectory(map[string]files.Node{name: node}), true)
+	req, err := c.newRequest(ctx, http.MethodPost, mfr, "upload")
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("content-type", "multipart/form-data; boundary="+mfr.Boundary())
+
+	resp, err := c.do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if err := pup.CheckResponse(resp); err != nil {
+		return "", fmt.Errorf("unable to upload %q: %w", name, err)
+	}
+
+	var pin struct {
+		Hash string `json:"hash"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&pin); err != nil {
+		return "", err
+	}
+	return pin.Hash, nil
+}
+
 func (c *Client) Unpin(ctx context.Context, hash pup.Hash) error {
-	req, err := http.NewRequestWithContext(
-		ctx,
-		http.MethodDelete,
-		c.endpoint("pin/%s", hash).String(),
-		nil,
-	)
+	req, err := c.newRequest(ctx, http.MethodDelete, nil, "pin/%s", hash)
 	if err != nil {
 		return err
 	}
-	req.Header.Add("authorization", fmt.Sprintf("Bearer %s", c.Token))
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		// todo: better errors
-		return fmt.Errorf("unable to unpin hash")
+	if err := pup.CheckResponse(resp); err != nil {
+		return fmt.Errorf("unable to unpin hash: %w", err)
 	}
 
 	return nil
 }
+
+func (c *Client) Status(ctx context.Context, hash pup.Hash) (pup.PinStatus, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, nil, "pin/%s", hash)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if err := pup.CheckResponse(resp); err != nil {
+		return "", fmt.Errorf("unable to check pin status: %w", err)
+	}
+
+	var status struct {
+		Pinned bool   `json:"pinned"`
+		Status string `json:"status"` // missing in older PiPin versions
+	}
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case status.Pinned:
+		return pup.StatusPinned, nil
+	case status.Status == "queued":
+		return pup.StatusQueued, nil
+	case status.Status == "pinning":
+		return pup.StatusPinning, nil
+	case status.Status == "failed":
+		return pup.StatusFailed, nil
+	default:
+		return pup.StatusUnpinned, nil
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package pipin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestUnmarshalConfig(t *testing.T) {
+	tests := []struct {
+		config  string
+		baseURL string
+		pins    string // URL of the pins endpoint
+	}{
+		// Older configs
+		{`{"Host": "raspberrypi.local:9229", "Token": "secret"}`, "http://raspberrypi.local:9229", "http://raspberrypi.local:9229/pins"},
+		{`{"UseTLS": true, "Host": "pi:9229", "Token": "secret"}`, "https://pi:9229", "https://pi:9229/pins"},
+		{`{"UseTLS": false, "Host": "10.0.0.2:9229", "Token": "secret"}`, "http://10.0.0.2:9229", "http://10.0.0.2:9229/pins"},
+		// Current ones
+		{`{"BaseURL": "https://pi:9229", "Token": "secret"}`, "https://pi:9229", "https://pi:9229/pins"},
+		{`{"BaseURL": "https://example.com/pipin/", "Token": "secret"}`, "https://example.com/pipin/", "https://example.com/pipin/pins"},
+		{`{"BaseURL": "unix:///run/pipin.sock", "Token": "secret"}`, "unix:///run/pipin.sock", "http://pipin/pins"},
+		// BaseURL wins over older fields
+		{`{"BaseURL": "https://new:9229", "UseTLS": false, "Host": "old:9229", "Token": "secret"}`, "https://new:9229", "https://new:9229/pins"},
+	}
+	for _, tt := range tests {
+		var c Client
+		if err := json.Unmarshal([]byte(tt.config), &c); err != nil {
+			t.Errorf("decoding %s: %v", tt.config, err)
+			continue
+		}
+		if c.BaseURL != tt.baseURL || c.Token != "secret" {
+			t.Errorf("decoding %s: BaseURL %q, Token %q; want %q, secret", tt.config, c.BaseURL, c.Token, tt.baseURL)
+			continue
+		}
+		req, err := c.newRequest(context.Background(), http.MethodGet, nil, "pins")
+		if err != nil {
+			t.Errorf("decoding %s: newRequest: %v", tt.config, err)
+			continue
+		}
+		if req.URL.String() != tt.pins {
+			t.Errorf("decoding %s: pins at %s, want %s", tt.config, req.URL, tt.pins)
+		}
+		if got := req.Header.Get("authorization"); got != "Bearer secret" {
+			t.Errorf("decoding %s: authorization %q", tt.config, got)
+		}
+	}
+}
+
+func TestUnmarshalConfigFields(t *testing.T) {
+	// As found in Herder's config.json
+	var config struct{ Pipin *Client }
+	err := json.Unmarshal([]byte(`{"Pipin": {
+		"Host": "pi:9229",
+		"UseTLS": true,
+		"Token": "secret",
+		"Fingerprint": "ab:cd",
+		"Headers": {"X-Proxy-Auth": "yes"}
+	}}`), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := config.Pipin
+	if c == nil {
+		t.Fatal("decoded no client")
+	}
+	if c.BaseURL != "https://pi:9229" || c.Fingerprint != "ab:cd" || c.Headers["X-Proxy-Auth"] != "yes" {
+		t.Errorf("decoded %+v", c)
+	}
+
+	// Configs are saved in the current form
+	buf, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(buf), "UseTLS") || strings.Contains(string(buf), `"Host"`) {
+		t.Errorf("encoded %s, want no UseTLS and Host", buf)
+	}
+	var again Client
+	if err := json.Unmarshal(buf, &again); err != nil || again.BaseURL != c.BaseURL {
+		t.Errorf("decoding %s again = %+v, %v", buf, again, err)
+	}
+
+	if err := json.Unmarshal([]byte(`{"Host": 9229}`), &Client{}); err == nil {
+		t.Error("decoding a config with a bad Host succeeded")
+	}
+}
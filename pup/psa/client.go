@@ -0,0 +1,344 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package psa implements a pup.Pup talking to any service implementing the
+// IPFS Pinning Service API spec v1.
+//
+// See: https://ipfs.github.io/pinning-services-api-spec/
+package psa
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wpengine/hackathon-catation/pup"
+)
+
+// Pin is an object which should be pinned, as defined by the spec.
+type Pin struct {
+	CID     string            `json:"cid"`
+	Name    string            `json:"name,omitempty"`
+	Origins []string          `json:"origins,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty"`
+}
+
+// PinStatus describes a pin request, as defined by the spec.
+type PinStatus struct {
+	RequestID string            `json:"requestid"`
+	Status    string            `json:"status"`
+	Created   time.Time         `json:"created"`
+	Pin       Pin               `json:"pin"`
+	Delegates []string          `json:"delegates"`
+	Info      map[string]string `json:"info,omitempty"`
+}
+
+// PinResults is a page of pin requests, as defined by the spec.
+type PinResults struct {
+	Count   int         `json:"count"`
+	Results []PinStatus `json:"results"`
+}
+
+// Failure is the body of an error response, as defined by the spec.
+type Failure struct {
+	Error struct {
+		Reason  string `json:"reason"`
+		Details string `json:"details,omitempty"`
+	} `json:"error"`
+}
+
+// Statuses of pin requests defined by the spec.
+const (
+	Queued  = "queued"
+	Pinning = "pinning"
+	Pinned  = "pinned"
+	Failed  = "failed"
+)
+
+// AllStatuses can be used as a status filter when listing pin requests.
+const AllStatuses = Queued + "," + Pinning + "," + Pinned + "," + Failed
+
+// maxLimit is the maximum page size allowed by the spec.
+const maxLimit = 1000
+
+// maxCIDs is the maximum number of CIDs in a single cid filter allowed by the
+// spec.
+const maxCIDs = 10
+
+type Client struct {
+	// Name is shown in Herder as the column header.
+	Name    string
+	BaseURL string // e.g. https://api.pinata.cloud/psa
+	Token   string
+	// HTTPClient optionally overrides the client used for requests.
+	HTTPClient *http.Client `json:"-"`
+}
+
+// defaultHTTPClient is shared by all Client values without an explicit
+// HTTPClient. Services rate-limit the API per account, and Herder checks
+// statuses of many pins at once, so at most 4 requests are sent at a time.
+var defaultHTTPClient = pup.NewHTTPClient(4)
+
+func New(baseURL, token string) *Client {
+	return &Client{BaseURL: baseURL, Token: token}
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return defaultHTTPClient
+}
+
+func (c *Client) endpoint(path string) string {
+	return strings.TrimSuffix(c.BaseURL, "/") + path
+}
+
+// do sends a request with an optional JSON body to the service, and decodes
+// the JSON response into out, if non-nil.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		buf, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(buf)
+	}
+	u := c.endpoint(path)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("authorization", "Bearer "+c.Token)
+	if body != nil {
+		req.Header.Set("content-type", "application/json")
+	}
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := pup.CheckResponse(resp); err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// List calls fn with consecutive pages of pin requests matching query, newest
+// first, until all pages are exhausted. Each request is reported once.
+//
+// Pages are requested by creation time, and several requests may share the
+// creation time of the oldest one on a page, so the next page starts with
+// it, and requests we've already seen are skipped. Only if more than a
+// full page of requests shares a creation time, some of them may be
+// missed.
+func (c *Client) List(ctx context.Context, query url.Values, fn func([]PinStatus)) error {
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	q.Set("limit", strconv.Itoa(maxLimit))
+	seen := map[string]bool{}
+	var before time.Time
+	for {
+		var page PinResults
+		err := c.do(ctx, http.MethodGet, "/pins", q, nil, &page)
+		if err != nil {
+			return fmt.Errorf("listing pins: %w", err)
+		}
+		var fresh []PinStatus
+		for _, r := range page.Results {
+			if !seen[r.RequestID] {
+				seen[r.RequestID] = true
+				fresh = append(fresh, r)
+			}
+		}
+		if len(fresh) > 0 {
+			fn(fresh)
+		}
+		// Count is the number of all requests matching the query, including
+		// the "before" filter, so it shrinks with each page.
+		if len(page.Results) == 0 || len(page.Results) >= page.Count {
+			return nil
+		}
+		// Results are sorted by creation time, so continue from the oldest
+		// one we got. "before" is exclusive, so nudge it to include
+		// requests created at the same time, unless the whole page was
+		// created at that time and we'd get the same page again.
+		oldest := page.Results[0].Created
+		for _, r := range page.Results {
+			if r.Created.Before(oldest) {
+				oldest = r.Created
+			}
+		}
+		next := oldest.Add(time.Nanosecond)
+		if next.Equal(before) {
+			next = oldest
+		}
+		before = next
+		q.Set("before", before.Format(time.RFC3339Nano))
+	}
+}
+
+func (c *Client) Fetch(ctx context.Context, filter []pup.Hash) ([]pup.NamedHash, error) {
+	// Prepare filter
+	var m map[string]bool = nil
+	cids := []string{}
+	if len(filter) > 0 {
+		m = make(map[string]bool)
+		for _, h := range filter {
+			if !m[h] {
+				cids = append(cids, h)
+			}
+			m[h] = true
+		}
+	}
+
+	// Ask the service to filter the hashes for us, if the filter is short
+	// enough
+	query := url.Values{"status": {Pinned}}
+	if m != nil && len(cids) <= maxCIDs {
+		query.Set("cid", strings.Join(cids, ","))
+	}
+
+	// There may be more than one request for the same hash, deduplicate them
+	list := []pup.NamedHash{}
+	seen := map[string]bool{}
+	err := c.List(ctx, query, func(results []PinStatus) {
+		for _, r := range results {
+			if seen[r.Pin.CID] || (m != nil && !m[r.Pin.CID]) {
+				continue
+			}
+			seen[r.Pin.CID] = true
+			list = append(list, pup.NamedHash{
+				Hash: r.Pin.CID,
+				Name: r.Pin.Name,
+			})
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("psa: fetching: %w", err)
+	}
+	return list, nil
+}
+
+func (c *Client) Pin(ctx context.Context, hash pup.Hash) error {
+	return c.PinWithOptions(ctx, hash, pup.PinOptions{})
+}
+
+func (c *Client) PinWithOptions(ctx context.Context, hash pup.Hash, opts pup.PinOptions) error {
+	pin := Pin{
+		CID:     hash,
+		Name:    opts.Name,
+		Origins: opts.Origins,
+		Meta:    opts.KeyValues,
+	}
+	err := c.do(ctx, http.MethodPost, "/pins", nil, pin, nil)
+	if err != nil {
+		return fmt.Errorf("psa: pinning %q: %w", hash, err)
+	}
+	return nil
+}
+
+// requests returns all pin requests for the hash, in any status.
+func (c *Client) requests(ctx context.Context, hash pup.Hash) ([]PinStatus, error) {
+	var all []PinStatus
+	err := c.List(ctx, url.Values{"cid": {hash}, "status": {AllStatuses}}, func(results []PinStatus) {
+		for _, r := range results {
+			if r.Pin.CID == hash {
+				all = append(all, r)
+			}
+		}
+	})
+	return all, err
+}
+
+// Unpin removes all pin requests for the hash.
+func (c *Client) Unpin(ctx context.Context, hash pup.Hash) error {
+	reqs, err := c.requests(ctx, hash)
+	if err != nil {
+		return fmt.Errorf("psa: unpinning %q: %w", hash, err)
+	}
+	for _, r := range reqs {
+		err := c.do(ctx, http.MethodDelete, "/pins/"+url.PathEscape(r.RequestID), nil, nil, nil)
+		if err != nil {
+			return fmt.Errorf("psa: unpinning %q: %w", hash, err)
+		}
+	}
+	return nil
+}
+
+// Status returns the most advanced status among pin requests for the hash.
+func (c *Client) Status(ctx context.Context, hash pup.Hash) (pup.PinStatus, error) {
+	reqs, err := c.requests(ctx, hash)
+	if err != nil {
+		return "", fmt.Errorf("psa: checking status of %q: %w", hash, err)
+	}
+	rank := map[string]int{Failed: 1, Queued: 2, Pinning: 3, Pinned: 4}
+	best := ""
+	for _, r := range reqs {
+		if rank[r.Status] > rank[best] {
+			best = r.Status
+		}
+	}
+	switch best {
+	case Queued:
+		return pup.StatusQueued, nil
+	case Pinning:
+		return pup.StatusPinning, nil
+	case Pinned:
+		return pup.StatusPinned, nil
+	case Failed:
+		return pup.StatusFailed, nil
+	default:
+		return pup.StatusUnpinned, nil
+	}
+}
+
+// UpdateMetadata replaces name and meta of all pin requests for the hash.
+func (c *Client) UpdateMetadata(ctx context.Context, hash pup.Hash, md pup.Metadata) error {
+	reqs, err := c.requests(ctx, hash)
+	if err != nil {
+		return fmt.Errorf("psa: updating metadata of %q: %w", hash, err)
+	}
+	if len(reqs) == 0 {
+		return fmt.Errorf("psa: updating metadata of %q: %w", hash, pup.ErrNotFound)
+	}
+	for _, r := range reqs {
+		pin := r.Pin
+		pin.Name = md.Name
+		pin.Meta = md.KeyValues
+		err := c.do(ctx, http.MethodPost, "/pins/"+url.PathEscape(r.RequestID), nil, pin, nil)
+		if err != nil {
+			return fmt.Errorf("psa: updating metadata of %q: %w", hash, err)
+		}
+	}
+	return nil
+}
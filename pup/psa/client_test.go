@@ -0,0 +1,180 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package psa_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/wpengine/hackathon-catation/pup"
+	"github.com/wpengine/hackathon-catation/pup/psa"
+	"github.com/wpengine/hackathon-catation/pup/psa/psatest"
+)
+
+func newServer(t *testing.T) (*psatest.Server, *psa.Client) {
+	s := psatest.NewServer("token")
+	t.Cleanup(s.Close)
+	c := psa.New(s.URL, "token")
+	c.HTTPClient = s.Client()
+	return s, c
+}
+
+// pinAll pins n hashes named QmNNN, advancing the server's clock by step
+// before every pin request after the first.
+func pinAll(t *testing.T, s *psatest.Server, c *psa.Client, n int, step func(i int) time.Duration) []string {
+	var hashes []string
+	for i := 0; i < n; i++ {
+		s.ClockStep = step(i)
+		h := fmt.Sprintf("Qm%03d", i)
+		if err := c.Pin(context.Background(), h); err != nil {
+			t.Fatalf("Pin(%s): %v", h, err)
+		}
+		hashes = append(hashes, h)
+	}
+	return hashes
+}
+
+func TestListDuplicateTimestamps(t *testing.T) {
+	steps := map[string]func(i int) time.Duration{
+		"distinct": func(int) time.Duration { return time.Second },
+		// Groups of 3 requests straddle the page boundaries
+		"groups": func(i int) time.Duration {
+			if i%3 == 0 {
+				return time.Second
+			}
+			return 0
+		},
+		"sub-second": func(i int) time.Duration {
+			if i%2 == 0 {
+				return time.Millisecond
+			}
+			return 0
+		},
+	}
+	for name, step := range steps {
+		s, c := newServer(t)
+		s.PageSize = 4
+		want := pinAll(t, s, c, 11, step)
+
+		var got []string
+		ids := map[string]int{}
+		err := c.List(context.Background(), url.Values{}, func(results []psa.PinStatus) {
+			for _, r := range results {
+				got = append(got, r.Pin.CID)
+				ids[r.RequestID]++
+			}
+		})
+		if err != nil {
+			t.Fatalf("%s: List: %v", name, err)
+		}
+		for id, n := range ids {
+			if n > 1 {
+				t.Errorf("%s: request %s listed %d times", name, id, n)
+			}
+		}
+		sort.Strings(got)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: listed %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestFetch(t *testing.T) {
+	s, c := newServer(t)
+	s.PageSize = 2
+	ctx := context.Background()
+	pinAll(t, s, c, 5, func(i int) time.Duration { return time.Duration(i%2) * time.Second })
+	// A second request for the same hash
+	s.ClockStep = time.Second
+	if err := c.Pin(ctx, "Qm001"); err != nil {
+		t.Fatal(err)
+	}
+	s.InitialStatus = psa.Queued
+	if err := c.Pin(ctx, "QmQueued"); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := c.Fetch(ctx, nil)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	var got []string
+	for _, h := range list {
+		got = append(got, h.Hash)
+	}
+	sort.Strings(got)
+	if want := "[Qm000 Qm001 Qm002 Qm003 Qm004]"; fmt.Sprint(got) != want {
+		t.Errorf("Fetch = %v, want %s", got, want)
+	}
+
+	list, err = c.Fetch(ctx, []pup.Hash{"Qm003", "QmQueued", "QmMissing"})
+	if err != nil {
+		t.Fatalf("Fetch with filter: %v", err)
+	}
+	if len(list) != 1 || list[0].Hash != "Qm003" {
+		t.Errorf("Fetch with filter = %v, want Qm003", list)
+	}
+}
+
+func TestPinStatusUnpin(t *testing.T) {
+	s, c := newServer(t)
+	ctx := context.Background()
+	s.InitialStatus = psa.Queued
+
+	err := c.PinWithOptions(ctx, "QmA", pup.PinOptions{Metadata: pup.Metadata{Name: "a.jpg"}})
+	if err != nil {
+		t.Fatalf("PinWithOptions: %v", err)
+	}
+	if reqs := s.Requests(); len(reqs) != 1 || reqs[0].Pin.Name != "a.jpg" {
+		t.Errorf("requests = %v, want one for a.jpg", reqs)
+	}
+	for _, tt := range []struct {
+		status string
+		want   pup.PinStatus
+	}{
+		{psa.Queued, pup.StatusQueued},
+		{psa.Pinning, pup.StatusPinning},
+		{psa.Pinned, pup.StatusPinned},
+		{psa.Failed, pup.StatusFailed},
+	} {
+		s.SetStatus("QmA", tt.status)
+		got, err := c.Status(ctx, "QmA")
+		if err != nil || got != tt.want {
+			t.Errorf("Status with %s = %q, %v; want %q", tt.status, got, err, tt.want)
+		}
+	}
+
+	if err := c.Unpin(ctx, "QmA"); err != nil {
+		t.Fatalf("Unpin: %v", err)
+	}
+	if got, err := c.Status(ctx, "QmA"); err != nil || got != pup.StatusUnpinned {
+		t.Errorf("Status after Unpin = %q, %v; want %q", got, err, pup.StatusUnpinned)
+	}
+	err = c.UpdateMetadata(ctx, "QmA", pup.Metadata{Name: "b.jpg"})
+	if !errors.Is(err, pup.ErrNotFound) {
+		t.Errorf("UpdateMetadata after Unpin = %v, want ErrNotFound", err)
+	}
+
+	bad := psa.New(s.URL, "wrong")
+	if _, err := bad.Fetch(ctx, nil); !errors.Is(err, pup.ErrUnauthorized) {
+		t.Errorf("Fetch with bad token = %v, want ErrUnauthorized", err)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package psatest provides an in-memory implementation of the IPFS Pinning
+// Service API, for testing clients against.
+package psatest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wpengine/hackathon-catation/pup/psa"
+)
+
+// Server is an in-memory pinning service. It doesn't fetch any content; new
+// pin requests simply get InitialStatus, which can be later changed with
+// SetStatus.
+type Server struct {
+	*httptest.Server
+	Token string
+
+	// InitialStatus is assigned to new pin requests; psa.Pinned if empty.
+	InitialStatus string
+	// ClockStep is how much the fake clock advances before each new pin
+	// request; NewServer sets it to 1s. Zero makes all requests share the
+	// same creation time.
+	ClockStep time.Duration
+	// PageSize, if non-zero, caps the number of pin requests listed at once,
+	// regardless of the limit requested by the client.
+	PageSize int
+
+	mu       sync.Mutex
+	requests map[string]psa.PinStatus
+	lastID   int
+	clock    time.Time
+}
+
+// NewServer starts a fake pinning service accepting the token. The caller
+// should call Close when finished, to shut it down.
+func NewServer(token string) *Server {
+	s := &Server{
+		Token:     token,
+		ClockStep: time.Second,
+		requests:  map[string]psa.PinStatus{},
+		clock:     time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// SetStatus changes status of all pin requests for the cid.
+func (s *Server) SetStatus(cid, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, r := range s.requests {
+		if r.Pin.CID == cid {
+			r.Status = status
+			s.requests[id] = r
+		}
+	}
+}
+
+// Requests returns a snapshot of all pin requests.
+func (s *Server) Requests() []psa.PinStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := []psa.PinStatus{}
+	for _, r := range s.requests {
+		all = append(all, r)
+	}
+	return all
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("authorization") != "Bearer "+s.Token {
+		fail(w, http.StatusUnauthorized, "UNAUTHORIZED", "invalid access token")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case path == "pins" && r.Method == http.MethodGet:
+		q, err := psa.ParseQuery(r.URL.Query())
+		if err != nil {
+			fail(w, http.StatusBadRequest, "BAD_REQUEST", err.Error())
+			return
+		}
+		if s.PageSize > 0 && q.Limit > s.PageSize {
+			q.Limit = s.PageSize
+		}
+		all := []psa.PinStatus{}
+		for _, req := range s.requests {
+			all = append(all, req)
+		}
+		reply(w, http.StatusOK, q.Apply(all))
+	case path == "pins" && r.Method == http.MethodPost:
+		pin, ok := decodePin(w, r)
+		if !ok {
+			return
+		}
+		reply(w, http.StatusAccepted, s.add(pin))
+	case strings.HasPrefix(path, "pins/"):
+		id := strings.TrimPrefix(path, "pins/")
+		req, found := s.requests[id]
+		if !found {
+			fail(w, http.StatusNotFound, "NOT_FOUND", "no pin request with id "+id)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			reply(w, http.StatusOK, req)
+		case http.MethodPost:
+			pin, ok := decodePin(w, r)
+			if !ok {
+				return
+			}
+			delete(s.requests, id)
+			reply(w, http.StatusAccepted, s.add(pin))
+		case http.MethodDelete:
+			delete(s.requests, id)
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			fail(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", r.Method)
+		}
+	default:
+		fail(w, http.StatusNotFound, "NOT_FOUND", r.URL.Path)
+	}
+}
+
+// add registers a new pin request. It must be called with s.mu locked.
+func (s *Server) add(pin psa.Pin) psa.PinStatus {
+	// Use a fake clock, so that requests have predictable creation times
+	s.clock = s.clock.Add(s.ClockStep)
+	s.lastID++
+	status := s.InitialStatus
+	if status == "" {
+		status = psa.Pinned
+	}
+	req := psa.PinStatus{
+		RequestID: fmt.Sprintf("req-%d", s.lastID),
+		Status:    status,
+		Created:   s.clock,
+		Pin:       pin,
+		Delegates: []string{"/ip4/127.0.0.1/tcp/4001/p2p/QmFakeDelegate"},
+	}
+	s.requests[req.RequestID] = req
+	return req
+}
+
+func decodePin(w http.ResponseWriter, r *http.Request) (psa.Pin, bool) {
+	var pin psa.Pin
+	if err := json.NewDecoder(r.Body).Decode(&pin); err != nil {
+		fail(w, http.StatusBadRequest, "BAD_REQUEST", err.Error())
+		return pin, false
+	}
+	if pin.CID == "" {
+		fail(w, http.StatusBadRequest, "BAD_REQUEST", "missing cid")
+		return pin, false
+	}
+	return pin, true
+}
+
+func reply(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func fail(w http.ResponseWriter, code int, reason, details string) {
+	var f psa.Failure
+	f.Error.Reason = reason
+	f.Error.Details = details
+	reply(w, code, f)
+}
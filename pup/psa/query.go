@@ -0,0 +1,165 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package psa
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query is a parsed filter for listing pin requests, as defined by the spec.
+// It is used by implementations of the API.
+type Query struct {
+	CIDs     map[string]bool // empty means any
+	Name     string
+	Match    string          // exact, iexact, partial or ipartial
+	Statuses map[string]bool // never empty
+	Before   time.Time       // zero means no limit
+	After    time.Time       // zero means no limit
+	Limit    int
+	Meta     map[string]string
+}
+
+// ParseQuery parses query parameters of a request listing pin requests,
+// applying defaults from the spec.
+func ParseQuery(v url.Values) (*Query, error) {
+	q := &Query{
+		CIDs:     map[string]bool{},
+		Name:     v.Get("name"),
+		Match:    "exact",
+		Statuses: map[string]bool{},
+		Limit:    10,
+	}
+	if cids := v.Get("cid"); cids != "" {
+		list := strings.Split(cids, ",")
+		if len(list) > maxCIDs {
+			return nil, fmt.Errorf("too many CIDs, at most %d allowed", maxCIDs)
+		}
+		for _, c := range list {
+			q.CIDs[c] = true
+		}
+	}
+	if m := v.Get("match"); m != "" {
+		switch m {
+		case "exact", "iexact", "partial", "ipartial":
+			q.Match = m
+		default:
+			return nil, fmt.Errorf("invalid match %q", m)
+		}
+	}
+	status := v.Get("status")
+	if status == "" {
+		status = Pinned
+	}
+	for _, s := range strings.Split(status, ",") {
+		switch s {
+		case Queued, Pinning, Pinned, Failed:
+			q.Statuses[s] = true
+		default:
+			return nil, fmt.Errorf("invalid status %q", s)
+		}
+	}
+	var err error
+	if b := v.Get("before"); b != "" {
+		if q.Before, err = time.Parse(time.RFC3339Nano, b); err != nil {
+			return nil, fmt.Errorf("invalid before: %w", err)
+		}
+	}
+	if a := v.Get("after"); a != "" {
+		if q.After, err = time.Parse(time.RFC3339Nano, a); err != nil {
+			return nil, fmt.Errorf("invalid after: %w", err)
+		}
+	}
+	if l := v.Get("limit"); l != "" {
+		q.Limit, err = strconv.Atoi(l)
+		if err != nil || q.Limit < 1 || q.Limit > maxLimit {
+			return nil, fmt.Errorf("invalid limit %q, must be between 1 and %d", l, maxLimit)
+		}
+	}
+	if m := v.Get("meta"); m != "" {
+		if err := json.Unmarshal([]byte(m), &q.Meta); err != nil {
+			return nil, fmt.Errorf("invalid meta: %w", err)
+		}
+	}
+	return q, nil
+}
+
+// Matches reports whether the pin request matches all filters of the query,
+// except the limit.
+func (q *Query) Matches(s PinStatus) bool {
+	if len(q.CIDs) > 0 && !q.CIDs[s.Pin.CID] {
+		return false
+	}
+	if !q.Statuses[s.Status] {
+		return false
+	}
+	if !q.Before.IsZero() && !s.Created.Before(q.Before) {
+		return false
+	}
+	if !q.After.IsZero() && !s.Created.After(q.After) {
+		return false
+	}
+	if q.Name != "" && !matchName(q.Match, q.Name, s.Pin.Name) {
+		return false
+	}
+	for k, v := range q.Meta {
+		if s.Pin.Meta[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func matchName(match, want, name string) bool {
+	switch match {
+	case "iexact":
+		return strings.EqualFold(want, name)
+	case "partial":
+		return strings.Contains(name, want)
+	case "ipartial":
+		return strings.Contains(strings.ToLower(name), strings.ToLower(want))
+	default:
+		return want == name
+	}
+}
+
+// Apply returns a page of pin requests from all which match the query, sorted
+// from newest, along with the total count of matching requests.
+func (q *Query) Apply(all []PinStatus) PinResults {
+	matching := []PinStatus{}
+	for _, s := range all {
+		if q.Matches(s) {
+			matching = append(matching, s)
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool {
+		a, b := matching[i], matching[j]
+		if !a.Created.Equal(b.Created) {
+			return a.Created.After(b.Created)
+		}
+		return a.RequestID > b.RequestID
+	})
+	res := PinResults{Count: len(matching), Results: matching}
+	if len(res.Results) > q.Limit {
+		res.Results = res.Results[:q.Limit]
+	}
+	return res
+}
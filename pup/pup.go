@@ -15,7 +15,11 @@
 
 package pup
 
-import "context"
+import (
+	"context"
+
+	files "github.com/ipfs/go-ipfs-files"
+)
 
 type Hash = string
 
@@ -32,3 +36,52 @@ type Pup interface {
 	Pin(ctx context.Context, hash Hash) error
 	Unpin(ctx context.Context, hash Hash) error
 }
+
+// Metadata describes a pin, in services which support naming and tagging
+// pins.
+type Metadata struct {
+	Name      string
+	KeyValues map[string]string // optional
+}
+
+// PinOptions are extra parameters for pinning a hash.
+type PinOptions struct {
+	Metadata
+	// Origins are optional multiaddrs of nodes known to have the content,
+	// which the service may connect to directly to speed up retrieval.
+	Origins []string
+}
+
+// OptionsPinner is implemented by Pups which can pin a hash with a name, tags
+// or other options.
+type OptionsPinner interface {
+	PinWithOptions(ctx context.Context, hash Hash, opts PinOptions) error
+}
+
+// MetadataUpdater is implemented by Pups which can change metadata of an
+// already pinned hash.
+type MetadataUpdater interface {
+	UpdateMetadata(ctx context.Context, hash Hash, md Metadata) error
+}
+
+// Uploader is implemented by Pups which can receive content directly,
+// instead of fetching it by hash from the IPFS network. This way, the
+// uploading node doesn't need to stay reachable until the content is pinned.
+type Uploader interface {
+	// Add uploads and pins a file or a directory with all its contents,
+	// named name in the service, and returns its root hash.
+	Add(ctx context.Context, name string, node files.Node) (Hash, error)
+}
+
+// UnpinChecker is implemented by Pups which may be unable to remove pins,
+// e.g. because the service keeps them for a paid period. Pups which don't
+// implement it can always unpin.
+type UnpinChecker interface {
+	CanUnpin() bool
+}
+
+// CanUnpin reports whether p can remove pins.
+func CanUnpin(p Pup) bool {
+	c, ok := p.(UnpinChecker)
+	return !ok || c.CanUnpin()
+}
@@ -0,0 +1,32 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package puptest helps testing pups against fakes of their services.
+package puptest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Serve serves the fake service h over HTTP until the end of the test. It
+// returns the URL of the service, without a trailing slash, and a client to
+// send requests to it with.
+func Serve(t testing.TB, h http.Handler) (string, *http.Client) {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return srv.URL, srv.Client()
+}
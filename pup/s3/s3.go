@@ -0,0 +1,234 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package s3 implements a car.Store keeping CAR files in a bucket of an
+// S3-compatible service, such as AWS S3 or MinIO. Wrapped in car.Archive,
+// it serves as a cold storage pup, independent of any pinning service.
+package s3
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/wpengine/hackathon-catation/pup"
+)
+
+// Store keeps CAR files as objects named <Prefix><hash>.car in a bucket.
+// Buckets are addressed by path, which is supported by all S3-compatible
+// services.
+type Store struct {
+	// Name of the store, shown in Herder.
+	Name string `json:",omitempty"`
+	// Endpoint is the URL of the service, e.g.
+	// https://s3.us-east-1.amazonaws.com, or http://127.0.0.1:9000 for a
+	// local MinIO.
+	Endpoint string
+	// Region of the bucket; us-east-1 if empty, which MinIO uses by default.
+	Region string `json:",omitempty"`
+	Bucket string
+	// Prefix is prepended to names of objects, e.g. "catation/".
+	Prefix    string `json:",omitempty"`
+	AccessKey string
+	SecretKey string
+
+	// HTTPClient optionally overrides the client used for requests to the
+	// service.
+	HTTPClient *http.Client `json:"-"`
+}
+
+// defaultHTTPClient is shared by all Store values without an explicit
+// HTTPClient. At most 4 CAR files are uploaded at a time, so that large ones
+// don't all compete for the uplink and time out together.
+var defaultHTTPClient = pup.NewHTTPClient(4)
+
+func (s *Store) httpClient() *http.Client {
+	if s.HTTPClient != nil {
+		return s.HTTPClient
+	}
+	return defaultHTTPClient
+}
+
+func (s *Store) key(hash pup.Hash) string {
+	return s.Prefix + hash + ".car"
+}
+
+// send sends a signed request for the object key, or the bucket itself if
+// key is empty, and returns the response if successful. The caller must
+// close its body. If body is non-nil, it must have size bytes.
+func (s *Store) send(ctx context.Context, method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("bad endpoint: %w", err)
+	}
+	u.Path += "/" + s.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	payload := emptyPayload
+	if body != nil {
+		req.ContentLength = size
+		payload = unsignedPayload
+	}
+	region := s.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	sign(req, s.AccessKey, s.SecretKey, region, payload, time.Now())
+
+	resp, err := s.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// checkResponse maps an unsuccessful response to pup errors. S3 reports
+// errors as XML with a code and a message.
+func checkResponse(resp *http.Response) error {
+	err := pup.CheckResponse(resp)
+	var httpErr *pup.HTTPError
+	if !errors.As(err, &httpErr) {
+		return err
+	}
+	var body struct {
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal([]byte(httpErr.Message), &body) == nil && body.Code != "" {
+		httpErr.Message = body.Code
+		if body.Message != "" {
+			httpErr.Message += ": " + body.Message
+		}
+	}
+	return err
+}
+
+// listResult is a page of objects in the bucket.
+type listResult struct {
+	Contents []struct {
+		Key  string
+		Size int64
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List returns hashes of all CAR files in the bucket under Prefix, with
+// their sizes.
+func (s *Store) List(ctx context.Context) ([]pup.NamedHash, error) {
+	list := []pup.NamedHash{}
+	query := url.Values{"list-type": {"2"}, "prefix": {s.Prefix}}
+	for {
+		resp, err := s.send(ctx, http.MethodGet, "", query, nil, nil, 0)
+		if err != nil {
+			return nil, fmt.Errorf("s3: listing %s: %w", s.Bucket, err)
+		}
+		var page listResult
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3: listing %s: decoding response: %w", s.Bucket, err)
+		}
+		for _, obj := range page.Contents {
+			name := strings.TrimPrefix(obj.Key, s.Prefix)
+			if strings.Contains(name, "/") || !strings.HasSuffix(name, ".car") {
+				continue
+			}
+			list = append(list, pup.NamedHash{
+				Hash: strings.TrimSuffix(name, ".car"),
+				Size: obj.Size,
+			})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return list, nil
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+}
+
+func (s *Store) Has(ctx context.Context, hash pup.Hash) (bool, error) {
+	resp, err := s.send(ctx, http.MethodHead, s.key(hash), nil, nil, nil, 0)
+	if errors.Is(err, pup.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("s3: checking %s: %w", s.key(hash), err)
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+// Put uploads the CAR file, keeping the name in the object's metadata.
+func (s *Store) Put(ctx context.Context, hash pup.Hash, name string, r io.Reader, size int64) error {
+	header := http.Header{}
+	header.Set("content-type", "application/vnd.ipld.car")
+	if name != "" {
+		// Metadata must be ASCII
+		header.Set("x-amz-meta-name", mime.QEncoding.Encode("utf-8", name))
+	}
+	resp, err := s.send(ctx, http.MethodPut, s.key(hash), nil, header, r, size)
+	if err != nil {
+		return fmt.Errorf("s3: uploading %s: %w", s.key(hash), err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *Store) Open(ctx context.Context, hash pup.Hash) (io.ReadCloser, error) {
+	resp, err := s.send(ctx, http.MethodGet, s.key(hash), nil, nil, nil, 0)
+	if err != nil {
+		return nil, fmt.Errorf("s3: downloading %s: %w", s.key(hash), err)
+	}
+	return resp.Body, nil
+}
+
+// Delete removes the CAR file. As S3 doesn't report deleting missing
+// objects as an error, their existence is checked first.
+func (s *Store) Delete(ctx context.Context, hash pup.Hash) error {
+	ok, err := s.Has(ctx, hash)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("s3: deleting %s: %w", s.key(hash), pup.ErrNotFound)
+	}
+	resp, err := s.send(ctx, http.MethodDelete, s.key(hash), nil, nil, nil, 0)
+	if err != nil {
+		return fmt.Errorf("s3: deleting %s: %w", s.key(hash), err)
+	}
+	resp.Body.Close()
+	return nil
+}
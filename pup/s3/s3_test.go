@@ -0,0 +1,265 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wpengine/hackathon-catation/pup"
+	"github.com/wpengine/hackathon-catation/pup/puptest"
+)
+
+// fakeS3 emulates a bucket of an S3-compatible service, verifying
+// signatures of requests and listing objects in pages of pageSize.
+type fakeS3 struct {
+	t        *testing.T
+	bucket   string
+	pageSize int
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	names   map[string]string // x-amz-meta-name of objects
+	lists   []string          // continuation tokens of list requests
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *Store) {
+	f := &fakeS3{
+		t:        t,
+		bucket:   "photos",
+		pageSize: 2,
+		objects:  map[string][]byte{},
+		names:    map[string]string{},
+	}
+	s := &Store{
+		Bucket:    "photos",
+		Prefix:    "catation/",
+		AccessKey: "access",
+		SecretKey: "secret",
+	}
+	s.Endpoint, s.HTTPClient = puptest.Serve(t, f)
+	return f, s
+}
+
+// s3Error replies with an error in the format used by S3.
+func s3Error(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("content-type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, msg)
+}
+
+// verify checks the request's signature by signing the same request again.
+func (f *fakeS3) verify(r *http.Request) bool {
+	auth := r.Header.Get("authorization")
+	i := strings.Index(auth, "SignedHeaders=")
+	if i < 0 {
+		return false
+	}
+	signed := strings.Split(strings.SplitN(auth[i+len("SignedHeaders="):], ",", 2)[0], ";")
+	req, err := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	if err != nil {
+		return false
+	}
+	for _, name := range signed {
+		if name != "host" && name != "x-amz-date" && name != "x-amz-content-sha256" {
+			req.Header.Set(name, r.Header.Get(name))
+		}
+	}
+	now, err := time.Parse("20060102T150405Z", r.Header.Get("x-amz-date"))
+	if err != nil {
+		return false
+	}
+	sign(req, "access", "secret", "us-east-1", r.Header.Get("x-amz-content-sha256"), now)
+	return req.Header.Get("authorization") == auth
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !f.verify(r) {
+		s3Error(w, http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided.")
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != f.bucket {
+		s3Error(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(parts) == 1 {
+		if r.Method != http.MethodGet || r.URL.Query().Get("list-type") != "2" {
+			s3Error(w, http.StatusNotImplemented, "NotImplemented", "Only ListObjectsV2 is emulated")
+			return
+		}
+		f.list(w, r)
+		return
+	}
+	key := parts[1]
+	data, found := f.objects[key]
+	switch r.Method {
+	case http.MethodPut:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil || int64(len(body)) != r.ContentLength {
+			s3Error(w, http.StatusBadRequest, "IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header.")
+			return
+		}
+		f.objects[key] = body
+		f.names[key] = r.Header.Get("x-amz-meta-name")
+	case http.MethodHead:
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("content-length", fmt.Sprint(len(data)))
+	case http.MethodGet:
+		if !found {
+			s3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		w.Write(data)
+	case http.MethodDelete:
+		delete(f.objects, key)
+		delete(f.names, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	token := q.Get("continuation-token")
+	f.lists = append(f.lists, token)
+
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, q.Get("prefix")) && k > token {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	type object struct {
+		Key  string
+		Size int
+	}
+	page := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []object
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}{}
+	for i, k := range keys {
+		if i == f.pageSize {
+			page.IsTruncated = true
+			page.NextContinuationToken = keys[i-1]
+			break
+		}
+		page.Contents = append(page.Contents, object{Key: k, Size: len(f.objects[k])})
+	}
+	w.Header().Set("content-type", "application/xml")
+	xml.NewEncoder(w).Encode(page)
+}
+
+func TestStore(t *testing.T) {
+	f, s := newFakeS3(t)
+	ctx := context.Background()
+
+	var want []pup.NamedHash
+	for i := 0; i < 5; i++ {
+		h := fmt.Sprintf("Qm%d", i)
+		data := bytes.Repeat([]byte{'x'}, 10+i)
+		if err := s.Put(ctx, h, "żółw "+h, bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatalf("Put(%s): %v", h, err)
+		}
+		want = append(want, pup.NamedHash{Hash: h, Size: int64(len(data))})
+	}
+	// Objects which are not CAR files directly under the prefix
+	f.objects["catation/notes.txt"] = []byte("notes")
+	f.objects["catation/old/Qm9.car"] = []byte("old")
+	f.objects["other/Qm8.car"] = []byte("other")
+
+	list, err := s.List(ctx)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if !reflect.DeepEqual(list, want) {
+		t.Errorf("List = %v, want %v", list, want)
+	}
+	if want := []string{"", "catation/Qm1.car", "catation/Qm3.car", "catation/notes.txt"}; !reflect.DeepEqual(f.lists, want) {
+		t.Errorf("listed pages after %q, want %q", f.lists, want)
+	}
+	if got := f.names["catation/Qm1.car"]; got != "=?utf-8?q?=C5=BC=C3=B3=C5=82w_Qm1?=" {
+		t.Errorf("stored name %q, want it encoded", got)
+	}
+
+	if ok, err := s.Has(ctx, "Qm1"); err != nil || !ok {
+		t.Errorf("Has(Qm1) = %v, %v; want true", ok, err)
+	}
+	if ok, err := s.Has(ctx, "QmMissing"); err != nil || ok {
+		t.Errorf("Has(QmMissing) = %v, %v; want false", ok, err)
+	}
+	r, err := s.Open(ctx, "Qm2")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || len(data) != 12 {
+		t.Errorf("Open(Qm2) read %d bytes, %v; want 12", len(data), err)
+	}
+	_, err = s.Open(ctx, "QmMissing")
+	var httpErr *pup.HTTPError
+	if !errors.Is(err, pup.ErrNotFound) || !errors.As(err, &httpErr) || httpErr.Message != "NoSuchKey: The specified key does not exist." {
+		t.Errorf("Open of missing object = %v, want ErrNotFound with the S3 message", err)
+	}
+
+	if err := s.Delete(ctx, "Qm2"); err != nil {
+		t.Errorf("Delete: %v", err)
+	}
+	if err := s.Delete(ctx, "Qm2"); !errors.Is(err, pup.ErrNotFound) {
+		t.Errorf("Delete of missing object = %v, want ErrNotFound", err)
+	}
+	if _, found := f.objects["catation/Qm2.car"]; found {
+		t.Error("object still stored after Delete")
+	}
+}
+
+func TestStoreErrors(t *testing.T) {
+	_, s := newFakeS3(t)
+	ctx := context.Background()
+
+	s.SecretKey = "wrong"
+	if _, err := s.List(ctx); !errors.Is(err, pup.ErrUnauthorized) {
+		t.Errorf("List with wrong secret = %v, want ErrUnauthorized", err)
+	}
+	s.SecretKey = "secret"
+
+	s.Bucket = "missing"
+	if _, err := s.List(ctx); !errors.Is(err, pup.ErrNotFound) {
+		t.Errorf("List of missing bucket = %v, want ErrNotFound", err)
+	}
+}
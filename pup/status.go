@@ -0,0 +1,89 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package pup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// PinStatus describes progress of pinning a hash in a service.
+type PinStatus string
+
+const (
+	StatusUnpinned  PinStatus = "unpinned"  // the service doesn't know the hash
+	StatusQueued    PinStatus = "queued"    // waiting for the service to start
+	StatusSearching PinStatus = "searching" // looking for providers of the content
+	StatusPinning   PinStatus = "pinning"   // retrieving the content
+	StatusPinned    PinStatus = "pinned"    // done
+	StatusFailed    PinStatus = "failed"    // the service gave up
+)
+
+// InProgress reports whether the service is still working on pinning.
+func (s PinStatus) InProgress() bool {
+	switch s {
+	case StatusQueued, StatusSearching, StatusPinning:
+		return true
+	}
+	return false
+}
+
+// StatusChecker is implemented by Pups which can report progress of pinning
+// a hash, after Pin returned.
+type StatusChecker interface {
+	Status(ctx context.Context, hash Hash) (PinStatus, error)
+}
+
+// ErrPinFailed is returned by WaitPinned if the service gave up pinning.
+var ErrPinFailed = errors.New("pinning failed")
+
+// WaitPinned polls sc with increasing delays, until the hash gets pinned or
+// pinning fails. A hash reported as unpinned is assumed to not have been
+// noticed by the service yet, so it's also waited for - use ctx to limit the
+// total time. If non-nil, progress is called whenever the status changes.
+func WaitPinned(ctx context.Context, sc StatusChecker, hash Hash, progress func(PinStatus)) (PinStatus, error) {
+	var last PinStatus
+	for attempt := 0; ; attempt++ {
+		status, err := sc.Status(ctx, hash)
+		switch {
+		case err != nil && !IsRetryable(err):
+			return last, fmt.Errorf("waiting for %s to get pinned: %w", hash, err)
+		case err == nil && status != last:
+			last = status
+			if progress != nil {
+				progress(status)
+			}
+		}
+		switch last {
+		case StatusPinned:
+			return last, nil
+		case StatusFailed:
+			return last, fmt.Errorf("waiting for %s to get pinned: %w", hash, ErrPinFailed)
+		}
+
+		wait := RetryAfter(err)
+		if wait == 0 {
+			wait = Backoff(attempt, time.Second, 30*time.Second)
+		}
+		select {
+		case <-ctx.Done():
+			return last, fmt.Errorf("waiting for %s to get pinned: %w", hash, ctx.Err())
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,292 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package temporal implements a pup.Pup talking to the Temporal IPFS API.
+//
+// See: https://gateway.temporal.cloud/ipns/docs.api.temporal.cloud
+package temporal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wpengine/hackathon-catation/pup"
+)
+
+// DefaultHoldTime is how many months Temporal keeps pins, if not configured
+// otherwise.
+const DefaultHoldTime = 6
+
+// ErrUnpinUnsupported is returned by Unpin, as Temporal keeps pins until
+// their hold time expires.
+var ErrUnpinUnsupported = errors.New("pins can't be removed before their hold time expires")
+
+// refreshMargin is how long before expiry the login token gets refreshed.
+const refreshMargin = 5 * time.Minute
+
+type Client struct {
+	Username, Password string
+	// HoldTime is the number of months to keep new pins; DefaultHoldTime if
+	// zero.
+	HoldTime int `json:",omitempty"`
+
+	// BaseURL is the address of the API; https://api.temporal.cloud if
+	// empty.
+	BaseURL string `json:",omitempty"`
+	// HTTPClient optionally overrides the client used for requests to
+	// Temporal.
+	HTTPClient *http.Client `json:"-"`
+
+	mu     sync.Mutex
+	token  string
+	expire time.Time
+}
+
+var defaultHTTPClient = pup.NewHTTPClient(4)
+
+// New returns a client which logs in to Temporal with the credentials on
+// first use.
+func New(username, password string) *Client {
+	return &Client{Username: username, Password: password}
+}
+
+func (c *Client) endpoint(path string) string {
+	base := c.BaseURL
+	if base == "" {
+		base = "https://api.temporal.cloud"
+	}
+	return strings.TrimSuffix(base, "/") + path
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return defaultHTTPClient
+}
+
+// response is the envelope of all Temporal API responses.
+type response struct {
+	Code     int
+	Response json.RawMessage
+}
+
+// send sends a request to Temporal and decodes the payload of the response
+// envelope into out, if non-nil. If token is non-empty, it is sent as the
+// bearer token.
+func (c *Client) send(ctx context.Context, method, path, token, contentType string, body io.Reader, out interface{}) error {
+	if out == nil {
+		return c.sendRaw(ctx, method, path, token, contentType, body, nil)
+	}
+	var env response
+	err := c.sendRaw(ctx, method, path, token, contentType, body, &env)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(env.Response, out); err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	return nil
+}
+
+// sendRaw works like send, but decodes the whole response body into out.
+// This is needed for the login and refresh endpoints, whose responses are
+// not wrapped in the envelope.
+func (c *Client) sendRaw(ctx context.Context, method, path, token, contentType string, body io.Reader, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint(path), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("cache-control", "no-store,no-cache,private")
+	if contentType != "" {
+		req.Header.Set("content-type", contentType)
+	}
+	if token != "" {
+		req.Header.Set("authorization", "Bearer "+token)
+	}
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := pup.CheckResponse(resp); err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	return nil
+}
+
+// loginResponse is returned by both login and refresh endpoints.
+type loginResponse struct {
+	Expire time.Time `json:"expire"`
+	Token  string    `json:"token"`
+}
+
+// auth returns a valid login token, logging in or refreshing the current
+// token if it's about to expire.
+func (c *Client) auth(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && time.Now().Before(c.expire.Add(-refreshMargin)) {
+		return c.token, nil
+	}
+
+	var login loginResponse
+	if c.token != "" && time.Now().Before(c.expire) {
+		err := c.sendRaw(ctx, http.MethodGet, "/v2/auth/refresh", c.token, "", nil, &login)
+		if err == nil {
+			c.token, c.expire = login.Token, login.Expire
+			return c.token, nil
+		}
+		// Fall back to logging in again
+	}
+
+	var buf bytes.Buffer
+	err := json.NewEncoder(&buf).Encode(map[string]string{"username": c.Username, "password": c.Password})
+	if err != nil {
+		return "", err
+	}
+	err = c.sendRaw(ctx, http.MethodPost, "/v2/auth/login", "", "application/json", &buf, &login)
+	if err != nil {
+		return "", fmt.Errorf("temporal: logging in: %w", err)
+	}
+	c.token, c.expire = login.Token, login.Expire
+	return c.token, nil
+}
+
+// invalidate forgets the login token, unless it was replaced already.
+func (c *Client) invalidate(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token == token {
+		c.token = ""
+	}
+}
+
+// authSend works like send, authenticating with the login token. If the
+// token is rejected, e.g. because it was revoked or clocks differ, it logs
+// in again and retries once.
+func (c *Client) authSend(ctx context.Context, method, path, contentType string, body []byte, out interface{}) error {
+	for retried := false; ; retried = true {
+		token, err := c.auth(ctx)
+		if err != nil {
+			return err
+		}
+		var r io.Reader
+		if body != nil {
+			r = bytes.NewReader(body)
+		}
+		err = c.send(ctx, method, path, token, contentType, r, out)
+		if retried || !errors.Is(err, pup.ErrUnauthorized) {
+			return err
+		}
+		c.invalidate(token)
+	}
+}
+
+// upload is a record of content pinned by the user.
+type upload struct {
+	Hash               string    `json:"hash"`
+	FileName           string    `json:"file_name"`
+	HoldTimeInMonths   int64     `json:"hold_time_in_months"`
+	GarbageCollectDate time.Time `json:"garbage_collect_date"`
+}
+
+// Fetch lists hashes uploaded or pinned by the user, whose hold time didn't
+// expire yet.
+func (c *Client) Fetch(ctx context.Context, filter []pup.Hash) ([]pup.NamedHash, error) {
+	m := map[string]bool{}
+	for _, h := range filter {
+		m[h] = true
+	}
+
+	var uploads []upload
+	err := c.authSend(ctx, http.MethodGet, "/v2/database/uploads", "", nil, &uploads)
+	if err != nil {
+		return nil, fmt.Errorf("temporal: fetching: %w", err)
+	}
+
+	list := []pup.NamedHash{}
+	seen := map[string]bool{}
+	now := time.Now()
+	for _, u := range uploads {
+		if seen[u.Hash] || (len(m) > 0 && !m[u.Hash]) {
+			continue
+		}
+		if !u.GarbageCollectDate.IsZero() && u.GarbageCollectDate.Before(now) {
+			continue
+		}
+		seen[u.Hash] = true
+		list = append(list, pup.NamedHash{Hash: u.Hash, Name: u.FileName})
+	}
+	return list, nil
+}
+
+// Pin pins the hash for the configured HoldTime.
+func (c *Client) Pin(ctx context.Context, hash pup.Hash) error {
+	return c.PinFor(ctx, hash, "", c.HoldTime)
+}
+
+// PinWithOptions pins the hash for the configured HoldTime, using the name
+// as the file name of the pin. Other options are not supported by Temporal,
+// and are ignored.
+func (c *Client) PinWithOptions(ctx context.Context, hash pup.Hash, opts pup.PinOptions) error {
+	return c.PinFor(ctx, hash, opts.Name, c.HoldTime)
+}
+
+// PinFor pins the hash with an optional name for the number of months, or
+// DefaultHoldTime if months is zero.
+func (c *Client) PinFor(ctx context.Context, hash pup.Hash, name string, months int) error {
+	if months <= 0 {
+		months = DefaultHoldTime
+	}
+	form := url.Values{"hold_time": {strconv.Itoa(months)}}
+	if name != "" {
+		form.Set("file_name", name)
+	}
+
+	err := c.authSend(ctx, http.MethodPost, "/v2/ipfs/public/pin/"+url.PathEscape(hash),
+		"application/x-www-form-urlencoded", []byte(form.Encode()), nil)
+	if err != nil {
+		return fmt.Errorf("temporal: pinning %q: %w", hash, err)
+	}
+	return nil
+}
+
+// Unpin always fails with ErrUnpinUnsupported, as Temporal doesn't allow
+// removing pins.
+func (c *Client) Unpin(ctx context.Context, hash pup.Hash) error {
+	return fmt.Errorf("temporal: unpinning %q: %w", hash, ErrUnpinUnsupported)
+}
+
+// CanUnpin returns false; see Unpin.
+func (c *Client) CanUnpin() bool { return false }
@@ -0,0 +1,244 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package temporal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wpengine/hackathon-catation/pup"
+	"github.com/wpengine/hackathon-catation/pup/puptest"
+)
+
+// fakeTemporal emulates the subset of Temporal API used by Client. Login
+// tokens are valid for ttl, and can be revoked at any time.
+type fakeTemporal struct {
+	t   *testing.T
+	ttl time.Duration
+
+	mu        sync.Mutex
+	tokens    map[string]time.Time // expiry of valid tokens
+	issued    int
+	logins    int
+	refreshes int
+	pins      []url.Values // forms of pin requests
+}
+
+func newFakeTemporal(t *testing.T, ttl time.Duration) (*fakeTemporal, *Client) {
+	f := &fakeTemporal{t: t, ttl: ttl, tokens: map[string]time.Time{}}
+	c := New("user", "secret")
+	c.BaseURL, c.HTTPClient = puptest.Serve(t, f)
+	return f, c
+}
+
+func (f *fakeTemporal) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == "/v2/auth/login" && r.Method == http.MethodPost {
+		f.logins++
+		var body struct{ Username, Password string }
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Username != "user" || body.Password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"code":401,"message":"incorrect Username or Password"}`)
+			return
+		}
+		f.issue(w)
+		return
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("authorization"), "Bearer ")
+	if expire, ok := f.tokens[token]; !ok || time.Now().After(expire) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"code":401,"message":"Token is expired"}`)
+		return
+	}
+	switch {
+	case r.URL.Path == "/v2/auth/refresh" && r.Method == http.MethodGet:
+		f.refreshes++
+		delete(f.tokens, token)
+		f.issue(w)
+	case r.URL.Path == "/v2/database/uploads" && r.Method == http.MethodGet:
+		var uploads []upload
+		for _, form := range f.pins {
+			uploads = append(uploads, upload{Hash: form.Get("hash"), FileName: form.Get("file_name")})
+		}
+		f.reply(w, uploads)
+	case strings.HasPrefix(r.URL.Path, "/v2/ipfs/public/pin/") && r.Method == http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		form := r.PostForm
+		form.Set("hash", strings.TrimPrefix(r.URL.Path, "/v2/ipfs/public/pin/"))
+		f.pins = append(f.pins, form)
+		f.reply(w, "pin request sent to backend")
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeTemporal) issue(w http.ResponseWriter) {
+	f.issued++
+	token := fmt.Sprintf("token%d", f.issued)
+	f.tokens[token] = time.Now().Add(f.ttl)
+	json.NewEncoder(w).Encode(loginResponse{Token: token, Expire: f.tokens[token]})
+}
+
+func (f *fakeTemporal) reply(w http.ResponseWriter, v interface{}) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		f.t.Error(err)
+	}
+	json.NewEncoder(w).Encode(response{Code: 200, Response: payload})
+}
+
+// revoke invalidates all tokens issued so far.
+func (f *fakeTemporal) revoke() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tokens = map[string]time.Time{}
+}
+
+// counts returns numbers of logins and refreshes.
+func (f *fakeTemporal) counts() (int, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.logins, f.refreshes
+}
+
+func TestRefresh(t *testing.T) {
+	// Tokens expire within refreshMargin, so each use refreshes them
+	f, c := newFakeTemporal(t, time.Minute)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.Fetch(ctx, nil); err != nil {
+			t.Fatalf("Fetch %d: %v", i, err)
+		}
+	}
+	if logins, refreshes := f.counts(); logins != 1 || refreshes != 2 {
+		t.Errorf("%d logins and %d refreshes, want 1 and 2", logins, refreshes)
+	}
+
+	// A revoked token can't be refreshed, so the client logs in again
+	f.revoke()
+	if _, err := c.Fetch(ctx, nil); err != nil {
+		t.Fatalf("Fetch after revocation: %v", err)
+	}
+	if logins, refreshes := f.counts(); logins != 2 || refreshes != 2 {
+		t.Errorf("%d logins and %d refreshes, want 2 and 2", logins, refreshes)
+	}
+}
+
+func TestRelogin(t *testing.T) {
+	f, c := newFakeTemporal(t, time.Hour)
+	ctx := context.Background()
+
+	if err := c.Pin(ctx, "QmA"); err != nil {
+		t.Fatalf("Pin: %v", err)
+	}
+	if err := c.Pin(ctx, "QmB"); err != nil {
+		t.Fatalf("Pin: %v", err)
+	}
+	if logins, refreshes := f.counts(); logins != 1 || refreshes != 0 {
+		t.Errorf("%d logins and %d refreshes, want 1 and 0", logins, refreshes)
+	}
+
+	// A token revoked by the server, though valid according to the client,
+	// is replaced
+	f.revoke()
+	if err := c.Pin(ctx, "QmC"); err != nil {
+		t.Fatalf("Pin after revocation: %v", err)
+	}
+	if logins, _ := f.counts(); logins != 2 {
+		t.Errorf("%d logins, want 2", logins)
+	}
+	list, err := c.Fetch(ctx, nil)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if len(list) != 3 {
+		t.Errorf("Fetch = %v, want 3 pins", list)
+	}
+
+	// Bad credentials fail without looping
+	c.Password = "wrong"
+	f.revoke()
+	if err := c.Pin(ctx, "QmD"); !errors.Is(err, pup.ErrUnauthorized) {
+		t.Errorf("Pin with bad password = %v, want ErrUnauthorized", err)
+	}
+	if logins, _ := f.counts(); logins != 3 {
+		t.Errorf("%d logins, want 3", logins)
+	}
+}
+
+func TestPinForm(t *testing.T) {
+	f, c := newFakeTemporal(t, time.Hour)
+	ctx := context.Background()
+
+	if err := c.Pin(ctx, "QmA"); err != nil {
+		t.Fatalf("Pin: %v", err)
+	}
+	err := c.PinWithOptions(ctx, "QmB", pup.PinOptions{Metadata: pup.Metadata{Name: "cat & dog.jpg"}})
+	if err != nil {
+		t.Fatalf("PinWithOptions: %v", err)
+	}
+	c.HoldTime = 12
+	if err := c.Pin(ctx, "QmC"); err != nil {
+		t.Fatalf("Pin: %v", err)
+	}
+	if err := c.PinFor(ctx, "QmD", "dog.jpg", 1); err != nil {
+		t.Fatalf("PinFor: %v", err)
+	}
+
+	want := []url.Values{
+		{"hash": {"QmA"}, "hold_time": {"6"}},
+		{"hash": {"QmB"}, "hold_time": {"6"}, "file_name": {"cat & dog.jpg"}},
+		{"hash": {"QmC"}, "hold_time": {"12"}},
+		{"hash": {"QmD"}, "hold_time": {"1"}, "file_name": {"dog.jpg"}},
+	}
+	if !reflect.DeepEqual(f.pins, want) {
+		t.Errorf("pinned with forms %v, want %v", f.pins, want)
+	}
+
+	list, err := c.Fetch(ctx, []pup.Hash{"QmB", "QmX"})
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if want := []pup.NamedHash{{Hash: "QmB", Name: "cat & dog.jpg"}}; !reflect.DeepEqual(list, want) {
+		t.Errorf("Fetch = %v, want %v", list, want)
+	}
+}
+
+func TestUnpinUnsupported(t *testing.T) {
+	_, c := newFakeTemporal(t, time.Hour)
+	if pup.CanUnpin(c) {
+		t.Error("CanUnpin = true, want false")
+	}
+	if err := c.Unpin(context.Background(), "QmA"); !errors.Is(err, ErrUnpinUnsupported) {
+		t.Errorf("Unpin = %v, want %v", err, ErrUnpinUnsupported)
+	}
+}
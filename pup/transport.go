@@ -0,0 +1,208 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package pup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Transport is an http.RoundTripper for talking to pinning services. It
+// retries requests which were throttled by the service, waiting with
+// exponential backoff and jitter, or as long as requested in a Retry-After
+// header. Requests which failed with network errors or gateway timeouts are
+// retried only if they are idempotent, or never reached the service, so that
+// e.g. a pin request is not sent twice. It can also limit the number of
+// requests in flight.
+//
+// Retries never extend past the deadline of the request's context: if the
+// wait would end after it, the last response or error is returned instead,
+// so callers can use short timeouts without losing the reason of failure.
+// Clients using a Transport shouldn't retry requests themselves.
+//
+// The zero value is usable, with defaults described on the fields.
+type Transport struct {
+	// Base is the underlying transport; http.DefaultTransport if nil.
+	Base http.RoundTripper
+	// MaxRetries is the number of retries after the first attempt; 4 if zero,
+	// no retries if negative.
+	MaxRetries int
+	// MinBackoff and MaxBackoff bound the delay between attempts; 500ms and
+	// 30s if zero. A response with a Retry-After longer than MaxBackoff is
+	// returned to the caller instead of being waited for.
+	MinBackoff, MaxBackoff time.Duration
+	// MaxConcurrent limits the number of requests in flight at once;
+	// unlimited if zero.
+	MaxConcurrent int
+
+	once sync.Once
+	sem  chan struct{}
+}
+
+// NewHTTPClient returns an *http.Client using a Transport with default retry
+// settings, allowing at most maxConcurrent requests in flight (unlimited if
+// zero).
+func NewHTTPClient(maxConcurrent int) *http.Client {
+	return &http.Client{
+		Transport: &Transport{MaxConcurrent: maxConcurrent},
+	}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.once.Do(func() {
+		if t.MaxConcurrent > 0 {
+			t.sem = make(chan struct{}, t.MaxConcurrent)
+		}
+	})
+
+	maxRetries := t.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = 4
+	}
+	minBackoff, maxBackoff := t.MinBackoff, t.MaxBackoff
+	if minBackoff == 0 {
+		minBackoff = 500 * time.Millisecond
+	}
+	if maxBackoff == 0 {
+		maxBackoff = 30 * time.Second
+	}
+	ctx := req.Context()
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.Body != nil {
+			// The previous attempt consumed the body, we need a fresh copy.
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(ctx)
+			req.Body = body
+		}
+
+		resp, err := t.roundTrip(req)
+
+		// Is it worth trying again?
+		canRetry := attempt < maxRetries &&
+			(req.Body == nil || req.GetBody != nil) &&
+			ctx.Err() == nil
+		if !canRetry || !shouldRetry(req, resp, err) {
+			return resp, err
+		}
+		wait := Backoff(attempt, minBackoff, maxBackoff)
+		if resp != nil {
+			if d := ParseRetryAfter(resp.Header.Get("Retry-After")); d > maxBackoff {
+				// Too long to block the caller; let them decide.
+				return resp, err
+			} else if d > 0 {
+				wait = d
+			}
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			// We would fail with a less informative context error.
+			return resp, err
+		}
+		if resp != nil {
+			// Discard the body so that the connection can be reused.
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxErrorBody))
+			resp.Body.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (t *Transport) roundTrip(req *http.Request) (*http.Response, error) {
+	if t.sem != nil {
+		select {
+		case t.sem <- struct{}{}:
+			defer func() { <-t.sem }()
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(req)
+}
+
+// shouldRetry reports whether req, which ended with resp and err, is worth
+// retrying and safe to send again.
+func shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return false
+		}
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			// The service never saw the request.
+			return true
+		}
+		var netErr net.Error
+		retryable := errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+		return retryable && isIdempotent(req)
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		// The service refused to handle the request.
+		return true
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		// The request may have been handled behind the gateway.
+		return isIdempotent(req)
+	}
+	return false
+}
+
+// isIdempotent reports whether sending req several times has the same effect
+// as sending it once.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// Backoff returns a randomized delay before the retry number attempt
+// (counting from 0), growing exponentially from min up to max.
+func Backoff(attempt int, min, max time.Duration) time.Duration {
+	d := min
+	for i := 0; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	// "Equal jitter": wait at least half of the delay, to avoid hammering the
+	// service, but spread the attempts of concurrent clients.
+	half := int64(d / 2)
+	if half <= 0 {
+		return d
+	}
+	return time.Duration(half + rand.Int63n(half+1))
+}
@@ -0,0 +1,266 @@
+// Copyright (C) 2020  WPEngine
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package pup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// throttlingServer responds to each request with the next status from
+// statuses, and 200 OK once they run out. It counts requests it received.
+type throttlingServer struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	statuses   []int
+	retryAfter string
+	requests   int
+}
+
+func newThrottlingServer(t *testing.T, retryAfter string, statuses ...int) *throttlingServer {
+	s := &throttlingServer{statuses: statuses, retryAfter: retryAfter}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests++
+		io.Copy(ioutil.Discard, r.Body)
+		if len(s.statuses) == 0 {
+			w.Write([]byte("ok"))
+			return
+		}
+		status := s.statuses[0]
+		s.statuses = s.statuses[1:]
+		if s.retryAfter != "" {
+			w.Header().Set("Retry-After", s.retryAfter)
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *throttlingServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// send sends a request with a body to url via a Transport with short
+// backoff.
+func send(ctx context.Context, t *testing.T, method, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &Transport{MinBackoff: time.Millisecond, MaxBackoff: 2 * time.Second}
+	resp, err := tr.RoundTrip(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return resp, err
+}
+
+func TestTransportRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		statuses []int
+		want     int // final status
+		requests int
+	}{
+		{"429", http.MethodPost, []int{429, 429}, 200, 3},
+		{"503", http.MethodPost, []int{503}, 200, 2},
+		{"502 GET", http.MethodGet, []int{502, 504}, 200, 3},
+		// The pin may have been made behind the gateway
+		{"502 POST", http.MethodPost, []int{502}, 502, 1},
+		{"500", http.MethodGet, []int{500}, 500, 1},
+		{"400", http.MethodGet, []int{400}, 400, 1},
+		{"exhausted", http.MethodGet, []int{429, 429, 429, 429, 429, 429}, 429, 5},
+	}
+	for _, tt := range tests {
+		s := newThrottlingServer(t, "", tt.statuses...)
+		resp, err := send(context.Background(), t, tt.method, s.URL)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if resp.StatusCode != tt.want || s.count() != tt.requests {
+			t.Errorf("%s: got %d after %d requests, want %d after %d", tt.name, resp.StatusCode, s.count(), tt.want, tt.requests)
+		}
+	}
+}
+
+func TestTransportRetryAfter(t *testing.T) {
+	s := newThrottlingServer(t, "1", 429)
+	start := time.Now()
+	resp, err := send(context.Background(), t, http.MethodPost, s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 || s.count() != 2 {
+		t.Errorf("got %d after %d requests, want 200 after 2", resp.StatusCode, s.count())
+	}
+	if d := time.Since(start); d < time.Second {
+		t.Errorf("retried after %s, want at least Retry-After of 1s", d)
+	}
+
+	// Waits longer than MaxBackoff are left to the caller
+	s = newThrottlingServer(t, "60", 429)
+	resp, err = send(context.Background(), t, http.MethodGet, s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 429 || s.count() != 1 {
+		t.Errorf("with long Retry-After got %d after %d requests, want 429 after 1", resp.StatusCode, s.count())
+	}
+	if err := CheckResponse(resp); RetryAfter(err) != time.Minute {
+		t.Errorf("with long Retry-After got %v, want a RateLimitError with 1m", err)
+	}
+
+	// ...and so are waits past the deadline
+	s = newThrottlingServer(t, "1", 503)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	resp, err = send(ctx, t, http.MethodGet, s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 503 || s.count() != 1 {
+		t.Errorf("with short deadline got %d after %d requests, want 503 after 1", resp.StatusCode, s.count())
+	}
+}
+
+func TestTransportCancelDuringBackoff(t *testing.T) {
+	s := newThrottlingServer(t, "1", 429)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := send(ctx, t, http.MethodGet, s.URL)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("returned after %s, want right after cancellation", d)
+	}
+	if s.count() != 1 {
+		t.Errorf("made %d requests, want 1", s.count())
+	}
+}
+
+// failingTransport fails every request with err, counting them.
+type failingTransport struct {
+	err      error
+	requests int
+}
+
+func (f *failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.requests++
+	return nil, f.err
+}
+
+func TestTransportNetworkErrors(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+	tests := []struct {
+		method   string
+		err      error
+		requests int
+	}{
+		{http.MethodGet, reset, 3},
+		{http.MethodDelete, io.ErrUnexpectedEOF, 3},
+		// The service may have handled the request before failing
+		{http.MethodPost, reset, 1},
+		{http.MethodPost, io.EOF, 1},
+		// ...unless it never got it
+		{http.MethodPost, refused, 3},
+		{http.MethodGet, errors.New("bad things"), 1},
+	}
+	for _, tt := range tests {
+		base := &failingTransport{err: tt.err}
+		tr := &Transport{Base: base, MaxRetries: 2, MinBackoff: time.Millisecond}
+		req, err := http.NewRequest(tt.method, "http://example.com/", strings.NewReader("body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tr.RoundTrip(req); err != tt.err {
+			t.Errorf("%s with %v: got error %v", tt.method, tt.err, err)
+		}
+		if base.requests != tt.requests {
+			t.Errorf("%s with %v: made %d requests, want %d", tt.method, tt.err, base.requests, tt.requests)
+		}
+	}
+}
+
+func TestTransportMaxConcurrent(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, max := 0, 0
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > max {
+			max = inFlight
+		}
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	client := NewHTTPClient(2)
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(srv.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if max != 2 {
+		t.Errorf("max %d requests in flight, want 2", max)
+	}
+
+	// Requests waiting for a slot give up when cancelled
+	tr := &Transport{Base: &failingTransport{}, MaxConcurrent: 1}
+	tr.once.Do(func() { tr.sem = make(chan struct{}, 1) })
+	tr.sem <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com/", nil)
+	if _, err := tr.RoundTrip(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("waiting for a slot: got %v, want DeadlineExceeded", err)
+	}
+}